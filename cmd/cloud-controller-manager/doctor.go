@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Krystal Hosting Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/krystal/kce-ccm/kce"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// newDoctorCommand returns the doctor subcommand, which reports problems with
+// the provider configuration and the cluster's load balancers.
+func newDoctorCommand() *cobra.Command {
+	var kubeconfig, clusterName, output string
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose the KCE configuration and load balancers",
+		Long: `Checks the Katapult configuration from the environment, then compares the
+load balancers owned by the cluster with the Services in the cluster and
+reports any drift, orphaned load balancers or misconfiguration.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "text" && output != "json" {
+				return fmt.Errorf("unsupported output %q, must be text or json", output)
+			}
+
+			kube, err := newKubeClient(kubeconfig)
+			if err != nil {
+				return err
+			}
+
+			report := kce.RunDoctor(context.Background(), kube, clusterName)
+			if output == "json" {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(report); err != nil {
+					return err
+				}
+			} else {
+				report.WriteText(cmd.OutOrStdout())
+			}
+
+			if !report.Healthy() {
+				os.Exit(2)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, defaults to the usual kubectl locations")
+	cmd.Flags().StringVar(&clusterName, "cluster-name", "", "Name of the cluster, defaults to KATAPULT_CLUSTER_NAME or \"kubernetes\"")
+	cmd.Flags().StringVarP(&output, "output", "o", "text", "Output format, text or json")
+
+	return cmd
+}
+
+// newKubeClient builds a client from a kubeconfig, following the same
+// loading rules as kubectl when no path is given.
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules, &clientcmd.ConfigOverrides{},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	return kubernetes.NewForConfig(config)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 Krystal Hosting Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/krystal/kce-ccm/kce"
+	"github.com/spf13/cobra"
+)
+
+// lbOptions are the flags shared by the lb subcommands.
+type lbOptions struct {
+	kubeconfig  string
+	clusterName string
+	namespace   string
+	output      string
+}
+
+// run creates a load balancer tool and passes it to fn, printing the load
+// balancers it returns.
+func (o *lbOptions) run(cmd *cobra.Command, fn func(ctx context.Context, t *kce.LoadBalancerTool) ([]kce.LoadBalancerInfo, error)) error {
+	if o.output != "text" && o.output != "json" {
+		return fmt.Errorf("unsupported output %q, must be text or json", o.output)
+	}
+
+	kube, err := newKubeClient(o.kubeconfig)
+	if err != nil {
+		return err
+	}
+	t, err := kce.NewLoadBalancerTool(kube, o.clusterName)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	lbs, err := fn(context.Background(), t)
+	if lbs != nil {
+		if err := o.print(cmd.OutOrStdout(), lbs); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (o *lbOptions) print(w io.Writer, lbs []kce.LoadBalancerInfo) error {
+	if o.output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(lbs)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tIP\tSERVICE\tTARGET\tRULES")
+	for _, lb := range lbs {
+		service := lb.Service
+		if service == "" {
+			service = "<none>"
+		}
+
+		rules := []string{}
+		for _, rule := range lb.Rules {
+			rules = append(rules, fmt.Sprintf("%d->%d/%s", rule.ListenPort, rule.DestinationPort, rule.Protocol))
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s:%s\t%s\n",
+			lb.ID, lb.Name, lb.IP, service,
+			lb.ResourceType, strings.Join(lb.ResourceIDs, ","),
+			strings.Join(rules, ","),
+		)
+	}
+
+	return tw.Flush()
+}
+
+// newLBCommand returns the lb subcommand, which performs the controller's
+// load balancer operations on demand.
+func newLBCommand() *cobra.Command {
+	o := &lbOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "lb",
+		Short: "Inspect and repair the load balancers of a KCE cluster",
+		Long: `Acts on the load balancers owned by the cluster, using the Katapult
+configuration from the environment. Changes are made in exactly the same way
+as the controller makes them.`,
+	}
+
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, defaults to the usual kubectl locations")
+	flags.StringVar(&o.clusterName, "cluster-name", "", "Name of the cluster, defaults to KATAPULT_CLUSTER_NAME or \"kubernetes\"")
+	flags.StringVarP(&o.namespace, "namespace", "n", "default", "Namespace of the service")
+	flags.StringVarP(&o.output, "output", "o", "text", "Output format, text or json")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "list",
+		Short:        "List the load balancers owned by the cluster",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(ctx context.Context, t *kce.LoadBalancerTool) ([]kce.LoadBalancerInfo, error) {
+				return t.List(ctx)
+			})
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "show <service>",
+		Short:        "Show the load balancers of a service",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(ctx context.Context, t *kce.LoadBalancerTool) ([]kce.LoadBalancerInfo, error) {
+				return t.Show(ctx, o.namespace, args[0])
+			})
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "resync <service>",
+		Short:        "Reconcile the load balancers of a service now",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(ctx context.Context, t *kce.LoadBalancerTool) ([]kce.LoadBalancerInfo, error) {
+				if _, err := t.Resync(ctx, o.namespace, args[0]); err != nil {
+					return nil, err
+				}
+				return t.Show(ctx, o.namespace, args[0])
+			})
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "release <service>",
+		Short: "Keep the load balancers of a service when it is deleted",
+		Long: `Sets the retain deletion policy on a service, so that its load balancers
+and their IP addresses are left in place when the service is deleted or
+changes type.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(ctx context.Context, t *kce.LoadBalancerTool) ([]kce.LoadBalancerInfo, error) {
+				return t.Release(ctx, o.namespace, args[0])
+			})
+		},
+	})
+
+	var dryRun bool
+	gc := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete load balancers that no service uses",
+		Long: `Lists the load balancers named for the cluster and targeting its nodes that
+no service uses, and deletes them when run with --dry-run=false. Load
+balancers released by their service, and adopted load balancers, are not named
+for the cluster and are never deleted.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(ctx context.Context, t *kce.LoadBalancerTool) ([]kce.LoadBalancerInfo, error) {
+				return t.GC(ctx, dryRun)
+			})
+		},
+	}
+	gc.Flags().BoolVar(&dryRun, "dry-run", true, "Only list the load balancers that would be deleted, set to false to delete them")
+	cmd.AddCommand(gc)
+
+	return cmd
+}
@@ -31,6 +31,7 @@ import (
 	"time"
 
 	"github.com/krystal/kce-ccm/kce"
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/apimachinery/pkg/util/wait"
 	cloudprovider "k8s.io/cloud-provider"
@@ -60,6 +61,10 @@ func main() {
 
 	// Create a CCM Command instance
 	command := app.NewCloudControllerManagerCommand(opts, cloudInitializer, controllerInitializers, fss, wait.NeverStop)
+	command.AddCommand(
+		withDefaultHelp(newDoctorCommand()),
+		withDefaultHelp(newLBCommand()),
+	)
 
 	// TODO: Switch to utilflag.InitFlags() once k8s switches to Cobra
 	// https://github.com/kubernetes/cloud-provider-gcp/issues/215
@@ -69,6 +74,16 @@ func main() {
 	}
 }
 
+// withDefaultHelp restores cobra's usual help for a subcommand, rather than
+// the CCM's, which lists the controller manager's flags.
+func withDefaultHelp(cmd *cobra.Command) *cobra.Command {
+	defaults := &cobra.Command{}
+	cmd.SetHelpFunc(defaults.HelpFunc())
+	cmd.SetUsageFunc(defaults.UsageFunc())
+
+	return cmd
+}
+
 func cloudInitializer(config *config.CompletedConfig) cloudprovider.Interface {
 	cloudConfig := config.ComponentConfig.KubeCloudShared.CloudProvider
 
@@ -0,0 +1,71 @@
+// The fake-katapult command serves an in-memory Katapult API, so that the
+// cloud controller manager can be run locally without a Katapult account.
+// See `make dev`.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/krystal/go-katapult/core"
+	"github.com/krystal/kce-ccm/internal/fakekatapult"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8780", "address to serve the API on")
+	token := flag.String("token", "dev", "API token to accept, or empty to accept any token")
+	org := flag.String("organization", "org_dev", "RID of the organization to create")
+	dataCenter := flag.String("data-center", "dc_dev", "RID of the data center VMs are created in")
+	nodeTag := flag.String("node-tag", "tag_dev_nodes", "RID of the tag applied to every VM")
+	nodes := flag.String("nodes", "", "comma separated FQDNs of VMs to create, normally the cluster's node names")
+	latency := flag.Duration("latency", 0, "delay added to every response")
+	flag.Parse()
+
+	s := fakekatapult.NewServer()
+	s.Token = *token
+	s.AddOrganization(core.Organization{ID: *org, SubDomain: "dev"})
+
+	zone := &core.Zone{
+		ID:         "zone_dev",
+		Permalink:  "dev-zone",
+		DataCenter: &core.DataCenter{ID: *dataCenter, Permalink: "dev"},
+	}
+	tag := &core.Tag{ID: *nodeTag, Name: "nodes"}
+	for i, fqdn := range strings.Split(*nodes, ",") {
+		if fqdn == "" {
+			continue
+		}
+
+		id := fmt.Sprintf("vm_dev_%d", i+1)
+		s.AddVirtualMachine(*org, core.VirtualMachine{
+			ID:          id,
+			Name:        fqdn,
+			Hostname:    strings.Split(fqdn, ".")[0],
+			FQDN:        fqdn,
+			State:       core.VirtualMachineStarted,
+			Zone:        zone,
+			Package:     &core.VirtualMachinePackage{ID: "vmpkg_dev", Permalink: "rock-3"},
+			Tags:        []*core.Tag{tag},
+			IPAddresses: []*core.IPAddress{{ID: fmt.Sprintf("ip_dev_%d", i+1), Address: fmt.Sprintf("198.51.100.%d", i+1)}},
+		})
+		s.AddNetworkInterface(id, core.VirtualMachineNetworkInterface{
+			ID:          fmt.Sprintf("nic_dev_%d", i+1),
+			Network:     &core.Network{ID: "netw_dev_public"},
+			IPAddresses: []*core.IPAddress{{Address: fmt.Sprintf("198.51.100.%d", i+1)}},
+		})
+	}
+	if *latency > 0 {
+		s.AddFault(fakekatapult.Fault{Latency: *latency})
+	}
+
+	log.Printf("serving fake Katapult API for %s on http://%s", *org, *listen)
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Fatal(server.ListenAndServe())
+}
@@ -0,0 +1,327 @@
+//go:build e2e
+// +build e2e
+
+// Package e2e runs the cloud-provider service controller with the kce
+// provider against a real kube-apiserver and a fake Katapult API.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"github.com/krystal/go-katapult/core"
+	"github.com/krystal/kce-ccm/internal/fakekatapult"
+	"github.com/krystal/kce-ccm/kce"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/cloud-provider/controllers/service"
+	"k8s.io/component-base/featuregate"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	e2eOrganizationID = "org_e2e"
+	e2eDataCenterID   = "dc_e2e"
+	e2eNodeTagID      = "tag_e2e_nodes"
+	e2eClusterName    = "kce-e2e"
+)
+
+var (
+	kube     kubernetes.Interface
+	katapult *fakekatapult.Server
+)
+
+func TestMain(m *testing.M) {
+	// Skipping is only allowed locally, so that CI cannot pass without
+	// running the tests.
+	assets := os.Getenv("KUBEBUILDER_ASSETS")
+	if assets == "" {
+		if os.Getenv("CI") != "" {
+			fmt.Fprintln(os.Stderr, "KUBEBUILDER_ASSETS must be set to run the e2e tests in CI")
+			os.Exit(1)
+		}
+		fmt.Println("skipping e2e tests, KUBEBUILDER_ASSETS is not set")
+		os.Exit(0)
+	}
+
+	os.Exit(run(m, assets))
+}
+
+func run(m *testing.M, assets string) int {
+	env, err := startTestEnv(assets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer env.stop()
+
+	kube, err = env.client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	katapult = fakekatapult.NewServer()
+	katapult.Token = "e2e"
+	katapult.AddOrganization(core.Organization{ID: e2eOrganizationID})
+	srv := httptest.NewServer(katapult)
+	defer srv.Close()
+
+	for k, v := range map[string]string{
+		"KATAPULT_API_HOST":         srv.URL,
+		"KATAPULT_API_TOKEN":        katapult.Token,
+		"KATAPULT_ORGANIZATION_RID": e2eOrganizationID,
+		"KATAPULT_DATA_CENTER_RID":  e2eDataCenterID,
+		"KATAPULT_NODE_TAG_RID":     e2eNodeTagID,
+		"KATAPULT_CLUSTER_NAME":     e2eClusterName,
+	} {
+		os.Setenv(k, v)
+	}
+
+	cloud, err := cloudprovider.InitCloudProvider(kce.ProviderName, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	cloud.Initialize(clientBuilder{config: env.config}, stop)
+
+	factory := informers.NewSharedInformerFactory(kube, 0)
+	controller, err := service.New(
+		cloud,
+		kube,
+		factory.Core().V1().Services(),
+		factory.Core().V1().Nodes(),
+		e2eClusterName,
+		featuregate.NewFeatureGate(),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	factory.Start(stop)
+	go controller.Run(stop, 2)
+
+	return m.Run()
+}
+
+// eventually polls until condition is true, failing the test if it never is.
+func eventually(t *testing.T, msg string, condition func() bool) {
+	t.Helper()
+
+	err := wait.PollImmediate(100*time.Millisecond, 30*time.Second, func() (bool, error) {
+		return condition(), nil
+	})
+	require.NoError(t, err, msg)
+}
+
+func createNode(t *testing.T, name string) {
+	t.Helper()
+	ctx := context.Background()
+
+	node, err := kube.CoreV1().Nodes().Create(ctx, &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	node.Status.Conditions = []v1.NodeCondition{{
+		Type:   v1.NodeReady,
+		Status: v1.ConditionTrue,
+	}}
+	_, err = kube.CoreV1().Nodes().UpdateStatus(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = kube.CoreV1().Nodes().Delete(context.Background(), name, metav1.DeleteOptions{})
+	})
+}
+
+func createService(t *testing.T, name string, annotations map[string]string, ports ...int32) *v1.Service {
+	t.Helper()
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   metav1.NamespaceDefault,
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeLoadBalancer,
+			Selector: map[string]string{"app": name},
+		},
+	}
+	for _, port := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{
+			Name: fmt.Sprintf("port-%d", port),
+			Port: port,
+		})
+	}
+
+	svc, err := kube.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	return svc
+}
+
+func getService(t *testing.T, name string) *v1.Service {
+	t.Helper()
+
+	svc, err := kube.CoreV1().Services(metav1.NamespaceDefault).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	return svc
+}
+
+// waitForLoadBalancer waits for a service to be given an IP address, and
+// returns the load balancer with that address.
+func waitForLoadBalancer(t *testing.T, name string) core.LoadBalancer {
+	t.Helper()
+
+	var lb core.LoadBalancer
+	eventually(t, "service was not given a load balancer", func() bool {
+		svc := getService(t, name)
+		if len(svc.Status.LoadBalancer.Ingress) == 0 {
+			return false
+		}
+
+		found, ok := loadBalancerWithIP(svc.Status.LoadBalancer.Ingress[0].IP)
+		lb = found
+		return ok
+	})
+
+	return lb
+}
+
+func loadBalancerWithIP(ip string) (core.LoadBalancer, bool) {
+	for _, lb := range katapult.LoadBalancers() {
+		if lb.IPAddress != nil && lb.IPAddress.Address == ip {
+			return lb, true
+		}
+	}
+
+	return core.LoadBalancer{}, false
+}
+
+func loadBalancerExists(id string) bool {
+	for _, lb := range katapult.LoadBalancers() {
+		if lb.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ruleDestinations maps each rule's listen port to its destination port.
+func ruleDestinations(lbID string) map[int]int {
+	ports := map[int]int{}
+	for _, rule := range katapult.LoadBalancerRules(lbID) {
+		ports[rule.ListenPort] = rule.DestinationPort
+	}
+
+	return ports
+}
+
+// nodePorts maps each of a service's ports to its node port.
+func nodePorts(svc *v1.Service) map[int]int {
+	ports := map[int]int{}
+	for _, port := range svc.Spec.Ports {
+		ports[int(port.Port)] = int(port.NodePort)
+	}
+
+	return ports
+}
+
+func TestService_lifecycle(t *testing.T) {
+	ctx := context.Background()
+	createNode(t, "lifecycle-node-1")
+	createService(t, "lifecycle", nil, 80)
+
+	lb := waitForLoadBalancer(t, "lifecycle")
+	assert.Equal(t, core.VirtualMachineGroupsResourceType, lb.ResourceType)
+	assert.Equal(t, []string{e2eNodeTagID}, lb.ResourceIDs)
+	eventually(t, "rules were not created", func() bool {
+		return assert.ObjectsAreEqual(nodePorts(getService(t, "lifecycle")), ruleDestinations(lb.ID))
+	})
+	assert.Contains(t, getService(t, "lifecycle").Finalizers, "service.kubernetes.io/load-balancer-cleanup")
+
+	// Adding a port adds a rule to the same load balancer.
+	svc := getService(t, "lifecycle")
+	svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "port-443", Port: 443})
+	_, err := kube.CoreV1().Services(svc.Namespace).Update(ctx, svc, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	eventually(t, "rule was not added", func() bool {
+		return len(ruleDestinations(lb.ID)) == 2 &&
+			assert.ObjectsAreEqual(nodePorts(getService(t, "lifecycle")), ruleDestinations(lb.ID))
+	})
+	assert.Len(t, katapult.LoadBalancers(), 1)
+
+	// Deleting the service deletes the load balancer before the finalizer
+	// is removed.
+	err = kube.CoreV1().Services(svc.Namespace).Delete(ctx, svc.Name, metav1.DeleteOptions{})
+	require.NoError(t, err)
+	eventually(t, "service was not deleted", func() bool {
+		_, err := kube.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		return apierrors.IsNotFound(err)
+	})
+	assert.False(t, loadBalancerExists(lb.ID))
+}
+
+func TestService_retained(t *testing.T) {
+	ctx := context.Background()
+	createNode(t, "retained-node-1")
+	createService(t, "retained", map[string]string{
+		"kce.krystal.uk/load-balancer-deletion-policy": "retain",
+	}, 80)
+
+	lb := waitForLoadBalancer(t, "retained")
+
+	err := kube.CoreV1().Services(metav1.NamespaceDefault).Delete(ctx, "retained", metav1.DeleteOptions{})
+	require.NoError(t, err)
+	eventually(t, "service was not deleted", func() bool {
+		_, err := kube.CoreV1().Services(metav1.NamespaceDefault).Get(ctx, "retained", metav1.GetOptions{})
+		return apierrors.IsNotFound(err)
+	})
+	assert.True(t, loadBalancerExists(lb.ID))
+	assert.Len(t, katapult.LoadBalancerRules(lb.ID), 1)
+}
+
+func TestService_nodeChanges(t *testing.T) {
+	ctx := context.Background()
+	createNode(t, "nodes-node-1")
+	createService(t, "nodes", nil, 80)
+	t.Cleanup(func() {
+		_ = kube.CoreV1().Services(metav1.NamespaceDefault).Delete(context.Background(), "nodes", metav1.DeleteOptions{})
+	})
+
+	lb := waitForLoadBalancer(t, "nodes")
+	eventually(t, "rules were not created", func() bool {
+		return len(katapult.LoadBalancerRules(lb.ID)) == 1
+	})
+	katapult.ResetRequests()
+
+	// The load balancer targets the node tag rather than individual nodes,
+	// so adding and removing nodes must leave it untouched.
+	createNode(t, "nodes-node-2")
+	err := kube.CoreV1().Nodes().Delete(ctx, "nodes-node-1", metav1.DeleteOptions{})
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Second)
+	for _, req := range katapult.Requests() {
+		assert.Equal(t, http.MethodGet, req.Method, "unexpected request to %s", req.Path)
+	}
+	assert.True(t, loadBalancerExists(lb.ID))
+	assert.Len(t, katapult.LoadBalancerRules(lb.ID), 1)
+}
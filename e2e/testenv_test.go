@@ -0,0 +1,228 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// testEnv runs etcd and kube-apiserver from the binaries envtest uses, found
+// in $KUBEBUILDER_ASSETS. These can be installed with setup-envtest:
+//
+//	export KUBEBUILDER_ASSETS=$(setup-envtest use -p path 1.21.x)
+//
+// controller-runtime's envtest package is not used, as the versions that
+// support this repository's Kubernetes libraries need newer dependencies.
+type testEnv struct {
+	dir    string
+	cmds   []*exec.Cmd
+	config *rest.Config
+}
+
+const testEnvToken = "kce-e2e-token"
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startTestEnv starts etcd and kube-apiserver, and waits for the API server
+// to be ready.
+func startTestEnv(assets string) (env *testEnv, err error) {
+	dir, err := ioutil.TempDir("", "kce-e2e")
+	if err != nil {
+		return nil, err
+	}
+	env = &testEnv{dir: dir}
+	defer func() {
+		if err != nil {
+			env.stop()
+		}
+	}()
+
+	etcdPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	etcdPeerPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	etcdURL := fmt.Sprintf("http://127.0.0.1:%d", etcdPort)
+	err = env.start(filepath.Join(assets, "etcd"),
+		"--data-dir="+filepath.Join(dir, "etcd"),
+		"--listen-client-urls="+etcdURL,
+		"--advertise-client-urls="+etcdURL,
+		fmt.Sprintf("--listen-peer-urls=http://127.0.0.1:%d", etcdPeerPort),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = waitForHealthy(http.DefaultClient, etcdURL+"/health")
+	if err != nil {
+		return nil, fmt.Errorf("etcd did not start: %w", err)
+	}
+
+	keyFile := filepath.Join(dir, "sa.key")
+	err = writeServiceAccountKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tokenFile := filepath.Join(dir, "tokens.csv")
+	err = ioutil.WriteFile(tokenFile, []byte(testEnvToken+",admin,admin,system:masters\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	apiPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	err = env.start(filepath.Join(assets, "kube-apiserver"),
+		"--etcd-servers="+etcdURL,
+		"--cert-dir="+filepath.Join(dir, "certs"),
+		"--bind-address=127.0.0.1",
+		fmt.Sprintf("--secure-port=%d", apiPort),
+		"--token-auth-file="+tokenFile,
+		"--authorization-mode=AlwaysAllow",
+		"--service-cluster-ip-range=10.0.0.0/24",
+		"--service-account-issuer=https://kubernetes.default.svc",
+		"--service-account-key-file="+keyFile,
+		"--service-account-signing-key-file="+keyFile,
+		"--disable-admission-plugins=ServiceAccount",
+		"--allow-privileged=true",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	env.config = &rest.Config{
+		Host:            fmt.Sprintf("https://127.0.0.1:%d", apiPort),
+		BearerToken:     testEnvToken,
+		TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+	}
+	transport, err := rest.TransportFor(env.config)
+	if err != nil {
+		return nil, err
+	}
+	err = waitForHealthy(&http.Client{Transport: transport}, env.config.Host+"/readyz")
+	if err != nil {
+		return nil, fmt.Errorf("kube-apiserver did not start: %w", err)
+	}
+
+	return env, nil
+}
+
+func (env *testEnv) start(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if os.Getenv("KCE_E2E_VERBOSE") != "" {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	env.cmds = append(env.cmds, cmd)
+
+	return nil
+}
+
+func (env *testEnv) stop() {
+	for i := len(env.cmds) - 1; i >= 0; i-- {
+		_ = env.cmds[i].Process.Kill()
+		_ = env.cmds[i].Wait()
+	}
+	_ = os.RemoveAll(env.dir)
+}
+
+func (env *testEnv) client() (kubernetes.Interface, error) {
+	return kubernetes.NewForConfig(env.config)
+}
+
+func waitForHealthy(client *http.Client, url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func writeServiceAccountKey(path string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+}
+
+// clientBuilder hands the test environment's config to the provider.
+type clientBuilder struct {
+	config *rest.Config
+}
+
+func (b clientBuilder) Config(_ string) (*rest.Config, error) {
+	return rest.CopyConfig(b.config), nil
+}
+
+func (b clientBuilder) ConfigOrDie(name string) *rest.Config {
+	config, err := b.Config(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return config
+}
+
+func (b clientBuilder) Client(name string) (kubernetes.Interface, error) {
+	return kubernetes.NewForConfig(b.ConfigOrDie(name))
+}
+
+func (b clientBuilder) ClientOrDie(name string) kubernetes.Interface {
+	client, err := b.Client(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return client
+}
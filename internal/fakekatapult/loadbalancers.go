@@ -0,0 +1,372 @@
+package fakekatapult
+
+import (
+	"fmt"
+	"github.com/krystal/go-katapult/core"
+	"net/http"
+	"net/url"
+)
+
+func (s *Server) findLoadBalancer(id string) *loadBalancer {
+	for _, lb := range s.loadBalancers {
+		if lb.ID == id {
+			return lb
+		}
+	}
+
+	return nil
+}
+
+// loadBalancer resolves the load balancer identified by ref, writing an error
+// if it does not exist.
+func (s *Server) loadBalancer(w http.ResponseWriter, ref core.LoadBalancerRef) (*loadBalancer, bool) {
+	lb := s.findLoadBalancer(ref.ID)
+	if lb == nil {
+		writeError(w, http.StatusNotFound, "load_balancer_not_found",
+			"No load balancer was found matching any of the criteria provided in the arguments")
+		return nil, false
+	}
+
+	return lb, true
+}
+
+// rule resolves the rule identified by the query string, writing an error if
+// it does not exist.
+func (s *Server) rule(w http.ResponseWriter, q url.Values) (*core.LoadBalancerRule, bool) {
+	rule, ok := s.rules[q.Get("load_balancer_rule[id]")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "load_balancer_rule_not_found",
+			"No load balancer rule was found matching any of the criteria provided in the arguments")
+		return nil, false
+	}
+
+	return rule, true
+}
+
+func validResourceType(t core.ResourceType) bool {
+	switch t {
+	case core.TagsResourceType, core.VirtualMachineGroupsResourceType, core.VirtualMachinesResourceType:
+		return true
+	}
+
+	return false
+}
+
+func (s *Server) listLoadBalancers(w http.ResponseWriter, q url.Values) {
+	org, ok := s.organization(w, q)
+	if !ok {
+		return
+	}
+
+	list := []*core.LoadBalancer{}
+	for _, lb := range s.loadBalancers {
+		if lb.orgID == org.ID {
+			lb := lb.LoadBalancer
+			list = append(list, &lb)
+		}
+	}
+
+	start, end, pagination := s.page(q, len(list))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pagination":     pagination,
+		"load_balancers": list[start:end],
+	})
+}
+
+func (s *Server) createLoadBalancer(w http.ResponseWriter, body []byte) {
+	req := struct {
+		Organization core.OrganizationRef             `json:"organization"`
+		Properties   core.LoadBalancerCreateArguments `json:"properties"`
+	}{}
+	if !decode(w, body, &req) {
+		return
+	}
+
+	org, ok := s.organization(w, url.Values{
+		"organization[id]":         {req.Organization.ID},
+		"organization[sub_domain]": {req.Organization.SubDomain},
+	})
+	if !ok {
+		return
+	}
+
+	args := req.Properties
+	if args.DataCenter.ID == "" && args.DataCenter.Permalink == "" {
+		writeValidationError(w, "Data center must be provided")
+		return
+	}
+	if args.ResourceType == "" {
+		args.ResourceType = core.VirtualMachinesResourceType
+	}
+	if !validResourceType(args.ResourceType) {
+		writeValidationError(w, fmt.Sprintf("Resource type %q is not valid", args.ResourceType))
+		return
+	}
+
+	lb := &loadBalancer{
+		orgID:        org.ID,
+		dataCenterID: args.DataCenter.ID,
+		LoadBalancer: core.LoadBalancer{
+			ID:           s.id("lb"),
+			Name:         args.Name,
+			ResourceType: args.ResourceType,
+			ResourceIDs:  []string{},
+		},
+	}
+	lb.IPAddress = &core.IPAddress{
+		ID:      s.id("ip"),
+		Address: fmt.Sprintf("192.0.2.%d", s.nextID%254+1),
+	}
+	if lb.Name == "" {
+		lb.Name = lb.ID
+	}
+	if args.ResourceIDs != nil {
+		lb.ResourceIDs = append(lb.ResourceIDs, *args.ResourceIDs...)
+	}
+	if args.HTTPSRedirect != nil {
+		lb.HTTPSRedirect = *args.HTTPSRedirect
+	}
+	s.loadBalancers = append(s.loadBalancers, lb)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"load_balancer": lb.LoadBalancer})
+}
+
+func (s *Server) getLoadBalancer(w http.ResponseWriter, q url.Values) {
+	lb, ok := s.loadBalancer(w, core.LoadBalancerRef{ID: q.Get("load_balancer[id]")})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer": lb.LoadBalancer})
+}
+
+func (s *Server) updateLoadBalancer(w http.ResponseWriter, body []byte) {
+	req := struct {
+		LoadBalancer core.LoadBalancerRef             `json:"load_balancer"`
+		Properties   core.LoadBalancerUpdateArguments `json:"properties"`
+	}{}
+	if !decode(w, body, &req) {
+		return
+	}
+
+	lb, ok := s.loadBalancer(w, req.LoadBalancer)
+	if !ok {
+		return
+	}
+
+	args := req.Properties
+	if args.ResourceType != "" && !validResourceType(args.ResourceType) {
+		writeValidationError(w, fmt.Sprintf("Resource type %q is not valid", args.ResourceType))
+		return
+	}
+
+	if args.Name != "" {
+		lb.Name = args.Name
+	}
+	if args.ResourceType != "" {
+		lb.ResourceType = args.ResourceType
+	}
+	if args.ResourceIDs != nil {
+		lb.ResourceIDs = append([]string{}, *args.ResourceIDs...)
+	}
+	if args.HTTPSRedirect != nil {
+		lb.HTTPSRedirect = *args.HTTPSRedirect
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer": lb.LoadBalancer})
+}
+
+func (s *Server) deleteLoadBalancer(w http.ResponseWriter, q url.Values) {
+	lb, ok := s.loadBalancer(w, core.LoadBalancerRef{ID: q.Get("load_balancer[id]")})
+	if !ok {
+		return
+	}
+
+	for _, id := range lb.ruleIDs {
+		delete(s.rules, id)
+	}
+	for i := range s.loadBalancers {
+		if s.loadBalancers[i] == lb {
+			s.loadBalancers = append(s.loadBalancers[:i], s.loadBalancers[i+1:]...)
+			break
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer": lb.LoadBalancer})
+}
+
+func (s *Server) listLoadBalancerRules(w http.ResponseWriter, q url.Values) {
+	lb, ok := s.loadBalancer(w, core.LoadBalancerRef{ID: q.Get("load_balancer[id]")})
+	if !ok {
+		return
+	}
+
+	list := []core.LoadBalancerRule{}
+	for _, id := range lb.ruleIDs {
+		list = append(list, *s.rules[id])
+	}
+
+	start, end, pagination := s.page(q, len(list))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pagination":          pagination,
+		"load_balancer_rules": list[start:end],
+	})
+}
+
+// validateRule checks a rule as it would be after a create or update,
+// returning any validation errors.
+func (s *Server) validateRule(lb *loadBalancer, rule *core.LoadBalancerRule) []string {
+	errors := []string{}
+	if rule.ListenPort < 1 || rule.ListenPort > 65535 {
+		errors = append(errors, "Listen port must be between 1 and 65535")
+	}
+	if rule.DestinationPort < 1 || rule.DestinationPort > 65535 {
+		errors = append(errors, "Destination port must be between 1 and 65535")
+	}
+	switch rule.Protocol {
+	case core.HTTPProtocol, core.HTTPSProtocol, core.TCPProtocol:
+	default:
+		errors = append(errors, "Protocol is not included in the list")
+	}
+	for _, id := range lb.ruleIDs {
+		if id != rule.ID && s.rules[id].ListenPort == rule.ListenPort {
+			errors = append(errors, "Listen port has already been taken")
+		}
+	}
+
+	return errors
+}
+
+// applyRuleArguments updates a rule with the arguments that were provided.
+func applyRuleArguments(rule *core.LoadBalancerRule, args core.LoadBalancerRuleArguments) {
+	if args.Algorithm != "" {
+		rule.Algorithm = args.Algorithm
+	}
+	if args.DestinationPort != 0 {
+		rule.DestinationPort = args.DestinationPort
+	}
+	if args.ListenPort != 0 {
+		rule.ListenPort = args.ListenPort
+	}
+	if args.Protocol != "" {
+		rule.Protocol = args.Protocol
+	}
+	if args.ProxyProtocol != nil {
+		rule.ProxyProtocol = *args.ProxyProtocol
+	}
+	if args.Certificates != nil {
+		rule.Certificates = args.Certificates
+	}
+	if args.CheckEnabled != nil {
+		rule.CheckEnabled = *args.CheckEnabled
+	}
+	if args.CheckFall != 0 {
+		rule.CheckFall = args.CheckFall
+	}
+	if args.CheckInterval != 0 {
+		rule.CheckInterval = args.CheckInterval
+	}
+	if args.CheckPath != "" {
+		rule.CheckPath = args.CheckPath
+	}
+	if args.CheckProtocol != "" {
+		rule.CheckProtocol = args.CheckProtocol
+	}
+	if args.CheckRise != 0 {
+		rule.CheckRise = args.CheckRise
+	}
+	if args.CheckTimeout != 0 {
+		rule.CheckTimeout = args.CheckTimeout
+	}
+}
+
+func (s *Server) createLoadBalancerRule(w http.ResponseWriter, lbID string, body []byte) {
+	lb, ok := s.loadBalancer(w, core.LoadBalancerRef{ID: lbID})
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Properties core.LoadBalancerRuleArguments `json:"properties"`
+	}{}
+	if !decode(w, body, &req) {
+		return
+	}
+
+	rule := &core.LoadBalancerRule{Algorithm: core.RoundRobinRuleAlgorithm}
+	applyRuleArguments(rule, req.Properties)
+	if errors := s.validateRule(lb, rule); len(errors) > 0 {
+		writeValidationError(w, errors...)
+		return
+	}
+
+	rule.ID = s.id("lbrule")
+	s.rules[rule.ID] = rule
+	lb.ruleIDs = append(lb.ruleIDs, rule.ID)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"load_balancer_rule": rule})
+}
+
+func (s *Server) getLoadBalancerRule(w http.ResponseWriter, q url.Values) {
+	rule, ok := s.rule(w, q)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer_rule": rule})
+}
+
+// ruleLoadBalancer finds the load balancer a rule belongs to.
+func (s *Server) ruleLoadBalancer(ruleID string) *loadBalancer {
+	for _, lb := range s.loadBalancers {
+		for _, id := range lb.ruleIDs {
+			if id == ruleID {
+				return lb
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) updateLoadBalancerRule(w http.ResponseWriter, q url.Values, body []byte) {
+	rule, ok := s.rule(w, q)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Properties core.LoadBalancerRuleArguments `json:"properties"`
+	}{}
+	if !decode(w, body, &req) {
+		return
+	}
+
+	updated := *rule
+	applyRuleArguments(&updated, req.Properties)
+	if errors := s.validateRule(s.ruleLoadBalancer(rule.ID), &updated); len(errors) > 0 {
+		writeValidationError(w, errors...)
+		return
+	}
+	*rule = updated
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer_rule": rule})
+}
+
+func (s *Server) deleteLoadBalancerRule(w http.ResponseWriter, q url.Values) {
+	rule, ok := s.rule(w, q)
+	if !ok {
+		return
+	}
+
+	lb := s.ruleLoadBalancer(rule.ID)
+	for i, id := range lb.ruleIDs {
+		if id == rule.ID {
+			lb.ruleIDs = append(lb.ruleIDs[:i], lb.ruleIDs[i+1:]...)
+			break
+		}
+	}
+	delete(s.rules, rule.ID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer_rule": rule})
+}
@@ -0,0 +1,456 @@
+// Package fakekatapult provides an in-memory implementation of the parts of
+// the Katapult API used by the KCE cloud controller manager. It is intended
+// for unit tests and for running the controller manager locally.
+package fakekatapult
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader is set on every response, as the real API does.
+const RequestIDHeader = "X-Request-ID"
+
+// defaultPerPage matches the page size used by the Katapult API.
+const defaultPerPage = 30
+
+// Request is a record of a request made to the server.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+}
+
+// Fault changes how the server responds to matching requests.
+type Fault struct {
+	// Method and Path restrict the fault to matching requests. Empty values
+	// match any request. Path is the full request path, such as
+	// "/core/v1/organizations/_/load_balancers".
+	Method string
+	Path   string
+
+	// Latency delays the response.
+	Latency time.Duration
+
+	// StatusCode, when set, fails the request with that status instead of
+	// handling it. 429 and 5xx responses carry the same error bodies as the
+	// real API.
+	StatusCode int
+
+	// Count is the number of requests the fault applies to. Zero applies it
+	// until the faults are cleared.
+	Count int
+}
+
+func (f *Fault) matches(r *http.Request) bool {
+	return (f.Method == "" || f.Method == r.Method) &&
+		(f.Path == "" || f.Path == r.URL.Path)
+}
+
+type loadBalancer struct {
+	core.LoadBalancer
+	orgID        string
+	dataCenterID string
+	ruleIDs      []string
+}
+
+// Server is a fake Katapult API. The zero value is not usable, use NewServer.
+type Server struct {
+	// Token, when set, is the only API token the server accepts.
+	Token string
+
+	// PerPage is the default page size for list endpoints.
+	PerPage int
+
+	mu       sync.Mutex
+	nextID   int
+	requests []Request
+	faults   []*Fault
+
+	organizations   map[string]*core.Organization
+	loadBalancers   []*loadBalancer
+	rules           map[string]*core.LoadBalancerRule
+	virtualMachines map[string][]*core.VirtualMachine
+	interfaces      map[string][]*core.VirtualMachineNetworkInterface
+	groups          map[string][]*core.VirtualMachineGroup
+	tags            map[string][]*core.Tag
+}
+
+// NewServer returns an empty fake Katapult API.
+func NewServer() *Server {
+	return &Server{
+		PerPage:         defaultPerPage,
+		organizations:   map[string]*core.Organization{},
+		rules:           map[string]*core.LoadBalancerRule{},
+		virtualMachines: map[string][]*core.VirtualMachine{},
+		interfaces:      map[string][]*core.VirtualMachineNetworkInterface{},
+		groups:          map[string][]*core.VirtualMachineGroup{},
+		tags:            map[string][]*core.Tag{},
+	}
+}
+
+// id generates a unique RID with the given prefix.
+func (s *Server) id(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s_%04d", prefix, s.nextID)
+}
+
+// AddOrganization adds an organization that resources can be created in.
+func (s *Server) AddOrganization(org core.Organization) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.organizations[org.ID] = &org
+}
+
+// AddVirtualMachine adds a VM to an organization. Any tags it carries are
+// added to the organization too.
+func (s *Server) AddVirtualMachine(orgID string, vm core.VirtualMachine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.virtualMachines[orgID] = append(s.virtualMachines[orgID], &vm)
+	for _, tag := range vm.Tags {
+		if s.findTag(tag.ID) == nil {
+			s.tags[orgID] = append(s.tags[orgID], tag)
+		}
+	}
+}
+
+// AddNetworkInterface attaches a network interface to a VM.
+func (s *Server) AddNetworkInterface(vmID string, nic core.VirtualMachineNetworkInterface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.interfaces[vmID] = append(s.interfaces[vmID], &nic)
+}
+
+// AddVirtualMachineGroup adds a VM group to an organization.
+func (s *Server) AddVirtualMachineGroup(orgID string, group core.VirtualMachineGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups[orgID] = append(s.groups[orgID], &group)
+}
+
+// AddTag adds a tag to an organization.
+func (s *Server) AddTag(orgID string, tag core.Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tags[orgID] = append(s.tags[orgID], &tag)
+}
+
+// LoadBalancers returns the load balancers that currently exist.
+func (s *Server) LoadBalancers() []core.LoadBalancer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]core.LoadBalancer, 0, len(s.loadBalancers))
+	for _, lb := range s.loadBalancers {
+		out = append(out, lb.LoadBalancer)
+	}
+
+	return out
+}
+
+// LoadBalancerRules returns the rules that currently exist for a load
+// balancer.
+func (s *Server) LoadBalancerRules(lbID string) []core.LoadBalancerRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lb := s.findLoadBalancer(lbID)
+	if lb == nil {
+		return nil
+	}
+
+	out := make([]core.LoadBalancerRule, 0, len(lb.ruleIDs))
+	for _, id := range lb.ruleIDs {
+		out = append(out, *s.rules[id])
+	}
+
+	return out
+}
+
+// AddFault changes how the server responds to matching requests. Faults are
+// checked in the order they were added, and the first match applies.
+func (s *Server) AddFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// Requests returns the requests made so far, including those that failed.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request{}, s.requests...)
+}
+
+// ResetRequests forgets the requests made so far.
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = nil
+}
+
+// takeFault finds the fault for a request, using up one of its requests.
+func (s *Server) takeFault(r *http.Request) *Fault {
+	for i, f := range s.faults {
+		if !f.matches(r) {
+			continue
+		}
+
+		fault := *f
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+
+		return &fault
+	}
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Body:   body,
+	})
+	w.Header().Set(RequestIDHeader, fmt.Sprintf("req_%d", len(s.requests)))
+	fault := s.takeFault(r)
+	s.mu.Unlock()
+
+	if fault != nil && fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if fault != nil && fault.StatusCode != 0 {
+		writeFault(w, fault.StatusCode)
+		return
+	}
+
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusForbidden, "invalid_api_token",
+			"The API token provided was not valid")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.route(w, r, body)
+}
+
+// route dispatches a request to its handler. Paths use the same "_"
+// placeholders as the go-katapult client, with the object identified by the
+// query string or body.
+func (s *Server) route(w http.ResponseWriter, r *http.Request, body []byte) {
+	path := strings.TrimPrefix(r.URL.Path, "/core/v1/")
+	q := r.URL.Query()
+
+	switch {
+	case path == "organizations/_" && r.Method == http.MethodGet:
+		s.getOrganization(w, q)
+	case path == "organizations/_/load_balancers" && r.Method == http.MethodGet:
+		s.listLoadBalancers(w, q)
+	case path == "organizations/_/load_balancers" && r.Method == http.MethodPost:
+		s.createLoadBalancer(w, body)
+	case path == "load_balancers/_" && r.Method == http.MethodGet:
+		s.getLoadBalancer(w, q)
+	case path == "load_balancers/_" && r.Method == http.MethodPatch:
+		s.updateLoadBalancer(w, body)
+	case path == "load_balancers/_" && r.Method == http.MethodDelete:
+		s.deleteLoadBalancer(w, q)
+	case path == "load_balancers/_/rules" && r.Method == http.MethodGet:
+		s.listLoadBalancerRules(w, q)
+	case path == "load_balancers/rules/_" && r.Method == http.MethodGet:
+		s.getLoadBalancerRule(w, q)
+	case path == "load_balancers/rules/_" && r.Method == http.MethodPatch:
+		s.updateLoadBalancerRule(w, q, body)
+	case path == "load_balancers/rules/_" && r.Method == http.MethodDelete:
+		s.deleteLoadBalancerRule(w, q)
+	case strings.HasPrefix(path, "load_balancers/") && strings.HasSuffix(path, "/rules") && r.Method == http.MethodPost:
+		s.createLoadBalancerRule(w, strings.TrimSuffix(strings.TrimPrefix(path, "load_balancers/"), "/rules"), body)
+	case path == "organizations/_/virtual_machines" && r.Method == http.MethodGet:
+		s.listVirtualMachines(w, q)
+	case path == "virtual_machines/_" && r.Method == http.MethodGet:
+		s.getVirtualMachine(w, q)
+	case path == "virtual_machines/_/network_interfaces" && r.Method == http.MethodGet:
+		s.listNetworkInterfaces(w, q)
+	case path == "organizations/_/virtual_machine_groups" && r.Method == http.MethodGet:
+		s.listVirtualMachineGroups(w, q)
+	case path == "organizations/_/tags" && r.Method == http.MethodGet:
+		s.listTags(w, q)
+	case path == "tags/_" && r.Method == http.MethodGet:
+		s.getTag(w, q)
+	default:
+		writeError(w, http.StatusNotFound, "route_not_found",
+			fmt.Sprintf("No route matches %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// organization resolves the organization identified by the query string,
+// writing an error if it does not exist.
+func (s *Server) organization(w http.ResponseWriter, q url.Values) (*core.Organization, bool) {
+	for _, org := range s.organizations {
+		if (q.Get("organization[id]") != "" && org.ID == q.Get("organization[id]")) ||
+			(q.Get("organization[sub_domain]") != "" && org.SubDomain == q.Get("organization[sub_domain]")) {
+			return org, true
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "organization_not_found",
+		"No organization was found matching any of the criteria provided in the arguments")
+	return nil, false
+}
+
+func (s *Server) getOrganization(w http.ResponseWriter, q url.Values) {
+	org, ok := s.organization(w, q)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"organization": org})
+}
+
+// page returns the bounds of the requested page of n items, and the
+// pagination to report.
+func (s *Server) page(q url.Values, n int) (int, int, *katapult.Pagination) {
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage <= 0 {
+		perPage = s.PerPage
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	totalPages := (n + perPage - 1) / perPage
+	if totalPages == 0 {
+		totalPages = 1
+	}
+
+	start := (page - 1) * perPage
+	if start > n {
+		start = n
+	}
+	end := start + perPage
+	if end > n {
+		end = n
+	}
+
+	return start, end, &katapult.Pagination{
+		CurrentPage: page,
+		TotalPages:  totalPages,
+		Total:       n,
+		PerPage:     perPage,
+	}
+}
+
+func decode(w http.ResponseWriter, body []byte, v interface{}) bool {
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": katapult.ResponseError{
+			Code:        code,
+			Description: description,
+			Detail:      json.RawMessage("{}"),
+		},
+	})
+}
+
+func writeValidationError(w http.ResponseWriter, errors ...string) {
+	detail, _ := json.Marshal(map[string]interface{}{"errors": errors})
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error": katapult.ResponseError{
+			Code:        "validation_error",
+			Description: "A validation error occurred with the object that was being created/updated/deleted",
+			Detail:      detail,
+		},
+	})
+}
+
+func writeFault(w http.ResponseWriter, status int) {
+	switch {
+	case status == http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", "1")
+		writeError(w, status, "too_many_requests",
+			"You have exceeded the rate limit for this API")
+	case status == http.StatusForbidden:
+		writeError(w, status, "scope_not_granted",
+			"The scope required for this endpoint has not been granted to the authenticating identity")
+	case status >= 500:
+		writeError(w, status, "internal_server_error",
+			"An internal server error occurred")
+	default:
+		writeError(w, status, "fault_injected",
+			fmt.Sprintf("A %d response was injected", status))
+	}
+}
+
+// NewClient returns a Katapult client for a server listening at rawURL, such
+// as an httptest.Server wrapping a Server.
+func NewClient(rawURL, token string) (*core.Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	rm, err := katapult.New(
+		katapult.WithAPIKey(token),
+		katapult.WithBaseURL(u),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return core.New(rm), nil
+}
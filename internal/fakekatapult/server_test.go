@@ -0,0 +1,240 @@
+package fakekatapult
+
+import (
+	"context"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testOrg = core.OrganizationRef{ID: "org_test"}
+
+func newTestServer(t *testing.T) (*Server, *core.Client) {
+	s := NewServer()
+	s.Token = "token"
+	s.AddOrganization(core.Organization{ID: testOrg.ID, SubDomain: "test"})
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	client, err := NewClient(srv.URL, s.Token)
+	require.NoError(t, err)
+
+	return s, client
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestServer_loadBalancers(t *testing.T) {
+	s, client := newTestServer(t)
+	ctx := context.Background()
+
+	lb, resp, err := client.LoadBalancers.Create(ctx, testOrg, &core.LoadBalancerCreateArguments{
+		DataCenter:   core.DataCenterRef{ID: "dc_test"},
+		Name:         "example",
+		ResourceType: core.TagsResourceType,
+		ResourceIDs:  &[]string{"tag_test"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(RequestIDHeader))
+	assert.NotEmpty(t, lb.ID)
+	assert.NotEmpty(t, lb.IPAddress.Address)
+	assert.Equal(t, []string{"tag_test"}, lb.ResourceIDs)
+
+	updated, _, err := client.LoadBalancers.Update(ctx, lb.Ref(), &core.LoadBalancerUpdateArguments{
+		HTTPSRedirect: boolPtr(true),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "example", updated.Name)
+	assert.True(t, updated.HTTPSRedirect)
+
+	rule, _, err := client.LoadBalancerRules.Create(ctx, lb.Ref(), core.LoadBalancerRuleArguments{
+		ListenPort:      80,
+		DestinationPort: 30080,
+		Protocol:        core.TCPProtocol,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, core.RoundRobinRuleAlgorithm, rule.Algorithm)
+
+	_, resp, err = client.LoadBalancerRules.Create(ctx, lb.Ref(), core.LoadBalancerRuleArguments{
+		ListenPort:      80,
+		DestinationPort: 30081,
+		Protocol:        core.TCPProtocol,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(t, "validation_error", resp.Error.Code)
+
+	rule, _, err = client.LoadBalancerRules.Update(ctx, rule.Ref(), core.LoadBalancerRuleArguments{
+		DestinationPort: 30090,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 80, rule.ListenPort)
+	assert.Equal(t, 30090, rule.DestinationPort)
+	assert.Equal(t, []core.LoadBalancerRule{*rule}, s.LoadBalancerRules(lb.ID))
+
+	_, _, err = client.LoadBalancers.Delete(ctx, lb.Ref())
+	require.NoError(t, err)
+	assert.Empty(t, s.LoadBalancers())
+
+	_, resp, err = client.LoadBalancers.Get(ctx, lb.Ref())
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "load_balancer_not_found", resp.Error.Code)
+
+	_, resp, err = client.LoadBalancerRules.Get(ctx, rule.Ref())
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_pagination(t *testing.T) {
+	s, client := newTestServer(t)
+	s.PerPage = 2
+	for _, id := range []string{"vm_1", "vm_2", "vm_3"} {
+		s.AddVirtualMachine(testOrg.ID, core.VirtualMachine{ID: id})
+	}
+
+	tests := []struct {
+		name           string
+		opts           *core.ListOptions
+		wantIDs        []string
+		wantTotalPages int
+	}{
+		{
+			name:           "first page",
+			wantIDs:        []string{"vm_1", "vm_2"},
+			wantTotalPages: 2,
+		},
+		{
+			name:           "last page",
+			opts:           &core.ListOptions{Page: 2},
+			wantIDs:        []string{"vm_3"},
+			wantTotalPages: 2,
+		},
+		{
+			name:           "past the last page",
+			opts:           &core.ListOptions{Page: 3},
+			wantIDs:        []string{},
+			wantTotalPages: 2,
+		},
+		{
+			name:           "per page",
+			opts:           &core.ListOptions{PerPage: 3},
+			wantIDs:        []string{"vm_1", "vm_2", "vm_3"},
+			wantTotalPages: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vms, resp, err := client.VirtualMachines.List(context.Background(), testOrg, tt.opts)
+			require.NoError(t, err)
+
+			ids := []string{}
+			for _, vm := range vms {
+				ids = append(ids, vm.ID)
+			}
+			assert.Equal(t, tt.wantIDs, ids)
+			assert.Equal(t, tt.wantTotalPages, resp.Pagination.TotalPages)
+			assert.Equal(t, 3, resp.Pagination.Total)
+		})
+	}
+}
+
+func TestServer_virtualMachines(t *testing.T) {
+	s, client := newTestServer(t)
+	s.AddVirtualMachine(testOrg.ID, core.VirtualMachine{
+		ID:   "vm_1",
+		FQDN: "node-1.example.com",
+		Tags: []*core.Tag{{ID: "tag_nodes", Name: "nodes"}},
+	})
+	s.AddNetworkInterface("vm_1", core.VirtualMachineNetworkInterface{ID: "nic_1"})
+	s.AddVirtualMachineGroup(testOrg.ID, core.VirtualMachineGroup{ID: "group_1"})
+	ctx := context.Background()
+
+	vm, _, err := client.VirtualMachines.Get(ctx, core.VirtualMachineRef{FQDN: "node-1.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "vm_1", vm.ID)
+
+	_, resp, err := client.VirtualMachines.Get(ctx, core.VirtualMachineRef{ID: "vm_missing"})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	nics, _, err := client.VirtualMachineNetworkInterfaces.List(ctx, vm.Ref(), nil)
+	require.NoError(t, err)
+	assert.Len(t, nics, 1)
+
+	groups, _, err := client.VirtualMachineGroups.List(ctx, testOrg)
+	require.NoError(t, err)
+	assert.Len(t, groups, 1)
+
+	_, resp, err = client.VirtualMachineGroups.List(ctx, core.OrganizationRef{ID: "org_missing"})
+	assert.Error(t, err)
+	assert.Equal(t, "organization_not_found", resp.Error.Code)
+
+	assert.Len(t, s.tags[testOrg.ID], 1)
+}
+
+func TestServer_faults(t *testing.T) {
+	s, client := newTestServer(t)
+	ctx := context.Background()
+	path := "/core/v1/organizations/_/load_balancers"
+
+	s.AddFault(Fault{Method: http.MethodGet, Path: path, StatusCode: http.StatusTooManyRequests, Count: 1})
+	_, resp, err := client.LoadBalancers.List(ctx, testOrg, nil)
+	assert.EqualError(t, err, "too_many_requests: You have exceeded the rate limit for this API")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	_, _, err = client.LoadBalancers.List(ctx, testOrg, nil)
+	assert.NoError(t, err)
+
+	s.AddFault(Fault{StatusCode: http.StatusInternalServerError})
+	_, resp, err = client.VirtualMachines.List(ctx, testOrg, nil)
+	assert.Error(t, err)
+	assert.Equal(t, "internal_server_error", resp.Error.Code)
+	s.ClearFaults()
+
+	s.AddFault(Fault{Latency: time.Second})
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, _, err = client.LoadBalancers.List(timeoutCtx, testOrg, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestServer_requests(t *testing.T) {
+	s, client := newTestServer(t)
+	ctx := context.Background()
+
+	_, _, err := client.LoadBalancers.List(ctx, testOrg, &core.ListOptions{Page: 2})
+	require.NoError(t, err)
+
+	requests := s.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, http.MethodGet, requests[0].Method)
+	assert.Equal(t, "/core/v1/organizations/_/load_balancers", requests[0].Path)
+	assert.Equal(t, "2", requests[0].Query.Get("page"))
+	assert.Equal(t, testOrg.ID, requests[0].Query.Get("organization[id]"))
+
+	s.ResetRequests()
+	assert.Empty(t, s.Requests())
+}
+
+func TestServer_token(t *testing.T) {
+	s, _ := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL, "wrong")
+	require.NoError(t, err)
+
+	_, resp, err := client.LoadBalancers.List(context.Background(), testOrg, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "invalid_api_token", resp.Error.Code)
+}
@@ -0,0 +1,111 @@
+package fakekatapult
+
+import (
+	"github.com/krystal/go-katapult/core"
+	"net/http"
+	"net/url"
+)
+
+// virtualMachine resolves the VM identified by the query string, by ID or
+// FQDN, writing an error if it does not exist.
+func (s *Server) virtualMachine(w http.ResponseWriter, q url.Values) (*core.VirtualMachine, bool) {
+	id, fqdn := q.Get("virtual_machine[id]"), q.Get("virtual_machine[fqdn]")
+	for _, vms := range s.virtualMachines {
+		for _, vm := range vms {
+			if (id != "" && vm.ID == id) || (id == "" && fqdn != "" && vm.FQDN == fqdn) {
+				return vm, true
+			}
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "virtual_machine_not_found",
+		"No virtual machine was found matching any of the criteria provided in the arguments")
+	return nil, false
+}
+
+func (s *Server) findTag(id string) *core.Tag {
+	for _, tags := range s.tags {
+		for _, tag := range tags {
+			if tag.ID == id {
+				return tag
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) listVirtualMachines(w http.ResponseWriter, q url.Values) {
+	org, ok := s.organization(w, q)
+	if !ok {
+		return
+	}
+
+	list := append([]*core.VirtualMachine{}, s.virtualMachines[org.ID]...)
+	start, end, pagination := s.page(q, len(list))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pagination":       pagination,
+		"virtual_machines": list[start:end],
+	})
+}
+
+func (s *Server) getVirtualMachine(w http.ResponseWriter, q url.Values) {
+	vm, ok := s.virtualMachine(w, q)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"virtual_machine": vm})
+}
+
+func (s *Server) listNetworkInterfaces(w http.ResponseWriter, q url.Values) {
+	vm, ok := s.virtualMachine(w, q)
+	if !ok {
+		return
+	}
+
+	list := append([]*core.VirtualMachineNetworkInterface{}, s.interfaces[vm.ID]...)
+	start, end, pagination := s.page(q, len(list))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pagination":                         pagination,
+		"virtual_machine_network_interfaces": list[start:end],
+	})
+}
+
+// listVirtualMachineGroups returns every group at once, as the real API does
+// not paginate groups.
+func (s *Server) listVirtualMachineGroups(w http.ResponseWriter, q url.Values) {
+	org, ok := s.organization(w, q)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"virtual_machine_groups": append([]*core.VirtualMachineGroup{}, s.groups[org.ID]...),
+	})
+}
+
+func (s *Server) listTags(w http.ResponseWriter, q url.Values) {
+	org, ok := s.organization(w, q)
+	if !ok {
+		return
+	}
+
+	list := append([]*core.Tag{}, s.tags[org.ID]...)
+	start, end, pagination := s.page(q, len(list))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pagination": pagination,
+		"tags":       list[start:end],
+	})
+}
+
+func (s *Server) getTag(w http.ResponseWriter, q url.Values) {
+	tag := s.findTag(q.Get("tag[id]"))
+	if tag == nil {
+		writeError(w, http.StatusNotFound, "tag_not_found",
+			"No tag was found matching any of the criteria provided in the arguments")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tag": tag})
+}
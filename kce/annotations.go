@@ -0,0 +1,268 @@
+package kce
+
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"strconv"
+	"strings"
+)
+
+const (
+	annotationPrefix = "kce.krystal.uk/"
+
+	// annotationLoadBalancerInternal requests that the load balancer is
+	// attached to a Katapult virtual network and given a private address
+	// rather than a public one. This is not supported yet, and services that
+	// request it are rejected.
+	annotationLoadBalancerInternal = annotationPrefix + "load-balancer-internal"
+	// annotationLoadBalancerVirtualNetwork is the RID of the virtual network
+	// an internal load balancer should be attached to. Like
+	// annotationLoadBalancerInternal, it is rejected.
+	annotationLoadBalancerVirtualNetwork = annotationPrefix + "load-balancer-virtual-network-rid"
+
+	// annotationLoadBalancerTagID targets the load balancer at VMs with the
+	// given Katapult tag RID rather than the cluster wide node tag.
+	annotationLoadBalancerTagID = annotationPrefix + "load-balancer-tag-rid"
+	// annotationLoadBalancerTagName is the same as annotationLoadBalancerTagID
+	// but the tag is looked up by name.
+	annotationLoadBalancerTagName = annotationPrefix + "load-balancer-tag-name"
+	// annotationLoadBalancerVMGroupIDs targets the load balancer at a comma
+	// separated list of Katapult virtual machine group RIDs.
+	annotationLoadBalancerVMGroupIDs = annotationPrefix + "load-balancer-vm-group-rids"
+
+	// annotationLoadBalancerID names an existing Katapult load balancer that
+	// should be adopted for the service rather than creating a new one.
+	annotationLoadBalancerID = annotationPrefix + "load-balancer-rid"
+	// annotationLoadBalancerDeletionPolicy controls what happens to a load
+	// balancer when the service is deleted or is no longer a LoadBalancer.
+	annotationLoadBalancerDeletionPolicy = annotationPrefix + "load-balancer-deletion-policy"
+
+	// annotationLoadBalancerDataCenters is a comma separated list of data
+	// center RIDs that the service should have a load balancer in, or "nodes"
+	// to use every data center that one of the cluster's nodes is in.
+	annotationLoadBalancerDataCenters = annotationPrefix + "load-balancer-data-centers"
+
+	// annotationLoadBalancerPortRanges collapses consecutive TCP service
+	// ports into ranges. Each port still has its own rule and API request,
+	// the changes for a range are only reported together.
+	annotationLoadBalancerPortRanges = annotationPrefix + "load-balancer-port-ranges"
+
+	// annotationLoadBalancerPortSettings is a JSON object, keyed by port
+	// name or number, of settings for the rules of individual ports.
+	annotationLoadBalancerPortSettings = annotationPrefix + "load-balancer-port-settings"
+
+	// annotationLoadBalancerManagedRules is maintained by kce-ccm to record
+	// the rules it manages on each of the service's load balancers.
+	annotationLoadBalancerManagedRules = annotationPrefix + "load-balancer-managed-rules"
+	// annotationLoadBalancerPortNames is maintained by kce-ccm to record the
+	// port each of the service's named ports had when its rules were last
+	// changed.
+	annotationLoadBalancerPortNames = annotationPrefix + "load-balancer-port-names"
+)
+
+// deletionPolicy determines whether a load balancer is deleted along with its
+// service, or released and left in place.
+type deletionPolicy string
+
+const (
+	deletionPolicyDelete deletionPolicy = "delete"
+	deletionPolicyRetain deletionPolicy = "retain"
+)
+
+// errInternalLoadBalancerUnsupported is returned when a service requests an
+// internal load balancer. The Katapult load balancer API does not yet allow a
+// load balancer to be placed on a virtual network.
+var errInternalLoadBalancerUnsupported = fmt.Errorf("internal load balancers are not supported by the katapult api")
+
+// loadBalancerOptions holds the per-service settings that are sourced from
+// annotations on the service.
+type loadBalancerOptions struct {
+	tagID      string
+	tagName    string
+	vmGroupIDs []string
+
+	loadBalancerID string
+	deletionPolicy deletionPolicy
+
+	dataCenterIDs []string
+
+	// portRanges are the ranges of the service's ports, and are only set when
+	// port ranges have been requested.
+	portRanges []portRange
+
+	// portSettings override the settings of the rules for individual ports,
+	// keyed by port number.
+	portSettings map[int]portSettings
+}
+
+// parseDeletionPolicy validates a deletion policy provided by a user.
+func parseDeletionPolicy(v string) (deletionPolicy, error) {
+	switch policy := deletionPolicy(v); policy {
+	case deletionPolicyDelete, deletionPolicyRetain:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("must be %q or %q", deletionPolicyDelete, deletionPolicyRetain)
+}
+
+// parseLoadBalancerOptions reads and validates the annotations on a service,
+// falling back to the cluster wide defaults in the config.
+func parseLoadBalancerOptions(service *v1.Service, c Config) (*loadBalancerOptions, error) {
+	opts := &loadBalancerOptions{}
+
+	// Internal load balancers are rejected here, so that the controller, the
+	// doctor and the lb commands all report the same error for them.
+	if v, ok := service.Annotations[annotationLoadBalancerInternal]; ok {
+		internal, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", annotationLoadBalancerInternal, err)
+		}
+		if internal {
+			return nil, fmt.Errorf("%s is unsupported: %w", annotationLoadBalancerInternal, errInternalLoadBalancerUnsupported)
+		}
+	}
+	if _, ok := service.Annotations[annotationLoadBalancerVirtualNetwork]; ok {
+		return nil, fmt.Errorf("%s is unsupported: %w", annotationLoadBalancerVirtualNetwork, errInternalLoadBalancerUnsupported)
+	}
+
+	targets := 0
+	for _, key := range []string{
+		annotationLoadBalancerTagID,
+		annotationLoadBalancerTagName,
+		annotationLoadBalancerVMGroupIDs,
+	} {
+		if _, ok := service.Annotations[key]; ok {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return nil, fmt.Errorf("only one of %s, %s or %s may be set",
+			annotationLoadBalancerTagID,
+			annotationLoadBalancerTagName,
+			annotationLoadBalancerVMGroupIDs,
+		)
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerTagID]; ok {
+		opts.tagID = strings.TrimSpace(v)
+		if opts.tagID == "" {
+			return nil, fmt.Errorf("%s cannot be empty", annotationLoadBalancerTagID)
+		}
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerTagName]; ok {
+		opts.tagName = strings.TrimSpace(v)
+		if opts.tagName == "" {
+			return nil, fmt.Errorf("%s cannot be empty", annotationLoadBalancerTagName)
+		}
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerVMGroupIDs]; ok {
+		for _, id := range strings.Split(v, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				return nil, fmt.Errorf("%s contains an empty rid", annotationLoadBalancerVMGroupIDs)
+			}
+			opts.vmGroupIDs = append(opts.vmGroupIDs, id)
+		}
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerID]; ok {
+		opts.loadBalancerID = strings.TrimSpace(v)
+		if opts.loadBalancerID == "" {
+			return nil, fmt.Errorf("%s cannot be empty", annotationLoadBalancerID)
+		}
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerDataCenters]; ok {
+		if opts.loadBalancerID != "" {
+			return nil, fmt.Errorf("%s cannot be used with %s", annotationLoadBalancerDataCenters, annotationLoadBalancerID)
+		}
+
+		for _, id := range strings.Split(v, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				return nil, fmt.Errorf("%s contains an empty rid", annotationLoadBalancerDataCenters)
+			}
+			opts.dataCenterIDs = append(opts.dataCenterIDs, id)
+		}
+
+		if len(opts.dataCenterIDs) > 1 {
+			for _, id := range opts.dataCenterIDs {
+				if id == selectDataCentersFromNodes {
+					return nil, fmt.Errorf("%s cannot combine %q with data center rids", annotationLoadBalancerDataCenters, selectDataCentersFromNodes)
+				}
+			}
+		}
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerPortRanges]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", annotationLoadBalancerPortRanges, err)
+		}
+		if enabled {
+			ranges, err := servicePortRanges(service.Spec.Ports)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port ranges: %w", err)
+			}
+			opts.portRanges = ranges
+		}
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerPortSettings]; ok {
+		settings, err := parsePortSettings(v, service.Spec.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", annotationLoadBalancerPortSettings, err)
+		}
+		opts.portSettings = settings
+	}
+
+	// Adopted load balancers are always retained by default, as they were not
+	// created by us in the first place.
+	opts.deletionPolicy = c.DeletionPolicy
+	if opts.deletionPolicy == "" {
+		opts.deletionPolicy = deletionPolicyDelete
+	}
+	if opts.loadBalancerID != "" {
+		opts.deletionPolicy = deletionPolicyRetain
+	}
+	if v, ok := service.Annotations[annotationLoadBalancerDeletionPolicy]; ok {
+		policy, err := parseDeletionPolicy(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", annotationLoadBalancerDeletionPolicy, err)
+		}
+		opts.deletionPolicy = policy
+	}
+
+	return opts, nil
+}
+
+// parseDeletionOptions reads the annotations that deleting a service's load
+// balancers depends on: the adopted load balancer and the deletion policy.
+// Unlike parseLoadBalancerOptions it never fails and ignores every other
+// annotation, so that an invalid annotation can never stop a service from
+// being deleted. An invalid deletion policy is treated as retain, so that a
+// load balancer is never deleted unless that was clearly asked for.
+func parseDeletionOptions(service *v1.Service, c Config) *loadBalancerOptions {
+	opts := &loadBalancerOptions{
+		loadBalancerID: strings.TrimSpace(service.Annotations[annotationLoadBalancerID]),
+		deletionPolicy: c.DeletionPolicy,
+	}
+
+	if opts.deletionPolicy == "" {
+		opts.deletionPolicy = deletionPolicyDelete
+	}
+	if opts.loadBalancerID != "" {
+		opts.deletionPolicy = deletionPolicyRetain
+	}
+	if v, ok := service.Annotations[annotationLoadBalancerDeletionPolicy]; ok {
+		policy, err := parseDeletionPolicy(v)
+		if err != nil {
+			policy = deletionPolicyRetain
+		}
+		opts.deletionPolicy = policy
+	}
+
+	return opts
+}
@@ -0,0 +1,288 @@
+package kce
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func Test_parseLoadBalancerOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ports       []v1.ServicePort
+		config      Config
+
+		want    *loadBalancerOptions
+		wantErr string
+	}{
+		{
+			name: "no annotations",
+			want: &loadBalancerOptions{deletionPolicy: deletionPolicyDelete},
+		},
+		{
+			name: "internal",
+			annotations: map[string]string{
+				annotationLoadBalancerInternal:       "true",
+				annotationLoadBalancerVirtualNetwork: "vnet_rNVw1X7iu4ll3xXT",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-internal is unsupported: internal load balancers are not supported by the katapult api",
+		},
+		{
+			name: "explicitly external",
+			annotations: map[string]string{
+				annotationLoadBalancerInternal: "false",
+			},
+			want: &loadBalancerOptions{deletionPolicy: deletionPolicyDelete},
+		},
+		{
+			name: "invalid internal value",
+			annotations: map[string]string{
+				annotationLoadBalancerInternal: "yes please",
+			},
+			wantErr: `invalid value for kce.krystal.uk/load-balancer-internal: strconv.ParseBool: parsing "yes please": invalid syntax`,
+		},
+		{
+			name: "internal without network",
+			annotations: map[string]string{
+				annotationLoadBalancerInternal: "true",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-internal is unsupported: internal load balancers are not supported by the katapult api",
+		},
+		{
+			name: "network without internal",
+			annotations: map[string]string{
+				annotationLoadBalancerVirtualNetwork: "vnet_rNVw1X7iu4ll3xXT",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-virtual-network-rid is unsupported: internal load balancers are not supported by the katapult api",
+		},
+		{
+			name: "tag id",
+			annotations: map[string]string{
+				annotationLoadBalancerTagID: " tag_Y1VhjfZDaM4pM6GT ",
+			},
+			want: &loadBalancerOptions{
+				tagID:          "tag_Y1VhjfZDaM4pM6GT",
+				deletionPolicy: deletionPolicyDelete,
+			},
+		},
+		{
+			name: "tag name",
+			annotations: map[string]string{
+				annotationLoadBalancerTagName: "ingress",
+			},
+			want: &loadBalancerOptions{
+				tagName:        "ingress",
+				deletionPolicy: deletionPolicyDelete,
+			},
+		},
+		{
+			name: "vm group ids",
+			annotations: map[string]string{
+				annotationLoadBalancerVMGroupIDs: "vmgrp_a, vmgrp_b",
+			},
+			want: &loadBalancerOptions{
+				vmGroupIDs:     []string{"vmgrp_a", "vmgrp_b"},
+				deletionPolicy: deletionPolicyDelete,
+			},
+		},
+		{
+			name: "empty tag id",
+			annotations: map[string]string{
+				annotationLoadBalancerTagID: "",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-tag-rid cannot be empty",
+		},
+		{
+			name: "empty tag name",
+			annotations: map[string]string{
+				annotationLoadBalancerTagName: " ",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-tag-name cannot be empty",
+		},
+		{
+			name: "empty vm group id",
+			annotations: map[string]string{
+				annotationLoadBalancerVMGroupIDs: "vmgrp_a,,vmgrp_b",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-vm-group-rids contains an empty rid",
+		},
+		{
+			name: "multiple targets",
+			annotations: map[string]string{
+				annotationLoadBalancerTagID:      "tag_Y1VhjfZDaM4pM6GT",
+				annotationLoadBalancerVMGroupIDs: "vmgrp_a",
+			},
+			wantErr: "only one of kce.krystal.uk/load-balancer-tag-rid, kce.krystal.uk/load-balancer-tag-name or kce.krystal.uk/load-balancer-vm-group-rids may be set",
+		},
+		{
+			name: "adopted",
+			annotations: map[string]string{
+				annotationLoadBalancerID: "lb_npORVDLVrf7MlghA",
+			},
+			want: &loadBalancerOptions{
+				loadBalancerID: "lb_npORVDLVrf7MlghA",
+				deletionPolicy: deletionPolicyRetain,
+			},
+		},
+		{
+			name: "adopted with delete policy",
+			annotations: map[string]string{
+				annotationLoadBalancerID:             "lb_npORVDLVrf7MlghA",
+				annotationLoadBalancerDeletionPolicy: "delete",
+			},
+			want: &loadBalancerOptions{
+				loadBalancerID: "lb_npORVDLVrf7MlghA",
+				deletionPolicy: deletionPolicyDelete,
+			},
+		},
+		{
+			name: "empty adopted id",
+			annotations: map[string]string{
+				annotationLoadBalancerID: "",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-rid cannot be empty",
+		},
+		{
+			name: "invalid deletion policy",
+			annotations: map[string]string{
+				annotationLoadBalancerID:             "lb_npORVDLVrf7MlghA",
+				annotationLoadBalancerDeletionPolicy: "shred",
+			},
+			wantErr: `invalid value for kce.krystal.uk/load-balancer-deletion-policy: must be "delete" or "retain"`,
+		},
+		{
+			name: "data centers",
+			annotations: map[string]string{
+				annotationLoadBalancerDataCenters: "dc_a, dc_b",
+			},
+			want: &loadBalancerOptions{
+				dataCenterIDs:  []string{"dc_a", "dc_b"},
+				deletionPolicy: deletionPolicyDelete,
+			},
+		},
+		{
+			name: "data centers from nodes",
+			annotations: map[string]string{
+				annotationLoadBalancerDataCenters: "nodes",
+			},
+			want: &loadBalancerOptions{
+				dataCenterIDs:  []string{"nodes"},
+				deletionPolicy: deletionPolicyDelete,
+			},
+		},
+		{
+			name: "data centers with empty rid",
+			annotations: map[string]string{
+				annotationLoadBalancerDataCenters: "dc_a,,dc_b",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-data-centers contains an empty rid",
+		},
+		{
+			name: "data centers mixing nodes and rids",
+			annotations: map[string]string{
+				annotationLoadBalancerDataCenters: "nodes,dc_a",
+			},
+			wantErr: `kce.krystal.uk/load-balancer-data-centers cannot combine "nodes" with data center rids`,
+		},
+		{
+			name: "data centers with adoption",
+			annotations: map[string]string{
+				annotationLoadBalancerDataCenters: "dc_a",
+				annotationLoadBalancerID:          "lb_npORVDLVrf7MlghA",
+			},
+			wantErr: "kce.krystal.uk/load-balancer-data-centers cannot be used with kce.krystal.uk/load-balancer-rid",
+		},
+		{
+			name: "retain policy",
+			annotations: map[string]string{
+				annotationLoadBalancerDeletionPolicy: "retain",
+			},
+			want: &loadBalancerOptions{deletionPolicy: deletionPolicyRetain},
+		},
+		{
+			name:   "cluster default policy",
+			config: Config{DeletionPolicy: deletionPolicyRetain},
+			want:   &loadBalancerOptions{deletionPolicy: deletionPolicyRetain},
+		},
+		{
+			name: "annotation overrides cluster default policy",
+			annotations: map[string]string{
+				annotationLoadBalancerDeletionPolicy: "delete",
+			},
+			config: Config{DeletionPolicy: deletionPolicyRetain},
+			want:   &loadBalancerOptions{deletionPolicy: deletionPolicyDelete},
+		},
+		{
+			name: "port ranges",
+			annotations: map[string]string{
+				annotationLoadBalancerPortRanges: "true",
+			},
+			ports: []v1.ServicePort{
+				{Port: 10000, NodePort: 31000},
+				{Port: 10001, NodePort: 31001},
+			},
+			want: &loadBalancerOptions{
+				deletionPolicy: deletionPolicyDelete,
+				portRanges:     []portRange{{first: 10000, last: 10001, firstNodePort: 31000}},
+			},
+		},
+		{
+			name: "port ranges disabled",
+			annotations: map[string]string{
+				annotationLoadBalancerPortRanges: "false",
+			},
+			ports: []v1.ServicePort{
+				{Port: 10000, NodePort: 31000},
+				{Port: 10001, NodePort: 30000},
+			},
+			want: &loadBalancerOptions{deletionPolicy: deletionPolicyDelete},
+		},
+		{
+			name: "port ranges without consecutive node ports",
+			annotations: map[string]string{
+				annotationLoadBalancerPortRanges: "true",
+			},
+			ports: []v1.ServicePort{
+				{Port: 10000, NodePort: 31000},
+				{Port: 10001, NodePort: 30000},
+			},
+			wantErr: "invalid port ranges: port 10001 has node port 30000, but must have node port 31001 to follow on from port 10000",
+		},
+		{
+			name: "port ranges with a udp port",
+			annotations: map[string]string{
+				annotationLoadBalancerPortRanges: "true",
+			},
+			ports: []v1.ServicePort{
+				{Port: 10000, NodePort: 31000, Protocol: v1.ProtocolUDP},
+			},
+			wantErr: "invalid port ranges: port 10000 uses UDP, but port ranges only support TCP",
+		},
+		{
+			name: "invalid port ranges value",
+			annotations: map[string]string{
+				annotationLoadBalancerPortRanges: "lots",
+			},
+			wantErr: `invalid value for kce.krystal.uk/load-balancer-port-ranges: strconv.ParseBool: parsing "lots": invalid syntax`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec:       v1.ServiceSpec{Ports: tt.ports},
+			}
+
+			got, err := parseLoadBalancerOptions(service, tt.config)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
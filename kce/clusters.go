@@ -0,0 +1,77 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sort"
+)
+
+// clusterManager implements cloudprovider.Clusters. KCE clusters are not
+// exposed by the Katapult API, so the cluster is identified by configuration
+// and its control plane is discovered through the VMs carrying the control
+// plane tag.
+type clusterManager struct {
+	log    logr.Logger
+	config Config
+
+	virtualMachineController virtualMachineController
+}
+
+// ListClusters lists the names of the available clusters.
+func (cm *clusterManager) ListClusters(ctx context.Context) (clusters []string, err error) {
+	_, span := startSpan(ctx, "Clusters.ListClusters", trace.SpanKindInternal)
+	defer func() { endSpan(span, err) }()
+
+	if cm.config.ClusterName == "" {
+		return []string{}, nil
+	}
+
+	return []string{cm.config.ClusterName}, nil
+}
+
+// Master gets back the address (either DNS name or IP address) of the master
+// node for the cluster.
+func (cm *clusterManager) Master(ctx context.Context, clusterName string) (address string, err error) {
+	ctx, span := startSpan(ctx, "Clusters.Master", trace.SpanKindInternal,
+		attribute.String(logKeyClusterName, clusterName),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if cm.config.ClusterName == "" || clusterName != cm.config.ClusterName {
+		return "", fmt.Errorf("cluster %q is not managed by this provider", clusterName)
+	}
+
+	if cm.config.ControlPlaneTagID == "" {
+		return "", fmt.Errorf("control plane tag id is not set")
+	}
+
+	vms, err := listVirtualMachines(ctx, cm.virtualMachineController, cm.config.orgRef())
+	if err != nil {
+		return "", err
+	}
+
+	// Sort by RID so that the same control plane VM is reported each time.
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].ID < vms[j].ID
+	})
+
+	for _, vm := range vms {
+		for _, tag := range vm.Tags {
+			if tag.ID != cm.config.ControlPlaneTagID {
+				continue
+			}
+
+			if vm.FQDN != "" {
+				return vm.FQDN, nil
+			}
+			if len(vm.IPAddresses) > 0 {
+				return vm.IPAddresses[0].Address, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no control plane virtual machines found for cluster %q", clusterName)
+}
@@ -0,0 +1,135 @@
+package kce
+
+import (
+	"context"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestClusterManager_ListClusters(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{
+			name:   "configured",
+			config: Config{ClusterName: "kce-atlantis"},
+			want:   []string{"kce-atlantis"},
+		},
+		{
+			name: "not configured",
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := clusterManager{config: tt.config}
+
+			got, err := cm.ListClusters(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestClusterManager_Master(t *testing.T) {
+	controlPlaneTag := []*core.Tag{{ID: "control-plane-tag"}}
+
+	tests := []struct {
+		name            string
+		config          Config
+		clusterName     string
+		virtualMachines []core.VirtualMachine
+
+		want    string
+		wantErr string
+	}{
+		{
+			name:        "fqdn of first control plane vm",
+			config:      Config{ClusterName: "kce-atlantis", ControlPlaneTagID: "control-plane-tag"},
+			clusterName: "kce-atlantis",
+			virtualMachines: []core.VirtualMachine{
+				{ID: "vm_c", FQDN: "cp-2.example.com", Tags: controlPlaneTag},
+				{ID: "vm_a", FQDN: "worker-1.example.com"},
+				{ID: "vm_b", FQDN: "cp-1.example.com", Tags: controlPlaneTag},
+			},
+			want: "cp-1.example.com",
+		},
+		{
+			name:        "ip address without fqdn",
+			config:      Config{ClusterName: "kce-atlantis", ControlPlaneTagID: "control-plane-tag"},
+			clusterName: "kce-atlantis",
+			virtualMachines: []core.VirtualMachine{
+				{
+					ID:          "vm_a",
+					Tags:        controlPlaneTag,
+					IPAddresses: []*core.IPAddress{{Address: "133.7.42.1"}},
+				},
+			},
+			want: "133.7.42.1",
+		},
+		{
+			name:        "no control plane vms",
+			config:      Config{ClusterName: "kce-atlantis", ControlPlaneTagID: "control-plane-tag"},
+			clusterName: "kce-atlantis",
+			virtualMachines: []core.VirtualMachine{
+				{ID: "vm_a", FQDN: "worker-1.example.com"},
+			},
+			wantErr: `no control plane virtual machines found for cluster "kce-atlantis"`,
+		},
+		{
+			name:        "vm list error",
+			config:      Config{ClusterName: "kce-atlantis", ControlPlaneTagID: "control-plane-tag"},
+			clusterName: "kce-atlantis",
+			virtualMachines: []core.VirtualMachine{
+				{ID: "error"},
+			},
+			wantErr: "error from 0",
+		},
+		{
+			name:        "unknown cluster",
+			config:      Config{ClusterName: "kce-atlantis", ControlPlaneTagID: "control-plane-tag"},
+			clusterName: "kubernetes",
+			wantErr:     `cluster "kubernetes" is not managed by this provider`,
+		},
+		{
+			name:        "control plane tag not set",
+			config:      Config{ClusterName: "kce-atlantis"},
+			clusterName: "kce-atlantis",
+			wantErr:     "control plane tag id is not set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := clusterManager{
+				config:                   tt.config,
+				virtualMachineController: &mockVMController{items: tt.virtualMachines},
+				log:                      logTest.TestLogger{T: t},
+			}
+
+			got, err := cm.Master(context.TODO(), tt.clusterName)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerManager_EnsureLoadBalancer_clusterName(t *testing.T) {
+	lbm := loadBalancerManager{
+		config: Config{ClusterName: "kce-atlantis"},
+		log:    logTest.TestLogger{T: t},
+	}
+
+	_, err := lbm.EnsureLoadBalancer(context.TODO(), "kubernetes", &v1.Service{}, []*v1.Node{})
+	assert.EqualError(t, err, `cluster name "kubernetes" does not match configured cluster "kce-atlantis"`)
+}
@@ -0,0 +1,89 @@
+package kce
+
+import (
+	"fmt"
+	"github.com/krystal/go-katapult/core"
+	v1 "k8s.io/api/core/v1"
+	"sort"
+)
+
+// selectDataCentersFromNodes is the value of the data centers annotation that
+// places a load balancer in every data center that contains one of the nodes.
+const selectDataCentersFromNodes = "nodes"
+
+// dataCenter is a Katapult data center that the cluster has nodes in.
+type dataCenter struct {
+	id        string
+	nodeTagID string
+}
+
+func (dc dataCenter) ref() core.DataCenterRef {
+	return core.DataCenterRef{ID: dc.id}
+}
+
+// dataCenters returns every data center the cluster spans. The primary data
+// center is always first, the rest are sorted by RID.
+func (c Config) dataCenters() []dataCenter {
+	dcs := []dataCenter{{id: c.DataCenterID, nodeTagID: c.NodeTagID}}
+
+	extra := make([]string, 0, len(c.ExtraDataCenters))
+	for id := range c.ExtraDataCenters {
+		extra = append(extra, id)
+	}
+	sort.Strings(extra)
+
+	for _, id := range extra {
+		dcs = append(dcs, dataCenter{id: id, nodeTagID: c.ExtraDataCenters[id]})
+	}
+
+	return dcs
+}
+
+// dataCenter finds a configured data center by RID.
+func (c Config) dataCenter(id string) (dataCenter, bool) {
+	for _, dc := range c.dataCenters() {
+		if dc.id == id {
+			return dc, true
+		}
+	}
+
+	return dataCenter{}, false
+}
+
+// selectDataCenters determines which data centers a service should have a
+// load balancer in. Unless chosen by annotation, this is the primary data
+// center.
+func (lbm *loadBalancerManager) selectDataCenters(opts *loadBalancerOptions, nodes []*v1.Node) ([]dataCenter, error) {
+	if len(opts.dataCenterIDs) == 0 {
+		return lbm.config.dataCenters()[:1], nil
+	}
+
+	if len(opts.dataCenterIDs) == 1 && opts.dataCenterIDs[0] == selectDataCentersFromNodes {
+		selected := []dataCenter{}
+		for _, dc := range lbm.config.dataCenters() {
+			for _, node := range nodes {
+				if node.Labels[v1.LabelTopologyRegion] == dc.id {
+					selected = append(selected, dc)
+					break
+				}
+			}
+		}
+
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("no nodes found in any configured data center")
+		}
+
+		return selected, nil
+	}
+
+	selected := []dataCenter{}
+	for _, id := range opts.dataCenterIDs {
+		dc, ok := lbm.config.dataCenter(id)
+		if !ok {
+			return nil, fmt.Errorf("data center %q is not configured", id)
+		}
+		selected = append(selected, dc)
+	}
+
+	return selected, nil
+}
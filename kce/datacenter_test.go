@@ -0,0 +1,182 @@
+package kce
+
+import (
+	"context"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+var multiDataCenterConfig = Config{
+	DataCenterID: "dc_primary",
+	NodeTagID:    "primary-nodes",
+	ExtraDataCenters: map[string]string{
+		"dc_z": "z-nodes",
+		"dc_b": "b-nodes",
+	},
+}
+
+func TestConfig_dataCenters(t *testing.T) {
+	assert.Equal(t, []dataCenter{
+		{id: "dc_primary", nodeTagID: "primary-nodes"},
+		{id: "dc_b", nodeTagID: "b-nodes"},
+		{id: "dc_z", nodeTagID: "z-nodes"},
+	}, multiDataCenterConfig.dataCenters())
+}
+
+func TestLoadBalancerManager_selectDataCenters(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  *loadBalancerOptions
+		nodes []*v1.Node
+
+		want    []dataCenter
+		wantErr string
+	}{
+		{
+			name: "defaults to primary",
+			opts: &loadBalancerOptions{},
+			want: []dataCenter{
+				{id: "dc_primary", nodeTagID: "primary-nodes"},
+			},
+		},
+		{
+			name: "by annotation",
+			opts: &loadBalancerOptions{dataCenterIDs: []string{"dc_z", "dc_primary"}},
+			want: []dataCenter{
+				{id: "dc_z", nodeTagID: "z-nodes"},
+				{id: "dc_primary", nodeTagID: "primary-nodes"},
+			},
+		},
+		{
+			name:    "unknown data center",
+			opts:    &loadBalancerOptions{dataCenterIDs: []string{"dc_missing"}},
+			wantErr: `data center "dc_missing" is not configured`,
+		},
+		{
+			name: "by nodes",
+			opts: &loadBalancerOptions{dataCenterIDs: []string{"nodes"}},
+			nodes: []*v1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{v1.LabelTopologyRegion: "dc_z"}}},
+				{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{v1.LabelTopologyRegion: "dc_primary"}}},
+				{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{v1.LabelTopologyRegion: "dc_z"}}},
+				{ObjectMeta: metav1.ObjectMeta{}},
+			},
+			want: []dataCenter{
+				{id: "dc_primary", nodeTagID: "primary-nodes"},
+				{id: "dc_z", nodeTagID: "z-nodes"},
+			},
+		},
+		{
+			name: "by nodes without matches",
+			opts: &loadBalancerOptions{dataCenterIDs: []string{"nodes"}},
+			nodes: []*v1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{v1.LabelTopologyRegion: "dc_elsewhere"}}},
+			},
+			wantErr: "no nodes found in any configured data center",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lbm := loadBalancerManager{config: multiDataCenterConfig}
+
+			got, err := lbm.selectDataCenters(tt.opts, tt.nodes)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerManager_loadBalancerName(t *testing.T) {
+	lbm := loadBalancerManager{config: multiDataCenterConfig}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foobar",
+			Namespace: "default",
+		},
+	}
+	longService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      strings.Repeat("a", 100),
+			Namespace: "default",
+		},
+	}
+
+	assert.Equal(t, "kce-boo-foobar", lbm.loadBalancerName("boo", service, dataCenter{id: "dc_primary"}))
+	assert.Equal(t, "kce-boo-foobar-dc_b", lbm.loadBalancerName("boo", service, dataCenter{id: "dc_b"}))
+	assert.Equal(t,
+		"kce-boo-"+strings.Repeat("a", 47)+"-dc_b",
+		lbm.loadBalancerName("boo", longService, dataCenter{id: "dc_b"}),
+	)
+}
+
+func TestLoadBalancerManager_EnsureLoadBalancer_dataCenters(t *testing.T) {
+	lbc := &mockLBController{items: []core.LoadBalancer{
+		{
+			ID:           "lb_primary",
+			Name:         "kce-example-foobar-bar",
+			IPAddress:    &core.IPAddress{Address: "133.7.42.0"},
+			ResourceType: core.VirtualMachineGroupsResourceType,
+			ResourceIDs:  []string{"primary-nodes"},
+		},
+	}}
+	lbm := loadBalancerManager{
+		config:                     multiDataCenterConfig,
+		loadBalancerController:     lbc,
+		loadBalancerRuleController: &mockLBRController{},
+		log:                        logTest.TestLogger{T: t},
+	}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bar",
+			Namespace: "foobar",
+			Annotations: map[string]string{
+				annotationLoadBalancerDataCenters: "dc_b,dc_z",
+			},
+		},
+	}
+
+	status, err := lbm.EnsureLoadBalancer(context.TODO(), "example", service, []*v1.Node{})
+	assert.NoError(t, err)
+	assert.Equal(t, &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+		{IP: "10.0.0.0"},
+		{IP: "10.0.0.1"},
+	}}, status)
+	assert.Equal(t, []core.LoadBalancer{
+		{
+			ID:           "created-0",
+			Name:         "kce-example-foobar-bar-dc_b",
+			IPAddress:    &core.IPAddress{Address: "10.0.0.0"},
+			ResourceType: core.VirtualMachineGroupsResourceType,
+			ResourceIDs:  []string{"b-nodes"},
+		},
+		{
+			ID:           "created-1",
+			Name:         "kce-example-foobar-bar-dc_z",
+			IPAddress:    &core.IPAddress{Address: "10.0.0.1"},
+			ResourceType: core.VirtualMachineGroupsResourceType,
+			ResourceIDs:  []string{"z-nodes"},
+		},
+	}, lbc.items)
+
+	status, exists, err := lbm.GetLoadBalancer(context.TODO(), "example", service)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+		{IP: "10.0.0.0"},
+		{IP: "10.0.0.1"},
+	}}, status)
+
+	err = lbm.EnsureLoadBalancerDeleted(context.TODO(), "example", service)
+	assert.NoError(t, err)
+	assert.Equal(t, []core.LoadBalancer{}, lbc.items)
+}
@@ -0,0 +1,356 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/krystal/go-katapult/core"
+	"github.com/sethvargo/go-envconfig"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+)
+
+// defaultClusterName is the --cluster-name the controller manager uses when
+// none is given.
+const defaultClusterName = "kubernetes"
+
+// Kinds of problem reported by the doctor.
+const (
+	FindingDrift            = "drift"
+	FindingOrphan           = "orphan"
+	FindingMisconfiguration = "misconfiguration"
+)
+
+// DoctorCheck is the result of checking one part of the configuration.
+type DoctorCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// DoctorFinding is a problem found with a service or load balancer.
+type DoctorFinding struct {
+	Kind           string `json:"kind"`
+	Service        string `json:"service,omitempty"`
+	LoadBalancerID string `json:"loadBalancerId,omitempty"`
+	Message        string `json:"message"`
+}
+
+// DoctorReport describes the state of the cluster's load balancers.
+type DoctorReport struct {
+	ClusterName   string             `json:"clusterName"`
+	Checks        []DoctorCheck      `json:"checks"`
+	LoadBalancers []LoadBalancerInfo `json:"loadBalancers"`
+	Findings      []DoctorFinding    `json:"findings"`
+}
+
+// Healthy returns true if every check passed and nothing was found.
+func (r *DoctorReport) Healthy() bool {
+	for _, check := range r.Checks {
+		if !check.OK {
+			return false
+		}
+	}
+
+	return len(r.Findings) == 0
+}
+
+// check records the result of a check, returning true if it passed.
+func (r *DoctorReport) check(name string, err error, message string) bool {
+	if err != nil {
+		message = err.Error()
+	}
+	r.Checks = append(r.Checks, DoctorCheck{Name: name, OK: err == nil, Message: message})
+
+	return err == nil
+}
+
+func (r *DoctorReport) finding(kind, service, lbID, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, DoctorFinding{
+		Kind:           kind,
+		Service:        service,
+		LoadBalancerID: lbID,
+		Message:        fmt.Sprintf(format, args...),
+	})
+}
+
+// WriteText writes the report in a human readable form.
+func (r *DoctorReport) WriteText(w io.Writer) {
+	fmt.Fprintln(w, "Checks:")
+	for _, check := range r.Checks {
+		status := "ok"
+		if !check.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "  [%s] %s", status, check.Name)
+		if check.Message != "" {
+			fmt.Fprintf(w, ": %s", check.Message)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "\nLoad balancers owned by cluster %q:\n", r.ClusterName)
+	if len(r.LoadBalancers) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, lb := range r.LoadBalancers {
+		service := lb.Service
+		if service == "" {
+			service = "no service"
+		}
+		fmt.Fprintf(w, "  %s %s %s (%s) -> %s %s\n",
+			lb.ID, lb.Name, lb.IP, service, lb.ResourceType, strings.Join(lb.ResourceIDs, ","))
+		for _, rule := range lb.Rules {
+			fmt.Fprintf(w, "    %s %s %d -> %d\n", rule.ID, rule.Protocol, rule.ListenPort, rule.DestinationPort)
+		}
+	}
+
+	fmt.Fprintln(w, "\nFindings:")
+	if len(r.Findings) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, f := range r.Findings {
+		subject := f.Service
+		if f.LoadBalancerID != "" {
+			subject = strings.TrimSpace(subject + " " + f.LoadBalancerID)
+		}
+		fmt.Fprintf(w, "  [%s] %s: %s\n", f.Kind, subject, f.Message)
+	}
+}
+
+// RunDoctor checks the provider configuration from the environment against
+// the Katapult API and the cluster, and reports any problems with the
+// cluster's load balancers.
+func RunDoctor(ctx context.Context, kube kubernetes.Interface, clusterName string) *DoctorReport {
+	return runDoctor(ctx, envconfig.OsLookuper(), kube, clusterName)
+}
+
+func runDoctor(ctx context.Context, lookuper envconfig.Lookuper, kube kubernetes.Interface, clusterName string) *DoctorReport {
+	report := &DoctorReport{
+		ClusterName:   clusterName,
+		Checks:        []DoctorCheck{},
+		LoadBalancers: []LoadBalancerInfo{},
+		Findings:      []DoctorFinding{},
+	}
+
+	c, err := loadConfig(lookuper)
+	if !report.check("config", err, "") {
+		return report
+	}
+	if report.ClusterName == "" {
+		report.ClusterName = c.ClusterName
+	}
+	if report.ClusterName == "" {
+		report.ClusterName = defaultClusterName
+	}
+
+	client, err := newKatapultClient(*c, logr.Discard())
+	if !report.check("api client", err, "") {
+		return report
+	}
+	lbm := newLoadBalancerManager(*c, client, logr.Discard())
+	if !report.check("cluster name", lbm.checkClusterName(report.ClusterName), "") {
+		return report
+	}
+
+	org, _, err := client.Organizations.Get(ctx, c.orgRef())
+	if !report.check("credentials", err, "") {
+		return report
+	}
+	report.Checks[len(report.Checks)-1].Message = fmt.Sprintf("token can access organization %s (%s)", org.ID, org.Name)
+
+	_, _, err = client.LoadBalancers.List(ctx, c.orgRef(), &core.ListOptions{PerPage: 1})
+	lbScope := report.check("load_balancers scope", err, "")
+	_, _, err = client.VirtualMachines.List(ctx, c.orgRef(), &core.ListOptions{PerPage: 1})
+	vmScope := report.check("virtual_machines scope", err, "")
+	if !lbScope || !vmScope {
+		return report
+	}
+
+	vms, err := listVirtualMachines(ctx, lbm.virtualMachineController, c.orgRef())
+	if !report.check("virtual machines", err, fmt.Sprintf("%d found", len(vms))) {
+		return report
+	}
+	for _, dc := range c.dataCenters() {
+		report.checkTag(fmt.Sprintf("node tag for %s", dc.id), dc.nodeTagID, vms)
+	}
+	if c.ControlPlaneTagID != "" {
+		report.checkTag("control plane tag", c.ControlPlaneTagID, vms)
+	}
+
+	services, err := kube.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if !report.check("kubernetes", err, "") {
+		return report
+	}
+	nodeList, err := kube.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if !report.check("kubernetes nodes", err, "") {
+		return report
+	}
+	nodes := make([]*v1.Node, 0, len(nodeList.Items))
+	for i := range nodeList.Items {
+		if loadBalancerNode(&nodeList.Items[i]) {
+			nodes = append(nodes, &nodeList.Items[i])
+		}
+	}
+
+	for i := range services.Items {
+		service := &services.Items[i]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer || !lbm.handlesService(service) {
+			continue
+		}
+
+		lbm.inspectService(ctx, report, service, nodes)
+	}
+
+	owned, err := lbm.ownedLoadBalancers(ctx, report.ClusterName, services.Items)
+	if !report.check("load balancers", err, "") {
+		return report
+	}
+	for _, o := range owned {
+		info, err := lbm.describeLoadBalancer(ctx, o.lb, o.service)
+		if err != nil {
+			report.finding(FindingMisconfiguration, info.Service, o.lb.ID, "%s", err)
+		}
+		report.LoadBalancers = append(report.LoadBalancers, info)
+
+		if o.service == nil {
+			report.finding(FindingOrphan, "", o.lb.ID,
+				"load balancer %s is not used by any service", o.lb.Name)
+		}
+	}
+
+	return report
+}
+
+// checkTag checks that at least one VM carries a tag.
+func (r *DoctorReport) checkTag(name, tagID string, vms []*core.VirtualMachine) {
+	count := 0
+	for _, vm := range vms {
+		for _, tag := range vm.Tags {
+			if tag.ID == tagID {
+				count++
+				break
+			}
+		}
+	}
+
+	if count == 0 {
+		r.check(name, fmt.Errorf("no virtual machines carry tag %s", tagID), "")
+		return
+	}
+	r.check(name, nil, fmt.Sprintf("%d virtual machines carry tag %s", count, tagID))
+}
+
+// inspectService compares a service with its load balancers, using the same
+// logic as EnsureLoadBalancer, and reports any differences.
+func (lbm *loadBalancerManager) inspectService(ctx context.Context, r *DoctorReport, service *v1.Service, nodes []*v1.Node) {
+	key := serviceKey(service)
+
+	opts, err := parseLoadBalancerOptions(service, lbm.config)
+	if err != nil {
+		r.finding(FindingMisconfiguration, key, "", "%s", err)
+		return
+	}
+
+	selected, err := lbm.selectDataCenters(opts, nodes)
+	if err != nil {
+		r.finding(FindingMisconfiguration, key, "", "%s", err)
+		return
+	}
+
+	for _, dc := range lbm.config.dataCenters() {
+		lb, err := lbm.findLoadBalancer(ctx, r.ClusterName, service, opts, dc)
+		if err != nil && err != lbNotFound {
+			r.finding(FindingMisconfiguration, key, "", "failed to find load balancer in %s: %s", dc.id, err)
+			continue
+		}
+
+		if !containsDataCenter(selected, dc) {
+			if lb != nil && opts.deletionPolicy != deletionPolicyRetain {
+				r.finding(FindingDrift, key, lb.ID, "load balancer in %s is no longer wanted and should be deleted", dc.id)
+			}
+			continue
+		}
+
+		if lb == nil {
+			r.finding(FindingDrift, key, "", "no load balancer in %s", dc.id)
+			continue
+		}
+
+		lbm.inspectLoadBalancer(ctx, r, service, opts, dc, lb)
+	}
+}
+
+// inspectLoadBalancer reports any differences between a load balancer and
+// what its service requires.
+func (lbm *loadBalancerManager) inspectLoadBalancer(ctx context.Context, r *DoctorReport, service *v1.Service, opts *loadBalancerOptions, dc dataCenter, lb *core.LoadBalancer) {
+	key := serviceKey(service)
+
+	if name := lbm.loadBalancerName(r.ClusterName, service, dc); opts.loadBalancerID == "" && lb.Name != name {
+		r.finding(FindingDrift, key, lb.ID, "name is %q, expected %q", lb.Name, name)
+	}
+
+	target, err := lbm.loadBalancerTarget(ctx, opts, dc)
+	if err != nil {
+		r.finding(FindingMisconfiguration, key, lb.ID, "%s", err)
+	} else if !target.matches(lb) {
+		r.finding(FindingDrift, key, lb.ID, "targets %s %s, expected %s %s",
+			lb.ResourceType, strings.Join(lb.ResourceIDs, ","),
+			target.resourceType, strings.Join(target.resourceIDs, ","))
+	}
+
+	rules, err := lbm.listLoadBalancerRules(ctx, lb.Ref())
+	if err != nil {
+		r.finding(FindingMisconfiguration, key, lb.ID, "failed to list rules: %s", err)
+		return
+	}
+	owned := newRuleRecord(service).owned(lb.ID)
+	ports := map[int]bool{}
+	for _, port := range service.Spec.Ports {
+		ports[int(port.Port)] = true
+
+		found := findRule(rules, int(port.Port))
+		switch {
+		case found == nil:
+			r.finding(FindingDrift, key, lb.ID, "no rule for port %d", port.Port)
+		case !owned[found.ListenPort]:
+			r.finding(FindingMisconfiguration, key, lb.ID, "rule %s for port %d was not created by kce-ccm, so the port is not served",
+				found.ID, port.Port)
+		case found.DestinationPort != int(port.NodePort):
+			r.finding(FindingDrift, key, lb.ID, "rule %s for port %d sends traffic to port %d, expected node port %d",
+				found.ID, port.Port, found.DestinationPort, port.NodePort)
+		default:
+			args := serviceRuleArguments(port)
+			opts.portSettings[int(port.Port)].apply(&args)
+			if !ruleMatches(*found, args) {
+				r.finding(FindingDrift, key, lb.ID, "rule %s for port %d has different settings to those configured for the port",
+					found.ID, port.Port)
+			}
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ListenPort < rules[j].ListenPort
+	})
+	// Rules added by hand for other ports are left alone by the controller.
+	for _, rule := range rules {
+		if !ports[rule.ListenPort] && owned[rule.ListenPort] {
+			r.finding(FindingDrift, key, lb.ID, "rule %s for port %d is not used by the service", rule.ID, rule.ListenPort)
+		}
+	}
+
+	if lb.IPAddress != nil {
+		reported := false
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP == lb.IPAddress.Address {
+				reported = true
+			}
+		}
+		if !reported {
+			r.finding(FindingDrift, key, lb.ID, "service status does not include %s", lb.IPAddress.Address)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package kce
+
+import (
+	"bytes"
+	"context"
+	"github.com/krystal/go-katapult/core"
+	"github.com/krystal/kce-ccm/internal/fakekatapult"
+	"github.com/sethvargo/go-envconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newDoctorLookuper(t *testing.T, s *fakekatapult.Server) envconfig.Lookuper {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	return envconfig.MapLookuper(map[string]string{
+		"KATAPULT_API_TOKEN":        "token",
+		"KATAPULT_API_HOST":         srv.URL,
+		"KATAPULT_ORGANIZATION_RID": "org_fake",
+		"KATAPULT_DATA_CENTER_RID":  "dc_fake",
+		"KATAPULT_NODE_TAG_RID":     "tag_nodes",
+	})
+}
+
+func doctorService(name string, ports ...int32) *v1.Service {
+	service := fakeKatapultService(ports...)
+	service.Name = name
+	service.UID = ""
+	service.Spec.Type = v1.ServiceTypeLoadBalancer
+
+	return service
+}
+
+func TestRunDoctor(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	s.AddVirtualMachine("org_fake", core.VirtualMachine{
+		ID:   "vm_1",
+		Tags: []*core.Tag{{ID: "tag_nodes", Name: "nodes"}},
+	})
+	lookuper := newDoctorLookuper(t, s)
+	ctx := context.Background()
+
+	healthy := doctorService("healthy", 80)
+	status, err := lbm.EnsureLoadBalancer(ctx, "kce", healthy, nil)
+	require.NoError(t, err)
+	healthy.Status.LoadBalancer = *status
+
+	drifted := doctorService("drifted", 80, 443)
+	status, err = lbm.EnsureLoadBalancer(ctx, "kce", drifted, nil)
+	require.NoError(t, err)
+	drifted.Status.LoadBalancer = *status
+	drifted.Spec.Ports[1].NodePort = 31000
+
+	missing := doctorService("missing", 80)
+
+	misconfigured := doctorService("misconfigured", 80)
+	misconfigured.Annotations = map[string]string{
+		annotationLoadBalancerDeletionPolicy: "bogus",
+	}
+
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", doctorService("deleted", 80), nil)
+	require.NoError(t, err)
+	_, _, err = lbm.loadBalancerController.Create(ctx, lbm.config.orgRef(), &core.LoadBalancerCreateArguments{
+		Name:       "unrelated",
+		DataCenter: lbm.config.dcRef(),
+	})
+	require.NoError(t, err)
+
+	kube := fake.NewSimpleClientset(healthy, drifted, missing, misconfigured)
+	report := runDoctor(ctx, lookuper, kube, "kce")
+
+	for _, check := range report.Checks {
+		assert.True(t, check.OK, "check %s failed: %s", check.Name, check.Message)
+	}
+	assert.False(t, report.Healthy())
+
+	owned := map[string]string{}
+	for _, lb := range report.LoadBalancers {
+		owned[lb.Name] = lb.Service
+	}
+	assert.Equal(t, map[string]string{
+		"kce-kce-healthy": "default/healthy",
+		"kce-kce-drifted": "default/drifted",
+		"kce-kce-deleted": "",
+	}, owned)
+
+	findings := map[string][]string{}
+	for _, f := range report.Findings {
+		findings[f.Kind] = append(findings[f.Kind], f.Service)
+	}
+	assert.Equal(t, map[string][]string{
+		FindingDrift:            {"default/drifted", "default/missing"},
+		FindingMisconfiguration: {"default/misconfigured"},
+		FindingOrphan:           {""},
+	}, findings)
+
+	buf := &bytes.Buffer{}
+	report.WriteText(buf)
+	assert.Contains(t, buf.String(), "sends traffic to port 30443, expected node port 31000")
+	assert.Contains(t, buf.String(), "[orphan]")
+}
+
+func TestRunDoctor_checks(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(s *fakekatapult.Server)
+		wantCheck DoctorCheck
+	}{
+		{
+			name: "invalid token",
+			setup: func(s *fakekatapult.Server) {
+				s.Token = "other"
+			},
+			wantCheck: DoctorCheck{
+				Name:    "credentials",
+				Message: "invalid_api_token: The API token provided was not valid",
+			},
+		},
+		{
+			name: "missing scope",
+			setup: func(s *fakekatapult.Server) {
+				s.AddFault(fakekatapult.Fault{
+					Method:     http.MethodGet,
+					Path:       "/core/v1/organizations/_/load_balancers",
+					StatusCode: http.StatusForbidden,
+				})
+			},
+			wantCheck: DoctorCheck{
+				Name:    "load_balancers scope",
+				Message: "scope_not_granted: The scope required for this endpoint has not been granted to the authenticating identity",
+			},
+		},
+		{
+			name:  "untagged nodes",
+			setup: func(s *fakekatapult.Server) {},
+			wantCheck: DoctorCheck{
+				Name:    "node tag for dc_fake",
+				Message: "no virtual machines carry tag tag_nodes",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := fakekatapult.NewServer()
+			s.AddOrganization(core.Organization{ID: "org_fake"})
+			lookuper := newDoctorLookuper(t, s)
+			tt.setup(s)
+
+			report := runDoctor(context.Background(), lookuper, fake.NewSimpleClientset(), "kce")
+
+			assert.False(t, report.Healthy())
+			assert.Contains(t, report.Checks, tt.wantCheck)
+		})
+	}
+}
+
+func TestRunDoctor_config(t *testing.T) {
+	report := runDoctor(context.Background(), envconfig.MapLookuper(nil), fake.NewSimpleClientset(), "")
+
+	assert.Equal(t, []DoctorCheck{
+		{Name: "config", Message: "api key is not configured"},
+	}, report.Checks)
+	assert.False(t, report.Healthy())
+}
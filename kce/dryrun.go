@@ -0,0 +1,98 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const eventReasonDryRun = "LoadBalancerDryRun"
+
+// Actions and resources of the changes skipped by a dry run.
+const (
+	dryRunCreate = "create"
+	dryRunUpdate = "update"
+	dryRunDelete = "delete"
+
+	dryRunLoadBalancer     = "lb"
+	dryRunLoadBalancerRule = "lb rule"
+)
+
+// dryRunChanges counts the changes to Katapult that a dry run has skipped.
+var dryRunChanges = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Namespace:      "kce_ccm",
+		Name:           "dry_run_changes_total",
+		Help:           "Number of changes to Katapult resources skipped because dry run is enabled.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"action", "resource"},
+)
+
+func init() {
+	legacyregistry.MustRegister(dryRunChanges)
+}
+
+// dryRunChange records a change to Katapult that was skipped as dry run is
+// enabled, by logging it, counting it and raising an event against the
+// service if there is one. The subject identifies the resource that would
+// have changed to someone reading the event.
+func (lbm *loadBalancerManager) dryRunChange(ctx context.Context, service *v1.Service, action, resource, subject string, keysAndValues ...interface{}) {
+	lbm.dryRunChangeBatch(ctx, service, action, resource, subject, 1, keysAndValues...)
+}
+
+// dryRunChangeBatch is the same as dryRunChange, but records n changes to
+// resources that are reported together, such as the rules for a port range.
+func (lbm *loadBalancerManager) dryRunChangeBatch(ctx context.Context, service *v1.Service, action, resource, subject string, n int, keysAndValues ...interface{}) {
+	noun := resource
+	if n > 1 {
+		noun += "s"
+	}
+
+	loggerFrom(ctx, lbm.log).Info(fmt.Sprintf("dry run: would %s %s", action, noun), keysAndValues...)
+	dryRunChanges.WithLabelValues(action, metricResource(resource)).Add(float64(n))
+
+	if service != nil {
+		lbm.event(service, v1.EventTypeNormal, eventReasonDryRun,
+			"Dry run: would %s %s %s", action, noun, subject,
+		)
+	}
+}
+
+// dryRunRuleChanges records the rule changes that a dry run has skipped.
+// Changes to the rules for a port range are reported together.
+func (lbm *loadBalancerManager) dryRunRuleChanges(ctx context.Context, service *v1.Service, changes []ruleChange, ranges []portRange, keysAndValues ...interface{}) {
+	for _, batch := range batchRuleChanges(changes, ranges) {
+		c := batch[0]
+		if len(batch) == 1 {
+			kv := append([]interface{}{"rulePort", c.port}, keysAndValues...)
+			if c.rule != nil {
+				kv = append(kv, logKeyRuleID, c.rule.ID)
+			}
+			subject := fmt.Sprintf("for port %d", c.port)
+			if c.from != 0 {
+				kv = append(kv, "previousRulePort", c.from)
+				subject += fmt.Sprintf(" to move it from port %d", c.from)
+			}
+			lbm.dryRunChange(ctx, service, c.action, dryRunLoadBalancerRule, subject, kv...)
+			continue
+		}
+
+		ports := make([]int, 0, len(batch))
+		for _, c := range batch {
+			ports = append(ports, c.port)
+		}
+		kv := append([]interface{}{"rulePorts", formatPorts(ports)}, keysAndValues...)
+		lbm.dryRunChangeBatch(ctx, service, c.action, dryRunLoadBalancerRule, "for ports "+formatPorts(ports), len(batch), kv...)
+	}
+}
+
+func metricResource(resource string) string {
+	if resource == dryRunLoadBalancerRule {
+		return "lb_rule"
+	}
+
+	return resource
+}
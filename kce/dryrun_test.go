@@ -0,0 +1,219 @@
+package kce
+
+import (
+	"context"
+	"github.com/krystal/kce-ccm/internal/fakekatapult"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics/testutil"
+	"net/http"
+	"testing"
+)
+
+// mutatingRequests returns the requests made to the fake Katapult API that
+// would have changed something.
+func mutatingRequests(s *fakekatapult.Server) []string {
+	requests := []string{}
+	for _, req := range s.Requests() {
+		if req.Method != http.MethodGet {
+			requests = append(requests, req.Method+" "+req.Path)
+		}
+	}
+
+	return requests
+}
+
+func dryRunCount(t *testing.T, action, resource string) float64 {
+	v, err := testutil.GetCounterMetricValue(dryRunChanges.WithLabelValues(action, resource))
+	require.NoError(t, err)
+
+	return v
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestLoadBalancerManager_dryRun(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	recorder := record.NewFakeRecorder(20)
+	lbm.recorder = recorder
+	ctx := context.Background()
+
+	t.Run("create", func(t *testing.T) {
+		lbm.config.DryRun = true
+		createdRules := dryRunCount(t, dryRunCreate, "lb_rule")
+
+		status, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443), nil)
+		require.NoError(t, err)
+		assert.Empty(t, status.Ingress)
+		assert.Empty(t, s.LoadBalancers())
+		assert.Empty(t, mutatingRequests(s))
+		assert.Equal(t, createdRules+2, dryRunCount(t, dryRunCreate, "lb_rule"))
+		assert.Equal(t, []string{
+			"Normal LoadBalancerDryRun Dry run: would create lb kce-kce-web",
+			"Normal LoadBalancerDryRun Dry run: would create lb rule for port 80",
+			"Normal LoadBalancerDryRun Dry run: would create lb rule for port 443",
+		}, drainEvents(recorder))
+	})
+
+	t.Run("port ranges", func(t *testing.T) {
+		lbm.config.DryRun = true
+		createdRules := dryRunCount(t, dryRunCreate, "lb_rule")
+		service := fakeKatapultService(80, 10000, 10001, 10002)
+		service.Annotations = map[string]string{annotationLoadBalancerPortRanges: "true"}
+
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+		require.NoError(t, err)
+		assert.Empty(t, mutatingRequests(s))
+		assert.Equal(t, createdRules+4, dryRunCount(t, dryRunCreate, "lb_rule"))
+		assert.Equal(t, []string{
+			"Normal LoadBalancerDryRun Dry run: would create lb kce-kce-web",
+			"Normal LoadBalancerDryRun Dry run: would create lb rule for port 80",
+			"Normal LoadBalancerDryRun Dry run: would create lb rules for ports 10000-10002",
+		}, drainEvents(recorder))
+	})
+
+	t.Run("update", func(t *testing.T) {
+		lbm.config.DryRun = false
+		kube := withFakeCluster(lbm, fakeKatapultService())
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443), nil)
+		require.NoError(t, err)
+		drainEvents(recorder)
+		s.ResetRequests()
+
+		lbm.config.DryRun = true
+		service := recorded(t, kube, fakeKatapultService(80, 8080))
+		service.Spec.Ports[0].NodePort = 31000
+		_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+		require.NoError(t, err)
+		assert.Empty(t, mutatingRequests(s))
+		assert.Equal(t, []string{
+			"Normal LoadBalancerDryRun Dry run: would create lb rule for port 8080",
+			"Normal LoadBalancerDryRun Dry run: would update lb rule for port 80",
+			"Normal LoadBalancerDryRun Dry run: would delete lb rule for port 443",
+		}, drainEvents(recorder))
+
+		// Rules that already match are not reported.
+		_, err = lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443), nil)
+		require.NoError(t, err)
+		assert.Empty(t, drainEvents(recorder))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		lbm.config.DryRun = true
+		lbs := s.LoadBalancers()
+		require.Len(t, lbs, 1)
+		deleted := dryRunCount(t, dryRunDelete, "lb")
+
+		err := lbm.EnsureLoadBalancerDeleted(ctx, "kce", fakeKatapultService(80, 443))
+		require.NoError(t, err)
+		assert.Len(t, s.LoadBalancers(), 1)
+		assert.Empty(t, mutatingRequests(s))
+		assert.Equal(t, deleted+1, dryRunCount(t, dryRunDelete, "lb"))
+		assert.Equal(t, []string{
+			"Normal LoadBalancerDryRun Dry run: would delete lb rule for port 80",
+			"Normal LoadBalancerDryRun Dry run: would delete lb rule for port 443",
+			"Normal LoadBalancerDryRun Dry run: would delete lb " + lbs[0].ID,
+		}, drainEvents(recorder))
+	})
+
+	// The service controller only deletes load balancers that GetLoadBalancer
+	// reports, so a deleted service must be reported even when its
+	// annotations are invalid.
+	t.Run("deleted service", func(t *testing.T) {
+		lbm.config.DryRun = true
+		lbs := s.LoadBalancers()
+		require.Len(t, lbs, 1)
+		deleted := dryRunCount(t, dryRunDelete, "lb")
+		service := fakeKatapultService(80, 443)
+		now := metav1.Now()
+		service.DeletionTimestamp = &now
+		service.Annotations = map[string]string{
+			annotationLoadBalancerPortSettings: "not json",
+		}
+
+		_, exists, err := lbm.GetLoadBalancer(ctx, "kce", service)
+		require.NoError(t, err)
+		require.True(t, exists)
+		err = lbm.EnsureLoadBalancerDeleted(ctx, "kce", service)
+		require.NoError(t, err)
+		assert.Len(t, s.LoadBalancers(), 1)
+		assert.Empty(t, mutatingRequests(s))
+		assert.Equal(t, deleted+1, dryRunCount(t, dryRunDelete, "lb"))
+		assert.Equal(t, []string{
+			"Normal LoadBalancerDryRun Dry run: would delete lb rule for port 80",
+			"Normal LoadBalancerDryRun Dry run: would delete lb rule for port 443",
+			"Normal LoadBalancerDryRun Dry run: would delete lb " + lbs[0].ID,
+		}, drainEvents(recorder))
+	})
+
+	t.Run("retained service", func(t *testing.T) {
+		lbm.config.DryRun = true
+		lbs := s.LoadBalancers()
+		require.Len(t, lbs, 1)
+		updated := dryRunCount(t, dryRunUpdate, "lb")
+		service := fakeKatapultService(80, 443)
+		service.Annotations = map[string]string{
+			annotationLoadBalancerDeletionPolicy: "retain",
+		}
+
+		err := lbm.EnsureLoadBalancerDeleted(ctx, "kce", service)
+		require.NoError(t, err)
+		assert.Equal(t, "kce-kce-web", s.LoadBalancers()[0].Name)
+		assert.Empty(t, mutatingRequests(s))
+		assert.Equal(t, updated+1, dryRunCount(t, dryRunUpdate, "lb"))
+		assert.Equal(t, []string{
+			"Normal LoadBalancerDryRun Dry run: would update lb " + lbs[0].ID + ` to rename it "released-kce-kce-web"`,
+		}, drainEvents(recorder))
+	})
+
+	t.Run("released load balancer", func(t *testing.T) {
+		lbm.config.DryRun = false
+		service := fakeKatapultService(80, 443)
+		service.Annotations = map[string]string{
+			annotationLoadBalancerDeletionPolicy: "retain",
+		}
+		require.NoError(t, lbm.EnsureLoadBalancerDeleted(ctx, "kce", service))
+		lbs := s.LoadBalancers()
+		require.Len(t, lbs, 1)
+		require.Equal(t, "released-kce-kce-web", lbs[0].Name)
+		drainEvents(recorder)
+		s.ResetRequests()
+
+		lbm.config.DryRun = true
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443), nil)
+		require.NoError(t, err)
+		assert.Equal(t, "released-kce-kce-web", s.LoadBalancers()[0].Name)
+		assert.Empty(t, mutatingRequests(s))
+		assert.Equal(t, []string{
+			"Normal LoadBalancerDryRun Dry run: would update lb " + lbs[0].ID + ` to rename it "kce-kce-web"`,
+		}, drainEvents(recorder))
+	})
+
+	t.Run("adopted retained service", func(t *testing.T) {
+		lbm.config.DryRun = true
+		lbs := s.LoadBalancers()
+		require.Len(t, lbs, 1)
+		service := fakeKatapultService(80, 443)
+		service.Annotations = map[string]string{
+			annotationLoadBalancerID:             lbs[0].ID,
+			annotationLoadBalancerDeletionPolicy: "retain",
+		}
+
+		err := lbm.EnsureLoadBalancerDeleted(ctx, "kce", service)
+		require.NoError(t, err)
+		assert.Empty(t, mutatingRequests(s))
+		assert.Empty(t, drainEvents(recorder))
+	})
+}
@@ -0,0 +1,24 @@
+package kce
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// eventComponent is the source reported on events raised by the provider.
+	eventComponent = "kce-cloud-controller-manager"
+
+	eventReasonDriftCorrected = "LoadBalancerDriftCorrected"
+	eventReasonReleased       = "LoadBalancerReleased"
+	eventReasonReclaimed      = "LoadBalancerReclaimed"
+)
+
+// event records an event against a service. Events are only recorded once the
+// provider has been initialized with a recorder.
+func (lbm *loadBalancerManager) event(service *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if lbm.recorder == nil {
+		return
+	}
+
+	lbm.recorder.Eventf(service, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,182 @@
+package kce
+
+import (
+	"context"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult/core"
+	"github.com/krystal/kce-ccm/internal/fakekatapult"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newFakeKatapult starts a fake Katapult API with an empty organization, and
+// returns a load balancer manager that uses it.
+func newFakeKatapult(t *testing.T) (*fakekatapult.Server, *loadBalancerManager) {
+	s := fakekatapult.NewServer()
+	s.AddOrganization(core.Organization{ID: "org_fake"})
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	client, err := fakekatapult.NewClient(srv.URL, "")
+	require.NoError(t, err)
+
+	return s, &loadBalancerManager{
+		log: logTest.TestLogger{T: t},
+		config: Config{
+			OrganizationID: "org_fake",
+			DataCenterID:   "dc_fake",
+			NodeTagID:      "tag_nodes",
+		},
+		loadBalancerController:        client.LoadBalancers,
+		loadBalancerRuleController:    client.LoadBalancerRules,
+		virtualMachineController:      client.VirtualMachines,
+		virtualMachineGroupController: client.VirtualMachineGroups,
+		deletePollInterval:            time.Millisecond,
+		deletePollTimeout:             time.Second,
+	}
+}
+
+func fakeKatapultService(ports ...int32) *v1.Service {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			UID:       "d5a4b4c6-7c4e-4a5e-9c1d-1a0b6c1d2e3f",
+		},
+	}
+	for _, port := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{
+			Port:     port,
+			NodePort: 30000 + port,
+		})
+	}
+
+	return service
+}
+
+// withFakeCluster gives lbm a fake cluster holding a service, so that the
+// rules it manages on the service's load balancers are recorded.
+func withFakeCluster(lbm *loadBalancerManager, service *v1.Service) kubernetes.Interface {
+	kube := fake.NewSimpleClientset(service)
+	lbm.kube = kube
+
+	return kube
+}
+
+// recorded returns a copy of a service with the annotations stored in the
+// fake cluster, as the service controller would pass it on its next sync.
+func recorded(t *testing.T, kube kubernetes.Interface, service *v1.Service) *v1.Service {
+	stored, err := kube.CoreV1().Services(service.Namespace).Get(context.Background(), service.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	service = service.DeepCopy()
+	service.Annotations = stored.Annotations
+
+	return service
+}
+
+func TestLoadBalancerManager_fakeKatapult(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	kube := withFakeCluster(lbm, fakeKatapultService())
+	ctx := context.Background()
+
+	status, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443), nil)
+	require.NoError(t, err)
+
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	assert.Equal(t, lbs[0].IPAddress.Address, status.Ingress[0].IP)
+	assert.Equal(t, []int{80, 443}, fakeListenPorts(s.LoadBalancerRules(lbs[0].ID)))
+
+	// Removing a port removes its rule, and the load balancer is reused.
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", recorded(t, kube, fakeKatapultService(443)), nil)
+	require.NoError(t, err)
+	assert.Len(t, s.LoadBalancers(), 1)
+	assert.Equal(t, []int{443}, fakeListenPorts(s.LoadBalancerRules(lbs[0].ID)))
+
+	err = lbm.EnsureLoadBalancerDeleted(ctx, "kce", fakeKatapultService(443))
+	require.NoError(t, err)
+	assert.Empty(t, s.LoadBalancers())
+}
+
+func TestLoadBalancerManager_fakeKatapultPagination(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	s.PerPage = 1
+	ctx := context.Background()
+	service := fakeKatapultService(80)
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	for _, name := range []string{"unrelated-1", "unrelated-2"} {
+		_, _, err := lbm.loadBalancerController.Create(ctx, lbm.config.orgRef(), &core.LoadBalancerCreateArguments{
+			Name:       name,
+			DataCenter: lbm.config.dcRef(),
+		})
+		require.NoError(t, err)
+	}
+
+	// The service's load balancer is on the first of three pages, and must
+	// be found rather than a duplicate created.
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	assert.Len(t, s.LoadBalancers(), 3)
+
+	pages := 0
+	for _, req := range s.Requests() {
+		if req.Method == http.MethodGet && req.Path == "/core/v1/organizations/_/load_balancers" {
+			pages++
+		}
+	}
+	assert.Equal(t, 4, pages)
+}
+
+func TestLoadBalancerManager_fakeKatapultFaults(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	ctx := context.Background()
+	service := fakeKatapultService(80)
+
+	s.AddFault(fakekatapult.Fault{
+		Method:     http.MethodPost,
+		StatusCode: http.StatusTooManyRequests,
+		Count:      1,
+		Path:       "/core/v1/organizations/_/load_balancers",
+	})
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	assert.EqualError(t, err, "too_many_requests: You have exceeded the rate limit for this API")
+	assert.Empty(t, s.LoadBalancers())
+
+	s.AddFault(fakekatapult.Fault{
+		Method:     http.MethodGet,
+		StatusCode: http.StatusInternalServerError,
+		Count:      1,
+		Path:       "/core/v1/load_balancers/_/rules",
+	})
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	assert.EqualError(t, err, "internal_server_error: An internal server error occurred")
+
+	// Once the faults have passed, the next attempt picks up where the last
+	// one failed without creating a second load balancer.
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	assert.Equal(t, []int{80}, fakeListenPorts(s.LoadBalancerRules(lbs[0].ID)))
+}
+
+func fakeListenPorts(rules []core.LoadBalancerRule) []int {
+	ports := []int{}
+	for _, rule := range rules {
+		ports = append(ports, rule.ListenPort)
+	}
+
+	return ports
+}
@@ -0,0 +1,215 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	cloudprovider "k8s.io/cloud-provider"
+	"net"
+	"strings"
+)
+
+// providerIDPrefix is prepended to a VM's RID to form the node's provider ID.
+const providerIDPrefix = ProviderName + "://"
+
+type virtualMachineNetworkInterfaceController interface {
+	List(ctx context.Context, vm core.VirtualMachineRef, opts *core.ListOptions) ([]*core.VirtualMachineNetworkInterface, *katapult.Response, error)
+}
+
+// instancesManager implements cloudprovider.InstancesV2, mapping nodes to the
+// Katapult VMs they run on.
+type instancesManager struct {
+	log    logr.Logger
+	config Config
+
+	virtualMachineController                 virtualMachineController
+	virtualMachineNetworkInterfaceController virtualMachineNetworkInterfaceController
+}
+
+// vmRef determines the VM for a node. The provider ID is used when set,
+// otherwise the node name is expected to be the VM's FQDN.
+func vmRef(node *v1.Node) (core.VirtualMachineRef, error) {
+	if node.Spec.ProviderID == "" {
+		return core.VirtualMachineRef{FQDN: node.Name}, nil
+	}
+
+	if !strings.HasPrefix(node.Spec.ProviderID, providerIDPrefix) {
+		return core.VirtualMachineRef{}, fmt.Errorf("provider id %q is not a %s provider id", node.Spec.ProviderID, ProviderName)
+	}
+
+	return core.VirtualMachineRef{ID: strings.TrimPrefix(node.Spec.ProviderID, providerIDPrefix)}, nil
+}
+
+// getVirtualMachine fetches the VM for a node.
+func (im *instancesManager) getVirtualMachine(ctx context.Context, node *v1.Node) (*core.VirtualMachine, error) {
+	ref, err := vmRef(node)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, resp, err := im.virtualMachineController.Get(ctx, ref)
+	if err != nil {
+		if isNotFound(resp) {
+			return nil, cloudprovider.InstanceNotFound
+		}
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// listNetworkInterfaces fetches all network interfaces for a VM, paging where
+// necessary
+func (im *instancesManager) listNetworkInterfaces(ctx context.Context, vm core.VirtualMachineRef) ([]*core.VirtualMachineNetworkInterface, error) {
+	list, resp, err := im.virtualMachineNetworkInterfaceController.List(ctx, vm, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for page := 2; page <= resp.Pagination.TotalPages; page++ {
+		more, _, err := im.virtualMachineNetworkInterfaceController.List(ctx, vm, &core.ListOptions{Page: page})
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, more...)
+	}
+
+	return list, err
+}
+
+// privateNetworks are the RFC 1918 IPv4 ranges and the IPv6 unique local
+// range, whose addresses can only be reached privately.
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// isPrivateAddress returns true if an address is in one of privateNetworks.
+func isPrivateAddress(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeAddresses builds the addresses for a VM. Addresses on the configured
+// internal network are internal, all others are external. If no internal
+// network is configured, private addresses are internal instead.
+func (im *instancesManager) nodeAddresses(ctx context.Context, vm *core.VirtualMachine) ([]v1.NodeAddress, error) {
+	interfaces, err := im.listNetworkInterfaces(ctx, vm.Ref())
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []v1.NodeAddress{}
+	if vm.Hostname != "" {
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeHostName, Address: vm.Hostname})
+	}
+	if vm.FQDN != "" {
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeInternalDNS, Address: vm.FQDN})
+	}
+
+	for _, iface := range interfaces {
+		internal := iface.Network != nil && iface.Network.ID == im.config.InternalNetworkID
+
+		for _, ip := range iface.IPAddresses {
+			if im.config.InternalNetworkID == "" {
+				internal = isPrivateAddress(ip.Address)
+			}
+
+			if internal {
+				addresses = append(addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip.Address})
+			} else {
+				addresses = append(addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: ip.Address})
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+// InstanceExists returns true if the instance for the given node exists
+// according to the cloud provider.
+func (im *instancesManager) InstanceExists(ctx context.Context, node *v1.Node) (exists bool, err error) {
+	ctx, span := startSpan(ctx, "InstancesV2.InstanceExists", trace.SpanKindInternal, nodeAttributes(node)...)
+	defer func() { endSpan(span, err) }()
+
+	_, err = im.getVirtualMachine(ctx, node)
+	if err != nil {
+		if err == cloudprovider.InstanceNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// InstanceShutdown returns true if the instance is shutdown according to the
+// cloud provider.
+func (im *instancesManager) InstanceShutdown(ctx context.Context, node *v1.Node) (shutdown bool, err error) {
+	ctx, span := startSpan(ctx, "InstancesV2.InstanceShutdown", trace.SpanKindInternal, nodeAttributes(node)...)
+	defer func() { endSpan(span, err) }()
+
+	vm, err := im.getVirtualMachine(ctx, node)
+	if err != nil {
+		return false, err
+	}
+
+	return vm.State == core.VirtualMachineStopped, nil
+}
+
+// InstanceMetadata returns the instance's metadata. The region is the RID of
+// the VM's data center, which is used to place load balancers when a service
+// requests them in every data center containing a node.
+func (im *instancesManager) InstanceMetadata(ctx context.Context, node *v1.Node) (metadata *cloudprovider.InstanceMetadata, err error) {
+	ctx, span := startSpan(ctx, "InstancesV2.InstanceMetadata", trace.SpanKindInternal, nodeAttributes(node)...)
+	defer func() { endSpan(span, err) }()
+
+	vm, err := im.getVirtualMachine(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := im.nodeAddresses(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata = &cloudprovider.InstanceMetadata{
+		ProviderID:    providerIDPrefix + vm.ID,
+		NodeAddresses: addresses,
+	}
+	if vm.Package != nil {
+		metadata.InstanceType = vm.Package.Permalink
+	}
+	if vm.Zone != nil {
+		metadata.Zone = vm.Zone.Permalink
+		if vm.Zone.DataCenter != nil {
+			metadata.Region = vm.Zone.DataCenter.ID
+		}
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,289 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cloudprovider "k8s.io/cloud-provider"
+	"testing"
+)
+
+type mockVMNIController struct {
+	items map[string][]*core.VirtualMachineNetworkInterface
+}
+
+func (vmnic *mockVMNIController) List(_ context.Context, vm core.VirtualMachineRef, _ *core.ListOptions) ([]*core.VirtualMachineNetworkInterface, *katapult.Response, error) {
+	if vm.ID == "vm_nic_error" {
+		return nil, nil, fmt.Errorf("error listing interfaces")
+	}
+
+	return vmnic.items[vm.ID], &katapult.Response{Pagination: &katapult.Pagination{TotalPages: 1}}, nil
+}
+
+var testVirtualMachines = []core.VirtualMachine{
+	{
+		ID:       "vm_worker",
+		Hostname: "worker-1",
+		FQDN:     "worker-1.example.com",
+		State:    core.VirtualMachineStarted,
+		Package:  &core.VirtualMachinePackage{Permalink: "rock-3"},
+		Zone: &core.Zone{
+			Permalink:  "atlantis-a",
+			DataCenter: &core.DataCenter{ID: "dc_atlantis"},
+		},
+	},
+	{
+		ID:    "vm_stopped",
+		FQDN:  "stopped.example.com",
+		State: core.VirtualMachineStopped,
+	},
+	{
+		ID:   "vm_nic_error",
+		FQDN: "nic-error.example.com",
+	},
+}
+
+var testNetworkInterfaces = map[string][]*core.VirtualMachineNetworkInterface{
+	"vm_worker": {
+		{
+			Network: &core.Network{ID: "netw_public"},
+			IPAddresses: []*core.IPAddress{
+				{Address: "133.7.42.1"},
+				{Address: "2a03:2800::1"},
+			},
+		},
+		{
+			Network: &core.Network{ID: "netw_private"},
+			IPAddresses: []*core.IPAddress{
+				{Address: "10.0.0.1"},
+			},
+		},
+	},
+}
+
+func TestInstancesManager_InstanceMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		node   *v1.Node
+
+		want    *cloudprovider.InstanceMetadata
+		wantErr string
+	}{
+		{
+			name:   "by provider id with internal network",
+			config: Config{InternalNetworkID: "netw_private"},
+			node: &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: "kce://vm_worker"},
+			},
+			want: &cloudprovider.InstanceMetadata{
+				ProviderID:   "kce://vm_worker",
+				InstanceType: "rock-3",
+				Zone:         "atlantis-a",
+				Region:       "dc_atlantis",
+				NodeAddresses: []v1.NodeAddress{
+					{Type: v1.NodeHostName, Address: "worker-1"},
+					{Type: v1.NodeInternalDNS, Address: "worker-1.example.com"},
+					{Type: v1.NodeExternalIP, Address: "133.7.42.1"},
+					{Type: v1.NodeExternalIP, Address: "2a03:2800::1"},
+					{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+				},
+			},
+		},
+		{
+			name: "by node name without internal network",
+			node: &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker-1.example.com"},
+			},
+			want: &cloudprovider.InstanceMetadata{
+				ProviderID:   "kce://vm_worker",
+				InstanceType: "rock-3",
+				Zone:         "atlantis-a",
+				Region:       "dc_atlantis",
+				NodeAddresses: []v1.NodeAddress{
+					{Type: v1.NodeHostName, Address: "worker-1"},
+					{Type: v1.NodeInternalDNS, Address: "worker-1.example.com"},
+					{Type: v1.NodeExternalIP, Address: "133.7.42.1"},
+					{Type: v1.NodeExternalIP, Address: "2a03:2800::1"},
+					{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+				},
+			},
+		},
+		{
+			name: "without zone or package",
+			node: &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: "kce://vm_stopped"},
+			},
+			want: &cloudprovider.InstanceMetadata{
+				ProviderID: "kce://vm_stopped",
+				NodeAddresses: []v1.NodeAddress{
+					{Type: v1.NodeInternalDNS, Address: "stopped.example.com"},
+				},
+			},
+		},
+		{
+			name: "not found",
+			node: &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: "kce://vm_missing"},
+			},
+			wantErr: "instance not found",
+		},
+		{
+			name: "foreign provider id",
+			node: &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: "aws:///eu-west-1a/i-abc"},
+			},
+			wantErr: `provider id "aws:///eu-west-1a/i-abc" is not a kce provider id`,
+		},
+		{
+			name: "vm lookup error",
+			node: &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: "kce://error"},
+			},
+			wantErr: "error from get",
+		},
+		{
+			name: "network interface error",
+			node: &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: "kce://vm_nic_error"},
+			},
+			wantErr: "error listing interfaces",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := instancesManager{
+				config:                                   tt.config,
+				virtualMachineController:                 &mockVMController{items: testVirtualMachines},
+				virtualMachineNetworkInterfaceController: &mockVMNIController{items: testNetworkInterfaces},
+				log:                                      logTest.TestLogger{T: t},
+			}
+
+			got, err := im.InstanceMetadata(context.TODO(), tt.node)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstancesManager_InstanceExists(t *testing.T) {
+	tests := []struct {
+		name       string
+		providerID string
+
+		want    bool
+		wantErr string
+	}{
+		{
+			name:       "exists",
+			providerID: "kce://vm_worker",
+			want:       true,
+		},
+		{
+			name:       "missing",
+			providerID: "kce://vm_missing",
+			want:       false,
+		},
+		{
+			name:       "error",
+			providerID: "kce://error",
+			wantErr:    "error from get",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := instancesManager{
+				virtualMachineController: &mockVMController{items: testVirtualMachines},
+				log:                      logTest.TestLogger{T: t},
+			}
+
+			got, err := im.InstanceExists(context.TODO(), &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: tt.providerID},
+			})
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstancesManager_InstanceShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		providerID string
+
+		want    bool
+		wantErr string
+	}{
+		{
+			name:       "running",
+			providerID: "kce://vm_worker",
+			want:       false,
+		},
+		{
+			name:       "stopped",
+			providerID: "kce://vm_stopped",
+			want:       true,
+		},
+		{
+			name:       "missing",
+			providerID: "kce://vm_missing",
+			wantErr:    "instance not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := instancesManager{
+				virtualMachineController: &mockVMController{items: testVirtualMachines},
+				log:                      logTest.TestLogger{T: t},
+			}
+
+			got, err := im.InstanceShutdown(context.TODO(), &v1.Node{
+				Spec: v1.NodeSpec{ProviderID: tt.providerID},
+			})
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{address: "10.1.2.3", want: true},
+		{address: "172.16.0.1", want: true},
+		{address: "172.31.255.255", want: true},
+		{address: "172.32.0.1", want: false},
+		{address: "192.168.1.1", want: true},
+		{address: "133.7.42.1", want: false},
+		{address: "fd00::1", want: true},
+		{address: "2a03:2800::1", want: false},
+		{address: "not an address", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			assert.Equal(t, tt.want, isPrivateAddress(tt.address))
+		})
+	}
+}
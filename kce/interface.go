@@ -7,10 +7,17 @@ import (
 	"github.com/krystal/go-katapult"
 	"github.com/krystal/go-katapult/core"
 	"github.com/sethvargo/go-envconfig"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"io"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
-	"k8s.io/klog/v2/klogr"
 	"net/url"
+	"os"
+	"time"
 )
 
 type Config struct {
@@ -21,6 +28,58 @@ type Config struct {
 	DataCenterID   string `env:"KATAPULT_DATA_CENTER_RID"`
 
 	NodeTagID string `env:"KATAPULT_NODE_TAG_RID"`
+
+	// ExtraDataCenters maps the RIDs of any other data centers the cluster
+	// spans to the tag applied to the nodes in that data center.
+	ExtraDataCenters map[string]string `env:"KATAPULT_EXTRA_DATA_CENTERS"`
+
+	// DeletionPolicy is the default policy for load balancers when their
+	// service is deleted. This can be overridden per service by annotation.
+	DeletionPolicy deletionPolicy `env:"KATAPULT_LOAD_BALANCER_DELETION_POLICY,default=delete"`
+
+	// LoadBalancerClass is not supported, and is only read so that setting it
+	// is reported rather than silently ignored. The service controller from
+	// k8s.io/cloud-provider v0.21.0 never passes services with a
+	// spec.loadBalancerClass to the provider, so no class can select it.
+	LoadBalancerClass string `env:"KATAPULT_LOAD_BALANCER_CLASS"`
+
+	// ClusterName is the name of the KCE cluster. When set, it must match the
+	// --cluster-name the controller manager is started with.
+	ClusterName string `env:"KATAPULT_CLUSTER_NAME"`
+
+	// ControlPlaneTagID is the tag applied to the cluster's control plane
+	// nodes. It is used to report the cluster's master address.
+	ControlPlaneTagID string `env:"KATAPULT_CONTROL_PLANE_TAG_RID"`
+
+	// InternalNetworkID is the network whose addresses are reported as node
+	// internal IPs. All other addresses are reported as external IPs. When not
+	// set, private addresses are reported as internal IPs instead.
+	InternalNetworkID string `env:"KATAPULT_INTERNAL_NETWORK_RID"`
+
+	// NodeLabels enables labelling nodes with metadata from their VM, which
+	// is refreshed every NodeLabelsInterval.
+	NodeLabels         bool          `env:"KATAPULT_NODE_LABELS"`
+	NodeLabelsInterval time.Duration `env:"KATAPULT_NODE_LABELS_INTERVAL,default=5m"`
+
+	// LogFormat is either "text" for klog formatted logs, or "json" for
+	// structured logs.
+	LogFormat logFormat `env:"KATAPULT_LOG_FORMAT,default=text"`
+
+	// DryRun stops any changes being made to Katapult load balancers. The
+	// changes that would have been made are logged, counted and raised as
+	// events instead.
+	DryRun bool `env:"KATAPULT_DRY_RUN"`
+
+	// RuleConcurrency is how many of a load balancer's rules are created,
+	// updated or deleted at once.
+	RuleConcurrency int `env:"KATAPULT_LOAD_BALANCER_RULE_CONCURRENCY,default=4"`
+
+	// TracingEndpoint is the base URL of an OTLP/HTTP collector, such as
+	// http://otel-collector:4318. Spans are exported to it when set.
+	TracingEndpoint string `env:"KATAPULT_TRACING_ENDPOINT"`
+
+	// TracingStdout enables writing spans to stdout as JSON, for debugging.
+	TracingStdout bool `env:"KATAPULT_TRACING_STDOUT"`
 }
 
 func (c Config) orgRef() core.OrganizationRef {
@@ -59,24 +118,45 @@ func loadConfig(lookuper envconfig.Lookuper) (*Config, error) {
 		return nil, fmt.Errorf("node tag id is not set")
 	}
 
-	return &c, nil
-}
+	for id, nodeTagID := range c.ExtraDataCenters {
+		if id == c.DataCenterID {
+			return nil, fmt.Errorf("data center %s is configured more than once", id)
+		}
+		if nodeTagID == "" {
+			return nil, fmt.Errorf("node tag id is not set for data center %s", id)
+		}
+	}
 
-// providerFactory creates any dependencies needed by the provider and passes
-// them into New. For now, we will source config from the environment, but we
-// k8s CCM provides us with an io.Reader which can be used to read a config
-// file.
-func providerFactory(_ io.Reader) (cloudprovider.Interface, error) {
-	log := klogr.NewWithOptions(klogr.WithFormat(klogr.FormatKlog))
-	c, err := loadConfig(envconfig.OsLookuper())
-	if err != nil {
-		return nil, err
+	if c.LoadBalancerClass != "" {
+		return nil, fmt.Errorf("load balancer class is not supported, as the service controller ignores every service with a load balancer class")
+	}
+
+	if _, err := parseDeletionPolicy(string(c.DeletionPolicy)); err != nil {
+		return nil, fmt.Errorf("invalid load balancer deletion policy: %w", err)
 	}
 
+	if _, err := parseLogFormat(string(c.LogFormat)); err != nil {
+		return nil, fmt.Errorf("invalid log format: %w", err)
+	}
+
+	if c.RuleConcurrency < 1 {
+		return nil, fmt.Errorf("load balancer rule concurrency must be positive")
+	}
+
+	if c.NodeLabels && c.NodeLabelsInterval <= 0 {
+		return nil, fmt.Errorf("node labels interval must be positive")
+	}
+
+	return &c, nil
+}
+
+// newKatapultClient creates a Katapult API client for the configured API host.
+func newKatapultClient(c Config, log logr.Logger) (*core.Client, error) {
 	apiUrl := katapult.DefaultURL
 	if c.APIHost != "" {
 		log.Info("default API base URL overrided",
 			"url", c.APIHost)
+		var err error
 		apiUrl, err = url.Parse(c.APIHost)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse provided api url: %w", err)
@@ -91,17 +171,75 @@ func providerFactory(_ io.Reader) (cloudprovider.Interface, error) {
 	if err != nil {
 		return nil, err
 	}
-	client := core.New(rm)
+
+	return core.New(rm), nil
+}
+
+// newLoadBalancerManager creates a load balancer manager using a Katapult
+// client. This is shared by the provider and the command line tools, so that
+// both act on load balancers in exactly the same way.
+func newLoadBalancerManager(c Config, client *core.Client, log logr.Logger) *loadBalancerManager {
+	return &loadBalancerManager{
+		log:                           log,
+		config:                        c,
+		loadBalancerController:        tracedLoadBalancerController{next: client.LoadBalancers},
+		loadBalancerRuleController:    tracedLoadBalancerRuleController{next: client.LoadBalancerRules},
+		virtualMachineController:      tracedVirtualMachineController{next: client.VirtualMachines},
+		virtualMachineGroupController: tracedVirtualMachineGroupController{next: client.VirtualMachineGroups},
+	}
+}
+
+// providerFactory creates any dependencies needed by the provider and passes
+// them into New. For now, we will source config from the environment, but we
+// k8s CCM provides us with an io.Reader which can be used to read a config
+// file.
+func providerFactory(_ io.Reader) (cloudprovider.Interface, error) {
+	c, err := loadConfig(envconfig.OsLookuper())
+	if err != nil {
+		return nil, err
+	}
+	log := newLogger(c.LogFormat)
+
+	client, err := newKatapultClient(*c, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var exporters []sdktrace.SpanExporter
+	if c.TracingEndpoint != "" {
+		log.Info("exporting traces",
+			"url", c.TracingEndpoint)
+		exporters = append(exporters, newOTLPExporter(c.TracingEndpoint))
+	}
+	if c.TracingStdout {
+		log.Info("writing traces to stdout")
+		exporters = append(exporters, newSpanWriter(os.Stdout))
+	}
+
+	var tp *sdktrace.TracerProvider
+	if len(exporters) > 0 {
+		tp = newTracerProvider(exporters...)
+		otel.SetTracerProvider(tp)
+	}
+
+	vmc := tracedVirtualMachineController{next: client.VirtualMachines}
 
 	return &provider{
-		log:      log,
-		katapult: client,
-		config:   *c,
-		loadBalancer: &loadBalancerManager{
-			log:                        log,
-			config:                     *c,
-			loadBalancerController:     client.LoadBalancers,
-			loadBalancerRuleController: client.LoadBalancerRules,
+		log:            log,
+		katapult:       client,
+		config:         *c,
+		tracerProvider: tp,
+		loadBalancer:   newLoadBalancerManager(*c, client, log),
+		clusters: &clusterManager{
+			log:                      log,
+			config:                   *c,
+			virtualMachineController: vmc,
+		},
+		instances: &instancesManager{
+			log:                                      log,
+			config:                                   *c,
+			virtualMachineController:                 vmc,
+			virtualMachineNetworkInterfaceController: tracedVirtualMachineNetworkInterfaceController{next: client.VirtualMachineNetworkInterfaces},
 		},
 	}, nil
 }
@@ -111,12 +249,51 @@ type provider struct {
 	katapult     *core.Client
 	config       Config
 	loadBalancer *loadBalancerManager
+	clusters     *clusterManager
+	instances    *instancesManager
+
+	// tracerProvider is set when traces are being exported, so that any
+	// buffered spans can be flushed on shutdown.
+	tracerProvider *sdktrace.TracerProvider
 }
 
+// Initialize sets up an event recorder so that the provider can report
+// changes it makes against the relevant kubernetes objects, and starts the
+// node label controller if enabled.
 func (p *provider) Initialize(
 	clientBuilder cloudprovider.ControllerClientBuilder,
 	stop <-chan struct{}) {
-	// TODO: Assess if we actually need anything here
+	client := clientBuilder.ClientOrDie(eventComponent)
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: client.CoreV1().Events(""),
+	})
+	p.loadBalancer.recorder = broadcaster.NewRecorder(
+		scheme.Scheme,
+		v1.EventSource{Component: eventComponent},
+	)
+	p.loadBalancer.kube = client
+
+	go func() {
+		<-stop
+		broadcaster.Shutdown()
+		if p.tracerProvider != nil {
+			if err := p.tracerProvider.Shutdown(context.Background()); err != nil {
+				p.log.Error(err, "failed to flush traces")
+			}
+		}
+	}()
+
+	if p.config.NodeLabels {
+		nlc := &nodeLabelController{
+			log:       p.log,
+			client:    client,
+			instances: p.instances,
+			interval:  p.config.NodeLabelsInterval,
+		}
+		go nlc.Run(stop)
+	}
 }
 
 // LoadBalancer returns our implementation of the loadBalancerManager provider
@@ -129,7 +306,7 @@ func (p *provider) Instances() (cloudprovider.Instances, bool) {
 }
 
 func (p *provider) InstancesV2() (cloudprovider.InstancesV2, bool) {
-	return nil, false
+	return p.instances, true
 }
 
 func (p *provider) Zones() (cloudprovider.Zones, bool) {
@@ -137,9 +314,14 @@ func (p *provider) Zones() (cloudprovider.Zones, bool) {
 }
 
 func (p *provider) Clusters() (cloudprovider.Clusters, bool) {
-	return nil, false
+	return p.clusters, true
 }
 
+// Routes is not implemented, and will not be until Katapult can route
+// traffic. Neither the Katapult API nor the go-katapult client (v0.1.0) has
+// any way to manage routes on a virtual network, so there is nothing that
+// ListRoutes, CreateRoute or DeleteRoute could be built on. Pod CIDRs cannot
+// be routed to nodes and clusters must use an overlay CNI.
 func (p *provider) Routes() (cloudprovider.Routes, bool) {
 	return nil, false
 }
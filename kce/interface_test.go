@@ -4,7 +4,11 @@ import (
 	"github.com/krystal/go-katapult/core"
 	"github.com/sethvargo/go-envconfig"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	cloudprovider "k8s.io/cloud-provider"
 	"testing"
+	"time"
 )
 
 func TestConfig_orgRef(t *testing.T) {
@@ -33,20 +37,157 @@ func Test_loadConfig(t *testing.T) {
 		{
 			name: "success",
 			lookuper: envconfig.MapLookuper(map[string]string{
-				"KATAPULT_API_TOKEN":        "atoken",
-				"KATAPULT_API_HOST":         "api.katapult.org",
-				"KATAPULT_ORGANIZATION_RID": "fake-org",
-				"KATAPULT_DATA_CENTER_RID":  "atlantis",
-				"KATAPULT_NODE_TAG_RID":     "example-tag",
+				"KATAPULT_API_TOKEN":             "atoken",
+				"KATAPULT_API_HOST":              "api.katapult.org",
+				"KATAPULT_ORGANIZATION_RID":      "fake-org",
+				"KATAPULT_DATA_CENTER_RID":       "atlantis",
+				"KATAPULT_NODE_TAG_RID":          "example-tag",
+				"KATAPULT_CLUSTER_NAME":          "kce-atlantis",
+				"KATAPULT_CONTROL_PLANE_TAG_RID": "control-plane-tag",
+				"KATAPULT_NODE_LABELS":           "true",
+				"KATAPULT_LOG_FORMAT":            "json",
+				"KATAPULT_TRACING_ENDPOINT":      "http://otel-collector:4318",
+				"KATAPULT_TRACING_STDOUT":        "true",
+			}),
+			want: &Config{
+				APIHost:            "api.katapult.org",
+				APIKey:             "atoken",
+				OrganizationID:     "fake-org",
+				DataCenterID:       "atlantis",
+				NodeTagID:          "example-tag",
+				DeletionPolicy:     deletionPolicyDelete,
+				ClusterName:        "kce-atlantis",
+				ControlPlaneTagID:  "control-plane-tag",
+				NodeLabels:         true,
+				NodeLabelsInterval: 5 * time.Minute,
+				RuleConcurrency:    4,
+				LogFormat:          logFormatJSON,
+				TracingEndpoint:    "http://otel-collector:4318",
+				TracingStdout:      true,
+			},
+		},
+		{
+			name: "retain deletion policy",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":                     "atoken",
+				"KATAPULT_ORGANIZATION_RID":              "fake-org",
+				"KATAPULT_DATA_CENTER_RID":               "atlantis",
+				"KATAPULT_NODE_TAG_RID":                  "example-tag",
+				"KATAPULT_LOAD_BALANCER_DELETION_POLICY": "retain",
+			}),
+			want: &Config{
+				APIKey:             "atoken",
+				OrganizationID:     "fake-org",
+				DataCenterID:       "atlantis",
+				NodeTagID:          "example-tag",
+				DeletionPolicy:     deletionPolicyRetain,
+				NodeLabelsInterval: 5 * time.Minute,
+				RuleConcurrency:    4,
+				LogFormat:          logFormatText,
+			},
+		},
+		{
+			name: "invalid deletion policy causes error",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":                     "atoken",
+				"KATAPULT_ORGANIZATION_RID":              "fake-org",
+				"KATAPULT_DATA_CENTER_RID":               "atlantis",
+				"KATAPULT_NODE_TAG_RID":                  "example-tag",
+				"KATAPULT_LOAD_BALANCER_DELETION_POLICY": "shred",
+			}),
+			wantErr: `invalid load balancer deletion policy: must be "delete" or "retain"`,
+		},
+		{
+			name: "load balancer class causes error",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":           "atoken",
+				"KATAPULT_ORGANIZATION_RID":    "fake-org",
+				"KATAPULT_DATA_CENTER_RID":     "atlantis",
+				"KATAPULT_NODE_TAG_RID":        "example-tag",
+				"KATAPULT_LOAD_BALANCER_CLASS": "kce.krystal.uk/lb",
+			}),
+			wantErr: "load balancer class is not supported, as the service controller ignores every service with a load balancer class",
+		},
+		{
+			name: "extra data centers",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":          "atoken",
+				"KATAPULT_ORGANIZATION_RID":   "fake-org",
+				"KATAPULT_DATA_CENTER_RID":    "atlantis",
+				"KATAPULT_NODE_TAG_RID":       "example-tag",
+				"KATAPULT_EXTRA_DATA_CENTERS": "lemuria:lemuria-tag,mu:mu-tag",
 			}),
 			want: &Config{
-				APIHost:        "api.katapult.org",
 				APIKey:         "atoken",
 				OrganizationID: "fake-org",
 				DataCenterID:   "atlantis",
 				NodeTagID:      "example-tag",
+				ExtraDataCenters: map[string]string{
+					"lemuria": "lemuria-tag",
+					"mu":      "mu-tag",
+				},
+				DeletionPolicy:     deletionPolicyDelete,
+				NodeLabelsInterval: 5 * time.Minute,
+				RuleConcurrency:    4,
+				LogFormat:          logFormatText,
 			},
 		},
+		{
+			name: "extra data center repeating primary causes error",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":          "atoken",
+				"KATAPULT_ORGANIZATION_RID":   "fake-org",
+				"KATAPULT_DATA_CENTER_RID":    "atlantis",
+				"KATAPULT_NODE_TAG_RID":       "example-tag",
+				"KATAPULT_EXTRA_DATA_CENTERS": "atlantis:other-tag",
+			}),
+			wantErr: "data center atlantis is configured more than once",
+		},
+		{
+			name: "extra data center without node tag causes error",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":          "atoken",
+				"KATAPULT_ORGANIZATION_RID":   "fake-org",
+				"KATAPULT_DATA_CENTER_RID":    "atlantis",
+				"KATAPULT_NODE_TAG_RID":       "example-tag",
+				"KATAPULT_EXTRA_DATA_CENTERS": "lemuria:",
+			}),
+			wantErr: "node tag id is not set for data center lemuria",
+		},
+		{
+			name: "invalid log format causes error",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":        "atoken",
+				"KATAPULT_ORGANIZATION_RID": "fake-org",
+				"KATAPULT_DATA_CENTER_RID":  "atlantis",
+				"KATAPULT_NODE_TAG_RID":     "example-tag",
+				"KATAPULT_LOG_FORMAT":       "xml",
+			}),
+			wantErr: `invalid log format: must be "text" or "json"`,
+		},
+		{
+			name: "invalid node labels interval causes error",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":            "atoken",
+				"KATAPULT_ORGANIZATION_RID":     "fake-org",
+				"KATAPULT_DATA_CENTER_RID":      "atlantis",
+				"KATAPULT_NODE_TAG_RID":         "example-tag",
+				"KATAPULT_NODE_LABELS":          "true",
+				"KATAPULT_NODE_LABELS_INTERVAL": "0s",
+			}),
+			wantErr: "node labels interval must be positive",
+		},
+		{
+			name: "invalid rule concurrency causes error",
+			lookuper: envconfig.MapLookuper(map[string]string{
+				"KATAPULT_API_TOKEN":                      "atoken",
+				"KATAPULT_ORGANIZATION_RID":               "fake-org",
+				"KATAPULT_DATA_CENTER_RID":                "atlantis",
+				"KATAPULT_NODE_TAG_RID":                   "example-tag",
+				"KATAPULT_LOAD_BALANCER_RULE_CONCURRENCY": "0",
+			}),
+			wantErr: "load balancer rule concurrency must be positive",
+		},
 		{
 			name:     "underlying err propagates",
 			lookuper: nil,
@@ -104,6 +245,24 @@ func Test_loadConfig(t *testing.T) {
 	}
 }
 
+type fakeClientBuilder struct {
+	cloudprovider.ControllerClientBuilder
+	client *fake.Clientset
+}
+
+func (b fakeClientBuilder) ClientOrDie(_ string) kubernetes.Interface {
+	return b.client
+}
+
+func TestProvider_Initialize(t *testing.T) {
+	p := &provider{loadBalancer: &loadBalancerManager{}}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	p.Initialize(fakeClientBuilder{client: fake.NewSimpleClientset()}, stop)
+	assert.NotNil(t, p.loadBalancer.recorder)
+}
+
 func TestProvider_LoadBalancer(t *testing.T) {
 	lbm := &loadBalancerManager{}
 	p := &provider{loadBalancer: lbm}
@@ -122,11 +281,12 @@ func TestProvider_Instances(t *testing.T) {
 }
 
 func TestProvider_InstancesV2(t *testing.T) {
-	p := &provider{}
+	im := &instancesManager{}
+	p := &provider{instances: im}
 
-	instances, isSupported := p.InstancesV2()
-	assert.Nil(t, instances)
-	assert.False(t, isSupported)
+	gotIm, isSupported := p.InstancesV2()
+	assert.Equal(t, im, gotIm)
+	assert.True(t, isSupported)
 }
 
 func TestProvider_Zones(t *testing.T) {
@@ -138,11 +298,12 @@ func TestProvider_Zones(t *testing.T) {
 }
 
 func TestProvider_Clusters(t *testing.T) {
-	p := &provider{}
+	cm := &clusterManager{}
+	p := &provider{clusters: cm}
 
-	clusters, isSupported := p.Clusters()
-	assert.Nil(t, clusters)
-	assert.False(t, isSupported)
+	gotCm, isSupported := p.Clusters()
+	assert.Equal(t, cm, gotCm)
+	assert.True(t, isSupported)
 }
 
 func TestProvider_Routes(t *testing.T) {
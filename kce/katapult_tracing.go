@@ -0,0 +1,132 @@
+package kce
+
+import (
+	"context"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The traced controllers wrap the Katapult clients so that every API request
+// gets a child span of the cloudprovider method that made it.
+
+func startKatapultSpan(ctx context.Context, name string, opts *core.ListOptions) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{}
+	if opts != nil && opts.Page != 0 {
+		attrs = append(attrs, attributeKatapultPage.Int(opts.Page))
+	}
+
+	return startSpan(ctx, "katapult."+name, trace.SpanKindClient, attrs...)
+}
+
+type tracedLoadBalancerController struct {
+	next loadBalancerController
+}
+
+func (c tracedLoadBalancerController) Get(ctx context.Context, lb core.LoadBalancerRef) (*core.LoadBalancer, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancers.Get", nil)
+	got, resp, err := c.next.Get(ctx, lb)
+	endKatapultSpan(span, resp, err)
+	return got, resp, err
+}
+
+func (c tracedLoadBalancerController) List(ctx context.Context, org core.OrganizationRef, opts *core.ListOptions) ([]*core.LoadBalancer, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancers.List", opts)
+	list, resp, err := c.next.List(ctx, org, opts)
+	endKatapultSpan(span, resp, err)
+	return list, resp, err
+}
+
+func (c tracedLoadBalancerController) Delete(ctx context.Context, lb core.LoadBalancerRef) (*core.LoadBalancer, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancers.Delete", nil)
+	deleted, resp, err := c.next.Delete(ctx, lb)
+	endKatapultSpan(span, resp, err)
+	return deleted, resp, err
+}
+
+func (c tracedLoadBalancerController) Update(ctx context.Context, lb core.LoadBalancerRef, args *core.LoadBalancerUpdateArguments) (*core.LoadBalancer, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancers.Update", nil)
+	updated, resp, err := c.next.Update(ctx, lb, args)
+	endKatapultSpan(span, resp, err)
+	return updated, resp, err
+}
+
+func (c tracedLoadBalancerController) Create(ctx context.Context, org core.OrganizationRef, args *core.LoadBalancerCreateArguments) (*core.LoadBalancer, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancers.Create", nil)
+	created, resp, err := c.next.Create(ctx, org, args)
+	endKatapultSpan(span, resp, err)
+	return created, resp, err
+}
+
+type tracedLoadBalancerRuleController struct {
+	next loadBalancerRuleController
+}
+
+func (c tracedLoadBalancerRuleController) List(ctx context.Context, lb core.LoadBalancerRef, opts *core.ListOptions) ([]core.LoadBalancerRule, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancerRules.List", opts)
+	list, resp, err := c.next.List(ctx, lb, opts)
+	endKatapultSpan(span, resp, err)
+	return list, resp, err
+}
+
+func (c tracedLoadBalancerRuleController) Delete(ctx context.Context, lbr core.LoadBalancerRuleRef) (*core.LoadBalancerRule, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancerRules.Delete", nil)
+	deleted, resp, err := c.next.Delete(ctx, lbr)
+	endKatapultSpan(span, resp, err)
+	return deleted, resp, err
+}
+
+func (c tracedLoadBalancerRuleController) Update(ctx context.Context, rule core.LoadBalancerRuleRef, args core.LoadBalancerRuleArguments) (*core.LoadBalancerRule, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancerRules.Update", nil)
+	updated, resp, err := c.next.Update(ctx, rule, args)
+	endKatapultSpan(span, resp, err)
+	return updated, resp, err
+}
+
+func (c tracedLoadBalancerRuleController) Create(ctx context.Context, lb core.LoadBalancerRef, args core.LoadBalancerRuleArguments) (*core.LoadBalancerRule, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "LoadBalancerRules.Create", nil)
+	created, resp, err := c.next.Create(ctx, lb, args)
+	endKatapultSpan(span, resp, err)
+	return created, resp, err
+}
+
+type tracedVirtualMachineController struct {
+	next virtualMachineController
+}
+
+func (c tracedVirtualMachineController) Get(ctx context.Context, ref core.VirtualMachineRef) (*core.VirtualMachine, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "VirtualMachines.Get", nil)
+	vm, resp, err := c.next.Get(ctx, ref)
+	endKatapultSpan(span, resp, err)
+	return vm, resp, err
+}
+
+func (c tracedVirtualMachineController) List(ctx context.Context, org core.OrganizationRef, opts *core.ListOptions) ([]*core.VirtualMachine, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "VirtualMachines.List", opts)
+	list, resp, err := c.next.List(ctx, org, opts)
+	endKatapultSpan(span, resp, err)
+	return list, resp, err
+}
+
+type tracedVirtualMachineGroupController struct {
+	next virtualMachineGroupController
+}
+
+func (c tracedVirtualMachineGroupController) List(ctx context.Context, org core.OrganizationRef) ([]*core.VirtualMachineGroup, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "VirtualMachineGroups.List", nil)
+	list, resp, err := c.next.List(ctx, org)
+	endKatapultSpan(span, resp, err)
+	return list, resp, err
+}
+
+type tracedVirtualMachineNetworkInterfaceController struct {
+	next virtualMachineNetworkInterfaceController
+}
+
+func (c tracedVirtualMachineNetworkInterfaceController) List(ctx context.Context, vm core.VirtualMachineRef, opts *core.ListOptions) ([]*core.VirtualMachineNetworkInterface, *katapult.Response, error) {
+	ctx, span := startKatapultSpan(ctx, "VirtualMachineNetworkInterfaces.List", opts)
+	list, resp, err := c.next.List(ctx, vm, opts)
+	endKatapultSpan(span, resp, err)
+	return list, resp, err
+}
@@ -0,0 +1,428 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	"github.com/krystal/go-katapult/core"
+	"github.com/sethvargo/go-envconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	servicehelper "k8s.io/cloud-provider/service/helpers"
+	"strings"
+)
+
+// LoadBalancerRuleInfo describes a rule on a load balancer.
+type LoadBalancerRuleInfo struct {
+	ID              string `json:"id"`
+	Protocol        string `json:"protocol"`
+	ListenPort      int    `json:"listenPort"`
+	DestinationPort int    `json:"destinationPort"`
+}
+
+// LoadBalancerInfo describes a load balancer, its rules and the service that
+// uses it, if any.
+type LoadBalancerInfo struct {
+	ID           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	IP           string                 `json:"ip,omitempty"`
+	ResourceType string                 `json:"resourceType"`
+	ResourceIDs  []string               `json:"resourceIds"`
+	Service      string                 `json:"service,omitempty"`
+	Rules        []LoadBalancerRuleInfo `json:"rules"`
+}
+
+// describeLoadBalancer fetches the rules of a load balancer, and describes it
+// along with the service that uses it.
+func (lbm *loadBalancerManager) describeLoadBalancer(ctx context.Context, lb *core.LoadBalancer, service *v1.Service) (LoadBalancerInfo, error) {
+	info := LoadBalancerInfo{
+		ID:           lb.ID,
+		Name:         lb.Name,
+		ResourceType: string(lb.ResourceType),
+		ResourceIDs:  lb.ResourceIDs,
+		Rules:        []LoadBalancerRuleInfo{},
+	}
+	if lb.IPAddress != nil {
+		info.IP = lb.IPAddress.Address
+	}
+	if service != nil {
+		info.Service = serviceKey(service)
+	}
+
+	rules, err := lbm.listLoadBalancerRules(ctx, lb.Ref())
+	if err != nil {
+		return info, fmt.Errorf("failed to list rules of %s: %w", lb.ID, err)
+	}
+	for _, rule := range rules {
+		info.Rules = append(info.Rules, LoadBalancerRuleInfo{
+			ID:              rule.ID,
+			Protocol:        string(rule.Protocol),
+			ListenPort:      rule.ListenPort,
+			DestinationPort: rule.DestinationPort,
+		})
+	}
+
+	return info, nil
+}
+
+func serviceKey(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
+
+// clusterLoadBalancerPrefix is the prefix of the name of every load balancer
+// created for a cluster.
+func clusterLoadBalancerPrefix(clusterName string) string {
+	return fmt.Sprintf("kce-%s-", clusterName)
+}
+
+// ownedLoadBalancer is a load balancer that belongs to the cluster.
+type ownedLoadBalancer struct {
+	lb *core.LoadBalancer
+	// service uses the load balancer, and is nil if it has been orphaned.
+	service *v1.Service
+}
+
+// ownedLoadBalancers returns the load balancers that belong to the cluster.
+// These are the load balancers its services use, including any they have
+// adopted, and those named for it that target its nodes. The name alone is not
+// enough, as the names of another cluster whose name starts with this one's,
+// such as prod-eu for prod, share the prefix.
+func (lbm *loadBalancerManager) ownedLoadBalancers(ctx context.Context, clusterName string, services []v1.Service) ([]ownedLoadBalancer, error) {
+	lbs, err := lbm.listLoadBalancers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := clusterLoadBalancerPrefix(clusterName)
+	owned := []ownedLoadBalancer{}
+	for _, lb := range lbs {
+		var user *v1.Service
+		for i := range services {
+			if lbm.usesLoadBalancer(clusterName, &services[i], lb) {
+				user = &services[i]
+				break
+			}
+		}
+
+		if user == nil && (!strings.HasPrefix(lb.Name, prefix) || !lbm.targetsClusterNodes(lb)) {
+			continue
+		}
+		owned = append(owned, ownedLoadBalancer{lb: lb, service: user})
+	}
+
+	return owned, nil
+}
+
+// targetsClusterNodes returns true if a load balancer directs traffic to the
+// nodes of one of the cluster's data centers.
+func (lbm *loadBalancerManager) targetsClusterNodes(lb *core.LoadBalancer) bool {
+	for _, dc := range lbm.config.dataCenters() {
+		for _, id := range lb.ResourceIDs {
+			if id == dc.nodeTagID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// usesLoadBalancer returns true if a service would use a load balancer were
+// it reconciled now. A service that has released its load balancer, by
+// changing to another type with the retain policy, still uses it as it will
+// pick it up again if changed back. When a service's annotations are invalid
+// we err on the side of it using any load balancer it might refer to.
+func (lbm *loadBalancerManager) usesLoadBalancer(clusterName string, service *v1.Service, lb *core.LoadBalancer) bool {
+	if !lbm.handlesService(service) {
+		return false
+	}
+
+	adoptedID := strings.TrimSpace(service.Annotations[annotationLoadBalancerID])
+	opts, err := parseLoadBalancerOptions(service, lbm.config)
+	if err == nil {
+		adoptedID = opts.loadBalancerID
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer && opts.deletionPolicy != deletionPolicyRetain {
+			return false
+		}
+	}
+
+	if adoptedID != "" {
+		return lb.ID == adoptedID
+	}
+	for _, dc := range lbm.config.dataCenters() {
+		name := lbm.loadBalancerName(clusterName, service, dc)
+		if lb.Name == name || lb.Name == releasedLoadBalancerName(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadBalancerTool performs the controller's load balancer operations on
+// demand, so that they can be inspected and repaired from the command line.
+type LoadBalancerTool struct {
+	lbm         *loadBalancerManager
+	kube        kubernetes.Interface
+	clusterName string
+	broadcaster record.EventBroadcaster
+}
+
+// NewLoadBalancerTool creates a LoadBalancerTool from the same environment
+// as the provider. If clusterName is empty, the configured cluster name is
+// used. Close should be called once finished with it so that any events are
+// flushed.
+func NewLoadBalancerTool(kube kubernetes.Interface, clusterName string) (*LoadBalancerTool, error) {
+	return newLoadBalancerTool(envconfig.OsLookuper(), kube, clusterName)
+}
+
+func newLoadBalancerTool(lookuper envconfig.Lookuper, kube kubernetes.Interface, clusterName string) (*LoadBalancerTool, error) {
+	c, err := loadConfig(lookuper)
+	if err != nil {
+		return nil, err
+	}
+	if clusterName == "" {
+		clusterName = c.ClusterName
+	}
+	if clusterName == "" {
+		clusterName = defaultClusterName
+	}
+	log := newLogger(c.LogFormat)
+
+	client, err := newKatapultClient(*c, log)
+	if err != nil {
+		return nil, err
+	}
+	lbm := newLoadBalancerManager(*c, client, log)
+	if err := lbm.checkClusterName(clusterName); err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: kube.CoreV1().Events(""),
+	})
+	lbm.recorder = broadcaster.NewRecorder(
+		scheme.Scheme,
+		v1.EventSource{Component: eventComponent},
+	)
+	lbm.kube = kube
+
+	return &LoadBalancerTool{
+		lbm:         lbm,
+		kube:        kube,
+		clusterName: clusterName,
+		broadcaster: broadcaster,
+	}, nil
+}
+
+// ClusterName returns the name of the cluster the tool acts on.
+func (t *LoadBalancerTool) ClusterName() string {
+	return t.clusterName
+}
+
+// Close stops recording events.
+func (t *LoadBalancerTool) Close() {
+	t.broadcaster.Shutdown()
+}
+
+func (t *LoadBalancerTool) listOwned(ctx context.Context) ([]ownedLoadBalancer, error) {
+	services, err := t.kube.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return t.lbm.ownedLoadBalancers(ctx, t.clusterName, services.Items)
+}
+
+// List describes every load balancer that belongs to the cluster.
+func (t *LoadBalancerTool) List(ctx context.Context) ([]LoadBalancerInfo, error) {
+	owned, err := t.listOwned(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []LoadBalancerInfo{}
+	for _, o := range owned {
+		info, err := t.lbm.describeLoadBalancer(ctx, o.lb, o.service)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Show describes the load balancers of a service, in each data center it has
+// one in.
+func (t *LoadBalancerTool) Show(ctx context.Context, namespace, name string) ([]LoadBalancerInfo, error) {
+	service, err := t.kube.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return t.serviceLoadBalancers(ctx, service)
+}
+
+func (t *LoadBalancerTool) serviceLoadBalancers(ctx context.Context, service *v1.Service) ([]LoadBalancerInfo, error) {
+	opts, err := parseLoadBalancerOptions(service, t.lbm.config)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []LoadBalancerInfo{}
+	for _, dc := range t.lbm.config.dataCenters() {
+		lb, err := t.lbm.findLoadBalancer(ctx, t.clusterName, service, opts, dc)
+		if err == lbNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := t.lbm.describeLoadBalancer(ctx, lb, service)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Resync reconciles the load balancers of a service as the service
+// controller would, and updates the service's status to match.
+func (t *LoadBalancerTool) Resync(ctx context.Context, namespace, name string) (*v1.LoadBalancerStatus, error) {
+	service, err := t.kube.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil, fmt.Errorf("service %s is of type %s, not %s",
+			serviceKey(service), service.Spec.Type, v1.ServiceTypeLoadBalancer)
+	}
+	if !t.lbm.handlesService(service) {
+		return nil, fmt.Errorf("service %s has a load balancer class that is not handled by kce-ccm", serviceKey(service))
+	}
+
+	nodeList, err := t.kube.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	nodes := []*v1.Node{}
+	for i := range nodeList.Items {
+		if loadBalancerNode(&nodeList.Items[i]) {
+			nodes = append(nodes, &nodeList.Items[i])
+		}
+	}
+
+	status, err := t.lbm.EnsureLoadBalancer(ctx, t.clusterName, service, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	if !servicehelper.LoadBalancerStatusEqual(&service.Status.LoadBalancer, status) {
+		updated := service.DeepCopy()
+		updated.Status.LoadBalancer = *status
+		if _, err := servicehelper.PatchService(t.kube.CoreV1(), service, updated); err != nil {
+			return nil, fmt.Errorf("failed to update status: %w", err)
+		}
+	}
+
+	return status, nil
+}
+
+// loadBalancerNode returns true if the service controller would pass a node
+// to the provider when reconciling load balancers.
+func loadBalancerNode(node *v1.Node) bool {
+	if _, ok := node.Labels[v1.LabelNodeExcludeBalancers]; ok {
+		return false
+	}
+	if len(node.Status.Conditions) == 0 {
+		return false
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady && cond.Status != v1.ConditionTrue {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Release sets the retain deletion policy on a service, so that its load
+// balancers are released rather than deleted when the service is deleted or
+// changes type. It returns the load balancers that will be released.
+func (t *LoadBalancerTool) Release(ctx context.Context, namespace, name string) ([]LoadBalancerInfo, error) {
+	service, err := t.kube.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if service.Annotations[annotationLoadBalancerDeletionPolicy] != string(deletionPolicyRetain) {
+		service = service.DeepCopy()
+		if service.Annotations == nil {
+			service.Annotations = map[string]string{}
+		}
+		service.Annotations[annotationLoadBalancerDeletionPolicy] = string(deletionPolicyRetain)
+
+		service, err = t.kube.CoreV1().Services(namespace).Update(ctx, service, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	infos, err := t.serviceLoadBalancers(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		t.lbm.event(service, v1.EventTypeNormal, eventReasonReleased,
+			"Load balancer %s will be released rather than deleted", info.ID,
+		)
+	}
+
+	return infos, nil
+}
+
+// GC deletes the load balancers owned by the cluster that no service uses,
+// such as those left behind by a service deleted during a dry run. Load
+// balancers released by their service are renamed with a released- prefix and
+// adopted load balancers keep their own name, so neither is ever deleted.
+// With dryRun, the load balancers are only returned.
+func (t *LoadBalancerTool) GC(ctx context.Context, dryRun bool) ([]LoadBalancerInfo, error) {
+	owned, err := t.listOwned(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []LoadBalancerInfo{}
+	errs := []error{}
+	for _, o := range owned {
+		if o.service != nil {
+			continue
+		}
+
+		info, err := t.lbm.describeLoadBalancer(ctx, o.lb, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if !dryRun {
+			err := t.lbm.deleteLoadBalancer(ctx, nil, o.lb)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, utilerrors.NewAggregate(errs)
+}
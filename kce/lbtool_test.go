@@ -0,0 +1,221 @@
+package kce
+
+import (
+	"context"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func readyNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			},
+		},
+	}
+}
+
+func infoNames(infos []LoadBalancerInfo) map[string]string {
+	names := map[string]string{}
+	for _, info := range infos {
+		names[info.Name] = info.Service
+	}
+
+	return names
+}
+
+func TestLoadBalancerTool(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	lookuper := newDoctorLookuper(t, s)
+	ctx := context.Background()
+
+	web := doctorService("web", 80)
+	released := doctorService("released", 80)
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", released, nil)
+	require.NoError(t, err)
+	released.Spec.Type = v1.ServiceTypeClusterIP
+	released.Annotations = map[string]string{
+		annotationLoadBalancerDeletionPolicy: "retain",
+	}
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", doctorService("deleted", 80), nil)
+	require.NoError(t, err)
+	// A service deleted with the retain policy releases its load balancer,
+	// which must never be garbage collected.
+	gone := doctorService("gone", 80)
+	gone.Annotations = map[string]string{
+		annotationLoadBalancerDeletionPolicy: "retain",
+	}
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", gone, nil)
+	require.NoError(t, err)
+	require.NoError(t, lbm.EnsureLoadBalancerDeleted(ctx, "kce", gone))
+
+	adopted, _, err := lbm.loadBalancerController.Create(ctx, lbm.config.orgRef(), &core.LoadBalancerCreateArguments{
+		Name:       "legacy",
+		DataCenter: lbm.config.dcRef(),
+	})
+	require.NoError(t, err)
+	// The adopting service has not been reconciled yet, so the load balancer
+	// keeps its original name.
+	adopter := doctorService("adopter")
+	adopter.Annotations = map[string]string{
+		annotationLoadBalancerID: adopted.ID,
+	}
+	_, _, err = lbm.loadBalancerController.Create(ctx, lbm.config.orgRef(), &core.LoadBalancerCreateArguments{
+		Name:       "unrelated",
+		DataCenter: lbm.config.dcRef(),
+	})
+	require.NoError(t, err)
+
+	kube := fake.NewSimpleClientset(web, released, adopter, readyNode("node-1"))
+	tool, err := newLoadBalancerTool(lookuper, kube, "kce")
+	require.NoError(t, err)
+	defer tool.Close()
+
+	t.Run("resync", func(t *testing.T) {
+		status, err := tool.Resync(ctx, "default", "web")
+		require.NoError(t, err)
+		require.Len(t, status.Ingress, 1)
+
+		got, err := kube.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, *status, got.Status.LoadBalancer)
+
+		_, err = tool.Resync(ctx, "default", "released")
+		assert.EqualError(t, err, "service default/released is of type ClusterIP, not LoadBalancer")
+	})
+
+	t.Run("show", func(t *testing.T) {
+		infos, err := tool.Show(ctx, "default", "web")
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		assert.Equal(t, "kce-kce-web", infos[0].Name)
+		assert.Equal(t, "default/web", infos[0].Service)
+		assert.Equal(t, []LoadBalancerRuleInfo{{
+			ID:              infos[0].Rules[0].ID,
+			Protocol:        "TCP",
+			ListenPort:      80,
+			DestinationPort: 30080,
+		}}, infos[0].Rules)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		infos, err := tool.List(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"kce-kce-web":      "default/web",
+			"kce-kce-released": "default/released",
+			"kce-kce-deleted":  "",
+			"legacy":           "default/adopter",
+		}, infoNames(infos))
+	})
+
+	t.Run("release", func(t *testing.T) {
+		infos, err := tool.Release(ctx, "default", "web")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"kce-kce-web": "default/web"}, infoNames(infos))
+
+		got, err := kube.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "retain", got.Annotations[annotationLoadBalancerDeletionPolicy])
+	})
+
+	t.Run("gc", func(t *testing.T) {
+		infos, err := tool.GC(ctx, true)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"kce-kce-deleted": ""}, infoNames(infos))
+		assert.Len(t, s.LoadBalancers(), 6)
+
+		infos, err = tool.GC(ctx, false)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"kce-kce-deleted": ""}, infoNames(infos))
+		assert.Len(t, s.LoadBalancers(), 5)
+		names := []string{}
+		for _, lb := range s.LoadBalancers() {
+			names = append(names, lb.Name)
+		}
+		assert.Contains(t, names, "released-kce-kce-gone")
+
+		infos, err = tool.GC(ctx, false)
+		require.NoError(t, err)
+		assert.Empty(t, infos)
+	})
+}
+
+func TestLoadBalancerTool_sharedClusterNamePrefix(t *testing.T) {
+	s, prod := newFakeKatapult(t)
+	lookuper := newDoctorLookuper(t, s)
+	ctx := context.Background()
+
+	// prod-eu shares the organization, and its load balancer names start with
+	// those of prod, but its nodes are tagged separately.
+	prodEU := &loadBalancerManager{
+		log: prod.log,
+		config: Config{
+			OrganizationID: "org_fake",
+			DataCenterID:   "dc_fake",
+			NodeTagID:      "tag_prod_eu_nodes",
+		},
+		loadBalancerController:        prod.loadBalancerController,
+		loadBalancerRuleController:    prod.loadBalancerRuleController,
+		virtualMachineController:      prod.virtualMachineController,
+		virtualMachineGroupController: prod.virtualMachineGroupController,
+	}
+	_, err := prodEU.EnsureLoadBalancer(ctx, "prod-eu", doctorService("web", 80), nil)
+	require.NoError(t, err)
+	_, err = prod.EnsureLoadBalancer(ctx, "prod", doctorService("deleted", 80), nil)
+	require.NoError(t, err)
+
+	kube := fake.NewSimpleClientset()
+	tool, err := newLoadBalancerTool(lookuper, kube, "prod")
+	require.NoError(t, err)
+	defer tool.Close()
+
+	infos, err := tool.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"kce-prod-deleted": ""}, infoNames(infos))
+
+	report := runDoctor(ctx, lookuper, kube, "prod")
+	orphans := []string{}
+	for _, f := range report.Findings {
+		if f.Kind == FindingOrphan {
+			orphans = append(orphans, f.LoadBalancerID)
+		}
+	}
+	assert.Equal(t, []string{infos[0].ID}, orphans)
+
+	infos, err = tool.GC(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"kce-prod-deleted": ""}, infoNames(infos))
+	require.Len(t, s.LoadBalancers(), 1)
+	assert.Equal(t, "kce-prod-eu-web", s.LoadBalancers()[0].Name)
+}
+
+func TestLoadBalancerNode(t *testing.T) {
+	excluded := readyNode("excluded")
+	excluded.Labels = map[string]string{v1.LabelNodeExcludeBalancers: ""}
+	notReady := readyNode("not-ready")
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+
+	tests := []struct {
+		name string
+		node *v1.Node
+		want bool
+	}{
+		{name: "ready", node: readyNode("ready"), want: true},
+		{name: "excluded", node: excluded, want: false},
+		{name: "not ready", node: notReady, want: false},
+		{name: "no conditions", node: &v1.Node{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, loadBalancerNode(tt.node))
+		})
+	}
+}
@@ -6,7 +6,16 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/krystal/go-katapult"
 	"github.com/krystal/go-katapult/core"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	cloudprovider "k8s.io/cloud-provider"
+	"net/http"
+	"strings"
+	"time"
 )
 
 // loadBalancerManager is an abstract, pluggable interface for load balancers.
@@ -27,6 +36,7 @@ import (
 // LB services must be managed in the alternate implementation.
 
 type loadBalancerController interface {
+	Get(ctx context.Context, lb core.LoadBalancerRef) (*core.LoadBalancer, *katapult.Response, error)
 	List(ctx context.Context, org core.OrganizationRef, opts *core.ListOptions) ([]*core.LoadBalancer, *katapult.Response, error)
 	Delete(ctx context.Context, lb core.LoadBalancerRef) (*core.LoadBalancer, *katapult.Response, error)
 	Update(ctx context.Context, lb core.LoadBalancerRef, args *core.LoadBalancerUpdateArguments) (*core.LoadBalancer, *katapult.Response, error)
@@ -41,15 +51,35 @@ type loadBalancerRuleController interface {
 }
 
 type loadBalancerManager struct {
-	log logr.Logger
-
-	config                     Config
-	loadBalancerController     loadBalancerController
-	loadBalancerRuleController loadBalancerRuleController
+	log      logr.Logger
+	recorder record.EventRecorder
+	// kube is used to record the rules managed on each service's load
+	// balancers. It is set once the provider has been initialized.
+	kube kubernetes.Interface
+
+	config                        Config
+	loadBalancerController        loadBalancerController
+	loadBalancerRuleController    loadBalancerRuleController
+	virtualMachineController      virtualMachineController
+	virtualMachineGroupController virtualMachineGroupController
+
+	// deletePollInterval and deletePollTimeout control how we wait for
+	// Katapult to confirm that a load balancer has been deleted.
+	deletePollInterval time.Duration
+	deletePollTimeout  time.Duration
+
+	// rateLimiter backs off rule changes, which are made concurrently, when
+	// Katapult reports that the rate limit has been exceeded.
+	rateLimiter rateLimiter
 }
 
 var lbNotFound = fmt.Errorf("lb not found")
 
+const (
+	defaultDeletePollInterval = 2 * time.Second
+	defaultDeletePollTimeout  = 30 * time.Second
+)
+
 // listLoadBalancers fetches all LBs for the associated org, paging where necessary
 func (lbm *loadBalancerManager) listLoadBalancers(ctx context.Context) ([]*core.LoadBalancer, error) {
 	list, resp, err := lbm.loadBalancerController.List(ctx, lbm.config.orgRef(), nil)
@@ -87,60 +117,162 @@ func (lbm *loadBalancerManager) listLoadBalancerRules(ctx context.Context, lb co
 }
 
 // getLoadBalancer lists all load balancers for an organisation and attemots to
-// find a specific load balancer. This will eventually be replaced with a
-// bespoke API field to avoid this.
-func (lbm *loadBalancerManager) getLoadBalancer(ctx context.Context, name string) (*core.LoadBalancer, error) {
+// find a specific load balancer. When more than one name is given, the load
+// balancer with the earliest of them is returned. This will eventually be
+// replaced with a bespoke API field to avoid this.
+func (lbm *loadBalancerManager) getLoadBalancer(ctx context.Context, names ...string) (*core.LoadBalancer, error) {
 	list, err := lbm.listLoadBalancers(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, potentialMatch := range list {
-		if potentialMatch.Name == name {
-			return potentialMatch, nil
+	for _, name := range names {
+		for _, potentialMatch := range list {
+			if potentialMatch.Name == name {
+				return potentialMatch, nil
+			}
 		}
 	}
 
 	return nil, lbNotFound
 }
 
+// getLoadBalancerByID fetches a specific load balancer by its RID.
+func (lbm *loadBalancerManager) getLoadBalancerByID(ctx context.Context, id string) (*core.LoadBalancer, error) {
+	lb, resp, err := lbm.loadBalancerController.Get(ctx, core.LoadBalancerRef{ID: id})
+	if err != nil {
+		if isNotFound(resp) {
+			return nil, lbNotFound
+		}
+		return nil, err
+	}
+
+	return lb, nil
+}
+
+// isNotFound returns true if a Katapult response indicates that the requested
+// resource does not exist.
+func isNotFound(resp *katapult.Response) bool {
+	return resp != nil && resp.Response != nil && resp.StatusCode == http.StatusNotFound
+}
+
+// findLoadBalancer finds the load balancer for a service in a data center.
+// This is the load balancer named in the adoption annotation if present,
+// otherwise the load balancer with the name we would have created it with.
+func (lbm *loadBalancerManager) findLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, opts *loadBalancerOptions, dc dataCenter) (*core.LoadBalancer, error) {
+	if opts.loadBalancerID != "" {
+		// Adopted load balancers only ever live in the primary data center.
+		if dc.id != lbm.config.DataCenterID {
+			return nil, lbNotFound
+		}
+		return lbm.getLoadBalancerByID(ctx, opts.loadBalancerID)
+	}
+
+	return lbm.getLoadBalancer(ctx, lbm.loadBalancerName(clusterName, service, dc))
+}
+
+// handlesService returns true if the service's load balancer should be
+// managed by us, rather than by another implementation selected with
+// spec.loadBalancerClass. This matches the service controller, which never
+// passes a service with a class to EnsureLoadBalancer.
+func (lbm *loadBalancerManager) handlesService(service *v1.Service) bool {
+	return service.Spec.LoadBalancerClass == nil
+}
+
+// loadBalancerNameLimit is katapult's limit on load balancer name length
+const loadBalancerNameLimit = 60
+
 func loadBalancerName(clusterName string, service *v1.Service) string {
 	// we want to produce a deterministic load balancer name from the service
-	// katapult has a limit of 60 characters on name length
 	ns := ""
 	if service.Namespace != "default" {
 		ns = fmt.Sprintf("%s-", service.Namespace)
 	}
 	untrimmed := fmt.Sprintf("kce-%s-%s%s", clusterName, ns, service.Name)
 
-	const trimLength = 60
-	if len(untrimmed) > trimLength {
-		return untrimmed[0:trimLength]
+	if len(untrimmed) > loadBalancerNameLimit {
+		return untrimmed[0:loadBalancerNameLimit]
 	}
 	return untrimmed
 }
 
+// releasedLoadBalancerPrefix is added to the name of a load balancer when its
+// service releases it, so that it is no longer named for the cluster.
+const releasedLoadBalancerPrefix = "released-"
+
+// releasedLoadBalancerName returns the name a load balancer is given when it
+// is released.
+func releasedLoadBalancerName(name string) string {
+	released := releasedLoadBalancerPrefix + name
+	if len(released) > loadBalancerNameLimit {
+		return released[0:loadBalancerNameLimit]
+	}
+	return released
+}
+
+// loadBalancerName returns the name of a service's load balancer in a data
+// center. Load balancers outside of the primary data center are suffixed with
+// the data center RID so that they remain unique.
+func (lbm *loadBalancerManager) loadBalancerName(clusterName string, service *v1.Service, dc dataCenter) string {
+	name := loadBalancerName(clusterName, service)
+	if dc.id == lbm.config.DataCenterID {
+		return name
+	}
+
+	suffix := fmt.Sprintf("-%s", dc.id)
+	if len(name)+len(suffix) > loadBalancerNameLimit {
+		name = name[0 : loadBalancerNameLimit-len(suffix)]
+	}
+	return name + suffix
+}
+
+// checkClusterName ensures the cluster name given by the controller manager
+// matches the configured KCE cluster, as load balancers are named after it and
+// a mismatch would leave existing load balancers behind.
+func (lbm *loadBalancerManager) checkClusterName(clusterName string) error {
+	if lbm.config.ClusterName != "" && clusterName != lbm.config.ClusterName {
+		return fmt.Errorf("cluster name %q does not match configured cluster %q", clusterName, lbm.config.ClusterName)
+	}
+
+	return nil
+}
+
 // GetLoadBalancer returns whether the specified load balancer exists, and
 // if so, what its status is.
 // Implementations must treat the *v1.Service parameter as read-only and not modify it.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
 func (lbm *loadBalancerManager) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
-	foundLb, err := lbm.getLoadBalancer(ctx, loadBalancerName(clusterName, service))
-	if err != nil {
-		if err == lbNotFound {
-			return nil, false, nil
+	ctx, span := startSpan(ctx, "LoadBalancer.GetLoadBalancer", trace.SpanKindInternal, serviceAttributes(clusterName, service)...)
+	defer func() { endSpan(span, err) }()
+
+	// The service controller checks that a load balancer exists before
+	// cleaning it up. So that cleanup always happens, services with a load
+	// balancer class are not skipped, as we may have created their load
+	// balancer before they were given one, and invalid annotations are
+	// ignored.
+	opts := parseDeletionOptions(service, lbm.config)
+
+	status = &v1.LoadBalancerStatus{}
+	for _, dc := range lbm.config.dataCenters() {
+		foundLb, err := lbm.findLoadBalancer(ctx, clusterName, service, opts, dc)
+		if err != nil {
+			if err == lbNotFound {
+				continue
+			}
+
+			return nil, false, err
 		}
 
-		return nil, false, err
+		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{
+			IP: foundLb.IPAddress.Address,
+		})
+	}
+
+	if len(status.Ingress) == 0 {
+		return nil, false, nil
 	}
 
-	return &v1.LoadBalancerStatus{
-		Ingress: []v1.LoadBalancerIngress{
-			{
-				IP: foundLb.IPAddress.Address,
-			},
-		},
-	}, true, nil
+	return status, true, nil
 }
 
 // GetLoadBalancerName returns the name of the load balancer. Implementations
@@ -149,170 +281,389 @@ func (lbm *loadBalancerManager) GetLoadBalancerName(_ context.Context, clusterNa
 	return loadBalancerName(clusterName, service)
 }
 
-// tidyLoadBalancerRules deletes rules that are no longer in use by the service
-// TODO: Instrumentation for number of entities cleaned up
-func (lbm *loadBalancerManager) tidyLoadBalancerRules(ctx context.Context, service *v1.Service, lb *core.LoadBalancer) error {
+// ensureLoadBalancerRules creates, updates and deletes LB rules to match the
+// ports exposed by a kubernetes service. The changes are planned up front and
+// rolled back if any of them fail. Rules for the service's ports that were
+// added by hand are left alone, and a warning is raised.
+// TODO: Instrumentation for number of entities created etc
+func (lbm *loadBalancerManager) ensureLoadBalancerRules(ctx context.Context, service *v1.Service, lb *core.LoadBalancer, opts *loadBalancerOptions, record *ruleRecord) error {
+	log := loggerFrom(ctx, lbm.log).WithValues(logKeyLoadBalancerID, lb.ID)
+
 	rules, err := lbm.listLoadBalancerRules(ctx, lb.Ref())
 	if err != nil {
 		return err
 	}
 
-	for _, rule := range rules {
-		inUse := false
-		for _, servicePort := range service.Spec.Ports {
-			if rule.ListenPort == int(servicePort.Port) {
-				inUse = true
-				break
-			}
+	owned := record.owned(lb.ID)
+	plan := planLoadBalancerRules(log, service, rules, owned, record.names, opts.portSettings)
+
+	for _, conflict := range plan.conflicts {
+		log.Info("lb rule conflicts with unmanaged rule",
+			logKeyRuleID, conflict.rule.ID,
+			"servicePort", conflict.servicePort.Port,
+			"servicePortName", conflict.servicePort.Name,
+		)
+		lbm.event(service, v1.EventTypeWarning, eventReasonRuleConflict,
+			"Port %d is not being served, load balancer %s already has a rule %s for it that was not created by kce-ccm",
+			conflict.servicePort.Port, lb.ID, conflict.rule.ID,
+		)
+	}
+
+	if lbm.config.DryRun {
+		lbm.dryRunRuleChanges(ctx, service, plan.changes, opts.portRanges, logKeyLoadBalancerID, lb.ID)
+		return nil
+	}
+
+	// Record the rules that are about to be created before creating them, so
+	// that they can never be mistaken for rules added by hand. This also
+	// saves the record of a load balancer that had none.
+	previouslyOwned := record.owned(lb.ID)
+	for _, c := range plan.changes {
+		if c.action == dryRunCreate || c.from != 0 {
+			owned[c.port] = true
 		}
+	}
+	record.set(lb.ID, owned)
+	if err := lbm.saveRuleRecord(ctx, record); err != nil {
+		return err
+	}
 
-		if !inUse {
-			lbm.log.Info("deleting unused lb rule",
-				"loadBalancerId", lb.ID,
-				"serviceId", service.UID,
-				"ruleId", rule.ID,
-				"rulePort", rule.ListenPort,
-			)
-			_, _, err := lbm.loadBalancerRuleController.Delete(ctx, rule.Ref())
-			if err != nil {
-				return err
+	if len(plan.changes) == 0 {
+		return nil
+	}
+	log.Info("applying lb rule changes",
+		"creates", plan.count(dryRunCreate),
+		"updates", plan.count(dryRunUpdate),
+		"deletes", plan.count(dryRunDelete),
+	)
+
+	undone, err := lbm.applyRulePlan(ctx, lb, plan, opts.portRanges)
+	if err != nil {
+		// Stop recording the rules whose creation or move was rolled back.
+		for _, c := range undone {
+			if c.action == dryRunDelete && !previouslyOwned[c.port] {
+				delete(owned, c.port)
+			}
+			if c.from != 0 && !previouslyOwned[c.from] {
+				delete(owned, c.from)
 			}
 		}
+	} else {
+		for _, c := range plan.changes {
+			if c.action == dryRunDelete {
+				delete(owned, c.port)
+			}
+			if c.from != 0 {
+				delete(owned, c.from)
+			}
+		}
+	}
+
+	record.set(lb.ID, owned)
+	if saveErr := lbm.saveRuleRecord(ctx, record); err == nil {
+		err = saveErr
+	}
+
+	return err
+}
+
+// findRule returns the rule listening on a port, or nil if there is none.
+func findRule(rules []core.LoadBalancerRule, port int) *core.LoadBalancerRule {
+	for i := range rules {
+		if rules[i].ListenPort == port {
+			return &rules[i]
+		}
 	}
 
 	return nil
 }
 
-// ensureLoadBalancerRules creates or update LB rules to match the ports exposed
-// by a kubernetes service.
-// TODO: Instrumentation for number of entities created etc
-func (lbm *loadBalancerManager) ensureLoadBalancerRules(ctx context.Context, service *v1.Service, lb *core.LoadBalancer) error {
-	rules, err := lbm.listLoadBalancerRules(ctx, lb.Ref())
+// reconcileLoadBalancer corrects any fields on an existing load balancer that
+// have drifted from what the service requires, for example where a load
+// balancer has been edited in the Katapult UI.
+func (lbm *loadBalancerManager) reconcileLoadBalancer(ctx context.Context, service *v1.Service, lb *core.LoadBalancer, name string, target loadBalancerTarget) (*core.LoadBalancer, error) {
+	args := &core.LoadBalancerUpdateArguments{}
+	drifted := []string{}
+
+	if lb.Name != name {
+		args.Name = name
+		drifted = append(drifted, "name")
+	}
+	if !target.matches(lb) {
+		args.ResourceType = target.resourceType
+		args.ResourceIDs = &target.resourceIDs
+		if lb.ResourceType != target.resourceType {
+			drifted = append(drifted, "resourceType")
+		}
+		if !sameIDs(lb.ResourceIDs, target.resourceIDs) {
+			drifted = append(drifted, "resourceIds")
+		}
+	}
+
+	if len(drifted) == 0 {
+		return lb, nil
+	}
+
+	if lbm.config.DryRun {
+		lbm.dryRunChange(ctx, service, dryRunUpdate, dryRunLoadBalancer, fmt.Sprintf("%s to revert changes to %s", lb.ID, strings.Join(drifted, ", ")),
+			logKeyLoadBalancerID, lb.ID,
+			"fields", drifted,
+		)
+		return lb, nil
+	}
+
+	log := loggerFrom(ctx, lbm.log).WithValues(logKeyLoadBalancerID, lb.ID)
+	log.V(4).Info("correcting lb drift",
+		"args", args,
+	)
+	updated, resp, err := lbm.loadBalancerController.Update(ctx, lb.Ref(), args)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	withRequestID(log, resp).Info("corrected lb drift",
+		"fields", drifted,
+	)
 
-	for _, servicePort := range service.Spec.Ports {
-		// attempt to match existing rule to service port based on Port and ListenPort
-		var foundRule *core.LoadBalancerRule
-		for _, rule := range rules {
-			if rule.ListenPort == int(servicePort.Port) {
-				foundRule = &rule
-				break
+	lbm.event(service, v1.EventTypeNormal, eventReasonDriftCorrected,
+		"Reverted changes to load balancer %s: %s", lb.ID, strings.Join(drifted, ", "),
+	)
+
+	return updated, nil
+}
+
+// EnsureLoadBalancer creates a new load balancer 'name', or updates the existing one. Returns the status of the balancer
+// Implementations must treat the *v1.Service and *v1.Node
+// parameters as read-only and not modify them.
+// Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
+func (lbm *loadBalancerManager) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (status *v1.LoadBalancerStatus, err error) {
+	ctx, span := startSpan(ctx, "LoadBalancer.EnsureLoadBalancer", trace.SpanKindInternal, serviceAttributes(clusterName, service)...)
+	defer func() { endSpan(span, err) }()
+
+	if !lbm.handlesService(service) {
+		return nil, cloudprovider.ImplementedElsewhere
+	}
+
+	ctx, _ = withLogger(ctx, lbm.log, "EnsureLoadBalancer", clusterName, service)
+
+	if err := lbm.checkClusterName(clusterName); err != nil {
+		return nil, err
+	}
+
+	opts, err := parseLoadBalancerOptions(service, lbm.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return lbm.ensureLoadBalancers(ctx, clusterName, service, opts, nodes)
+}
+
+// ensureLoadBalancers creates, updates and removes a service's load balancers
+// so that it has one in each of its selected data centers, returning their
+// addresses.
+func (lbm *loadBalancerManager) ensureLoadBalancers(ctx context.Context, clusterName string, service *v1.Service, opts *loadBalancerOptions, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	selected, err := lbm.selectDataCenters(opts, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	record := newRuleRecord(service)
+	ensured := map[string]bool{}
+	status := &v1.LoadBalancerStatus{}
+	for _, dc := range lbm.config.dataCenters() {
+		if !containsDataCenter(selected, dc) {
+			err := lbm.removeDataCenterLoadBalancer(ctx, clusterName, service, opts, dc)
+			if err != nil {
+				return nil, err
 			}
+			continue
 		}
 
-		proxyProtocol := false
-		checkEnabled := true
-		lbRuleArgs := core.LoadBalancerRuleArguments{
-			Algorithm:       core.RoundRobinRuleAlgorithm,
-			DestinationPort: int(servicePort.NodePort),
-			ListenPort:      int(servicePort.Port),
-			Protocol:        core.TCPProtocol,
-			ProxyProtocol:   &proxyProtocol,
-			CheckEnabled:    &checkEnabled,
-			CheckProtocol:   core.TCPProtocol,
-			CheckTimeout:    5,
-			CheckInterval:   10,
-			CheckRise:       1,
-			CheckFall:       1,
+		lb, err := lbm.ensureDataCenterLoadBalancer(ctx, clusterName, service, opts, dc, record)
+		if err != nil {
+			return nil, err
 		}
+		ensured[lb.ID] = true
 
-		if foundRule == nil {
-			lbm.log.Info("creating lb rule",
-				"loadBalancerId", lb.ID,
-				"serviceId", service.UID,
-				"servicePort", servicePort.Port,
-				"servicePortName", servicePort.Name,
-				"servicePortTarget", servicePort.TargetPort,
-			)
-			_, _, err := lbm.loadBalancerRuleController.Create(ctx, lb.Ref(), lbRuleArgs)
-			if err != nil {
-				return err
-			}
-		} else {
-			lbm.log.Info("updating lb rule",
-				"loadBalancerId", lb.ID,
-				"ruleId", foundRule.ID,
-				"serviceId", service.UID,
-				"servicePort", servicePort.Port,
-				"servicePortName", servicePort.Name,
-				"servicePortTarget", servicePort.TargetPort,
-			)
-			lbm.log.V(4).Info("updating lb rule",
-				"loadBalancerId", lb.ID,
-				"ruleId", foundRule.ID,
-				"args", lbRuleArgs,
-			)
-			// TODO: Matcher to avoid unnecessary updates
-			_, _, err := lbm.loadBalancerRuleController.Update(ctx, foundRule.Ref(), lbRuleArgs)
-			if err != nil {
-				return err
-			}
+		// A load balancer that a dry run would have created has no address.
+		if lb.IPAddress != nil {
+			status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{
+				IP: lb.IPAddress.Address,
+			})
 		}
 	}
 
-	return nil
+	// Forget the rules of any load balancers that are no longer used, and
+	// remember the service's named ports now that every load balancer serves
+	// them.
+	record.retain(ensured)
+	record.setNames(service.Spec.Ports)
+	if err := lbm.saveRuleRecord(ctx, record); err != nil {
+		return nil, err
+	}
+
+	return status, nil
 }
 
-// EnsureLoadBalancer creates a new load balancer 'name', or updates the existing one. Returns the status of the balancer
-// Implementations must treat the *v1.Service and *v1.Node
-// parameters as read-only and not modify them.
-// Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
-func (lbm *loadBalancerManager) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	name := loadBalancerName(clusterName, service)
-	lb, err := lbm.getLoadBalancer(ctx, name)
+func containsDataCenter(dcs []dataCenter, dc dataCenter) bool {
+	for _, candidate := range dcs {
+		if candidate.id == dc.id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ensureDataCenterLoadBalancer creates or updates a service's load balancer
+// in a single data center.
+func (lbm *loadBalancerManager) ensureDataCenterLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, opts *loadBalancerOptions, dc dataCenter, record *ruleRecord) (*core.LoadBalancer, error) {
+	log := loggerFrom(ctx, lbm.log).WithValues(logKeyDataCenterID, dc.id)
+
+	target, err := lbm.loadBalancerTarget(ctx, opts, dc)
+	if err != nil {
+		return nil, err
+	}
+
+	// A load balancer released by an earlier service with the same name and
+	// namespace is reclaimed if there is no other, keeping its IP address.
+	name := lbm.loadBalancerName(clusterName, service, dc)
+	var lb *core.LoadBalancer
+	if opts.loadBalancerID != "" {
+		lb, err = lbm.findLoadBalancer(ctx, clusterName, service, opts, dc)
+	} else {
+		lb, err = lbm.getLoadBalancer(ctx, name, releasedLoadBalancerName(name))
+	}
 	if err != nil && err != lbNotFound {
 		return nil, err
 	}
 
+	// An adopted load balancer must already exist, we should never create
+	// one in its place.
+	if lb == nil && opts.loadBalancerID != "" {
+		return nil, fmt.Errorf("load balancer %s to adopt was not found", opts.loadBalancerID)
+	}
+
+	if lb != nil && opts.loadBalancerID == "" && lb.Name != name {
+		lb, err = lbm.renameLoadBalancer(ctx, service, lb, name)
+		if err != nil {
+			return nil, err
+		}
+		if !lbm.config.DryRun {
+			lbm.event(service, v1.EventTypeNormal, eventReasonReclaimed,
+				"Reclaimed released load balancer %s", lb.ID,
+			)
+		}
+	}
+
+	// A dry run cannot create the load balancer, so instead reports it and
+	// every rule it would then have created.
+	if lb == nil && lbm.config.DryRun {
+		lbm.dryRunChange(ctx, service, dryRunCreate, dryRunLoadBalancer, name,
+			"name", name,
+			"resourceType", target.resourceType,
+			"resourceIds", target.resourceIDs,
+		)
+		plan := planLoadBalancerRules(log, service, nil, nil, nil, nil)
+		lbm.dryRunRuleChanges(ctx, service, plan.changes, opts.portRanges)
+
+		// There is no load balancer to report the address of.
+		return &core.LoadBalancer{Name: name}, nil
+	}
+
 	// If load balancer doesn't exist create it
 	if lb == nil {
-		lbm.log.Info("creating lb",
-			"serviceId", service.UID,
-		)
-		lb, _, err = lbm.loadBalancerController.Create(ctx, lbm.config.orgRef(), &core.LoadBalancerCreateArguments{
+		var resp *katapult.Response
+		lb, resp, err = lbm.loadBalancerController.Create(ctx, lbm.config.orgRef(), &core.LoadBalancerCreateArguments{
 			Name:         name,
-			DataCenter:   lbm.config.dcRef(),
-			ResourceType: core.VirtualMachineGroupsResourceType,
-			ResourceIDs:  &[]string{lbm.config.NodeTagID},
+			DataCenter:   dc.ref(),
+			ResourceType: target.resourceType,
+			ResourceIDs:  &target.resourceIDs,
 		})
 		if err != nil {
 			return nil, err
 		}
+		withRequestID(log, resp).Info("created lb",
+			logKeyLoadBalancerID, lb.ID,
+		)
 	} else {
-		lbm.log.Info("found existing lb",
-			"serviceId", service.UID,
-			"loadBalancerId", lb.ID,
+		log.Info("found existing lb",
+			logKeyLoadBalancerID, lb.ID,
 		)
+
+		// Adopted load balancers keep the name they were given, so that they
+		// are never mistaken for load balancers created for the cluster.
+		if opts.loadBalancerID != "" {
+			name = lb.Name
+		}
+
+		lb, err = lbm.reconcileLoadBalancer(ctx, service, lb, name, target)
+		if err != nil {
+			return nil, err
+		}
 	}
-	// If it already exists, there's not many fields we need to update
-	// We do need to update the associated loadBalancerManager rules though.
+	// We also need to update the associated loadBalancerManager rules.
 
-	err = lbm.ensureLoadBalancerRules(ctx, service, lb)
+	err = lbm.ensureLoadBalancerRules(ctx, service, lb, opts, record)
 	if err != nil {
 		return nil, err
 	}
 
-	err = lbm.tidyLoadBalancerRules(ctx, service, lb)
+	return lb, nil
+}
+
+// removeDataCenterLoadBalancer deletes a service's load balancer from a data
+// center that it is no longer wanted in. Retained load balancers are left
+// alone, and will be picked up again if the data center is selected again.
+func (lbm *loadBalancerManager) removeDataCenterLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, opts *loadBalancerOptions, dc dataCenter) error {
+	if opts.deletionPolicy == deletionPolicyRetain {
+		return nil
+	}
+
+	lb, err := lbm.findLoadBalancer(ctx, clusterName, service, opts, dc)
 	if err != nil {
-		return nil, err
+		if err == lbNotFound {
+			return nil
+		}
+		return err
 	}
 
-	return &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
-		{
-			IP: lb.IPAddress.Address,
-		},
-	}}, nil
+	return lbm.deleteLoadBalancer(ctx, service, lb)
 }
 
 // UpdateLoadBalancer updates hosts under the specified load balancer.
 // Implementations must treat the *v1.Service and *v1.Node
 // parameters as read-only and not modify them.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
-func (lbm *loadBalancerManager) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
-	// TODO: Evaluate if required. For now rely on health checking and tagging of hosts.
-	return nil
+func (lbm *loadBalancerManager) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (err error) {
+	ctx, span := startSpan(ctx, "LoadBalancer.UpdateLoadBalancer", trace.SpanKindInternal, serviceAttributes(clusterName, service)...)
+	defer func() { endSpan(span, err) }()
+
+	if !lbm.handlesService(service) {
+		return cloudprovider.ImplementedElsewhere
+	}
+
+	opts, err := parseLoadBalancerOptions(service, lbm.config)
+	if err != nil {
+		return err
+	}
+
+	// Load balancers target nodes by tag, so a change of nodes only matters
+	// when the service's data centers are selected from its nodes. The
+	// service controller does not update the service's status here, so the
+	// address of a load balancer added to a new data center is only reported
+	// on its next sync.
+	if len(opts.dataCenterIDs) != 1 || opts.dataCenterIDs[0] != selectDataCentersFromNodes {
+		return nil
+	}
+
+	ctx, _ = withLogger(ctx, lbm.log, "UpdateLoadBalancer", clusterName, service)
+
+	if err := lbm.checkClusterName(clusterName); err != nil {
+		return err
+	}
+
+	_, err = lbm.ensureLoadBalancers(ctx, clusterName, service, opts, nodes)
+	return err
 }
 
 // EnsureLoadBalancerDeleted deletes the specified load balancer if it
@@ -323,16 +674,175 @@ func (lbm *loadBalancerManager) UpdateLoadBalancer(ctx context.Context, clusterN
 // doesn't exist even if some part of it is still laying around.
 // Implementations must treat the *v1.Service parameter as read-only and not modify it.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
-func (lbm *loadBalancerManager) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
-	name := loadBalancerName(clusterName, service)
-	balancer, err := lbm.getLoadBalancer(ctx, name)
+func (lbm *loadBalancerManager) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) (err error) {
+	ctx, span := startSpan(ctx, "LoadBalancer.EnsureLoadBalancerDeleted", trace.SpanKindInternal, serviceAttributes(clusterName, service)...)
+	defer func() { endSpan(span, err) }()
+
+	ctx, log := withLogger(ctx, lbm.log, "EnsureLoadBalancerDeleted", clusterName, service)
+
+	// We don't check handlesService here, as we must still clean up after
+	// ourselves if the service has been given a load balancer class. Invalid
+	// annotations are ignored, as they must never stop a service from being
+	// deleted.
+	opts := parseDeletionOptions(service, lbm.config)
+	if _, err := parseLoadBalancerOptions(service, lbm.config); err != nil {
+		log.Info("ignoring invalid annotations",
+			"error", err.Error(),
+			"deletionPolicy", opts.deletionPolicy,
+		)
+	}
+
+	// Check every data center, as the service may have been moved between
+	// them since its load balancers were created.
+	errs := []error{}
+	for _, dc := range lbm.config.dataCenters() {
+		balancer, err := lbm.findLoadBalancer(ctx, clusterName, service, opts, dc)
+		if err != nil {
+			if err != lbNotFound { // If it doesn't exist, good!
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if opts.deletionPolicy == deletionPolicyRetain {
+			log.Info("releasing lb",
+				logKeyLoadBalancerID, balancer.ID,
+			)
+			err = lbm.releaseLoadBalancer(ctx, service, opts, balancer)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		err = lbm.deleteLoadBalancer(ctx, service, balancer)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// releaseLoadBalancer detaches a retained load balancer from the cluster, so
+// that it is no longer owned by the cluster and is never garbage collected.
+// Load balancers created for the service are renamed so that they are no
+// longer named for the cluster. Adopted load balancers already have a name of
+// their own, so are left as they are.
+func (lbm *loadBalancerManager) releaseLoadBalancer(ctx context.Context, service *v1.Service, opts *loadBalancerOptions, lb *core.LoadBalancer) error {
+	if opts.loadBalancerID != "" {
+		if !lbm.config.DryRun {
+			lbm.event(service, v1.EventTypeNormal, eventReasonReleased,
+				"Released adopted load balancer %s, it has not been deleted", lb.ID,
+			)
+		}
+		return nil
+	}
+
+	name := releasedLoadBalancerName(lb.Name)
+	if _, err := lbm.renameLoadBalancer(ctx, service, lb, name); err != nil {
+		return err
+	}
+	if lbm.config.DryRun {
+		return nil
+	}
+	lbm.event(service, v1.EventTypeNormal, eventReasonReleased,
+		"Released load balancer %s as %q, it has not been deleted", lb.ID, name,
+	)
+
+	return nil
+}
+
+// renameLoadBalancer changes the name of a load balancer, which is how load
+// balancers are released and reclaimed.
+func (lbm *loadBalancerManager) renameLoadBalancer(ctx context.Context, service *v1.Service, lb *core.LoadBalancer, name string) (*core.LoadBalancer, error) {
+	if lbm.config.DryRun {
+		lbm.dryRunChange(ctx, service, dryRunUpdate, dryRunLoadBalancer, fmt.Sprintf("%s to rename it %q", lb.ID, name),
+			logKeyLoadBalancerID, lb.ID,
+			"name", name,
+		)
+		renamed := *lb
+		renamed.Name = name
+		return &renamed, nil
+	}
+
+	updated, resp, err := lbm.loadBalancerController.Update(ctx, lb.Ref(), &core.LoadBalancerUpdateArguments{Name: name})
 	if err != nil {
-		if err == lbNotFound { // If it doesn't exist, good!
-			return nil
+		return nil, err
+	}
+	withRequestID(loggerFrom(ctx, lbm.log), resp).Info("renamed lb",
+		logKeyLoadBalancerID, lb.ID,
+		"name", name,
+	)
+
+	return updated, nil
+}
+
+// deleteLoadBalancer tears down a load balancer and its rules, and waits for
+// Katapult to confirm that the load balancer no longer exists. Each step
+// tolerates the resource already being gone, so this is safe to retry.
+func (lbm *loadBalancerManager) deleteLoadBalancer(ctx context.Context, service *v1.Service, lb *core.LoadBalancer) error {
+	log := loggerFrom(ctx, lbm.log).WithValues(logKeyLoadBalancerID, lb.ID)
+
+	rules, err := lbm.listLoadBalancerRules(ctx, lb.Ref())
+	if err != nil {
+		return err
+	}
+
+	if lbm.config.DryRun {
+		for _, rule := range rules {
+			lbm.dryRunChange(ctx, service, dryRunDelete, dryRunLoadBalancerRule, fmt.Sprintf("for port %d", rule.ListenPort),
+				logKeyLoadBalancerID, lb.ID,
+				logKeyRuleID, rule.ID,
+			)
 		}
+		lbm.dryRunChange(ctx, service, dryRunDelete, dryRunLoadBalancer, lb.ID,
+			logKeyLoadBalancerID, lb.ID,
+		)
+		return nil
+	}
+
+	for _, rule := range rules {
+		_, resp, err := lbm.loadBalancerRuleController.Delete(ctx, rule.Ref())
+		if err != nil && !isNotFound(resp) {
+			return err
+		}
+		withRequestID(log, resp).Info("deleted lb rule",
+			logKeyRuleID, rule.ID,
+		)
+	}
+
+	_, resp, err := lbm.loadBalancerController.Delete(ctx, lb.Ref())
+	if err != nil && !isNotFound(resp) {
 		return err
 	}
+	withRequestID(log, resp).Info("deleted lb")
+
+	interval := lbm.deletePollInterval
+	if interval == 0 {
+		interval = defaultDeletePollInterval
+	}
+	timeout := lbm.deletePollTimeout
+	if timeout == 0 {
+		timeout = defaultDeletePollTimeout
+	}
+
+	attempts := 0
+	defer func() {
+		trace.SpanFromContext(ctx).SetAttributes(attributeDeletePollAttempts.Int(attempts))
+	}()
+	err = wait.PollImmediate(interval, timeout, func() (bool, error) {
+		attempts++
+		_, err := lbm.getLoadBalancerByID(ctx, lb.ID)
+		if err == lbNotFound {
+			return true, nil
+		}
+
+		return false, err
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("lb %s still exists after deletion", lb.ID)
+	}
 
-	_, _, err = lbm.loadBalancerController.Delete(ctx, balancer.Ref())
 	return err
 }
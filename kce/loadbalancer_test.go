@@ -7,16 +7,22 @@ import (
 	"github.com/krystal/go-katapult"
 	"github.com/krystal/go-katapult/core"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	cloudprovider "k8s.io/cloud-provider"
 	"math"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 type mockLBController struct {
 	createdItems int
 	items        []core.LoadBalancer
+	ignoreDelete bool
 }
 
 func (lbc *mockLBController) List(_ context.Context, _ core.OrganizationRef, opts *core.ListOptions) ([]*core.LoadBalancer, *katapult.Response, error) {
@@ -55,10 +61,26 @@ func (lbc *mockLBController) List(_ context.Context, _ core.OrganizationRef, opt
 	}, nil
 }
 
+func (lbc *mockLBController) Get(_ context.Context, lb core.LoadBalancerRef) (*core.LoadBalancer, *katapult.Response, error) {
+	if lb.ID == "error" {
+		return nil, nil, fmt.Errorf("error getting %s", lb.ID)
+	}
+
+	for _, item := range lbc.items {
+		if item.ID == lb.ID {
+			return &item, &katapult.Response{}, nil
+		}
+	}
+
+	return nil, katapult.NewResponse(&http.Response{StatusCode: http.StatusNotFound}), fmt.Errorf("load_balancer_not_found")
+}
+
 func (lbc *mockLBController) Delete(_ context.Context, lb core.LoadBalancerRef) (*core.LoadBalancer, *katapult.Response, error) {
 	for i, item := range lbc.items {
 		if item.ID == lb.ID {
-			lbc.items = append(lbc.items[:i], lbc.items[i+1:]...)
+			if !lbc.ignoreDelete {
+				lbc.items = append(lbc.items[:i], lbc.items[i+1:]...)
+			}
 			return &item, &katapult.Response{}, nil
 		}
 	}
@@ -66,8 +88,20 @@ func (lbc *mockLBController) Delete(_ context.Context, lb core.LoadBalancerRef)
 	return nil, nil, fmt.Errorf("tried to delete non-existent element")
 }
 
-func (lbc *mockLBController) Update(ctx context.Context, lb core.LoadBalancerRef, args *core.LoadBalancerUpdateArguments) (*core.LoadBalancer, *katapult.Response, error) {
-	return nil, nil, fmt.Errorf("unimplemented")
+func (lbc *mockLBController) Update(_ context.Context, lb core.LoadBalancerRef, args *core.LoadBalancerUpdateArguments) (*core.LoadBalancer, *katapult.Response, error) {
+	for i, item := range lbc.items {
+		if item.ID == lb.ID {
+			item.Name = mergeString(args.Name, item.Name)
+			item.ResourceType = core.ResourceType(mergeString(string(args.ResourceType), string(item.ResourceType)))
+			if args.ResourceIDs != nil {
+				item.ResourceIDs = *args.ResourceIDs
+			}
+			lbc.items[i] = item
+			return &item, &katapult.Response{}, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("tried to update non-existent element")
 }
 
 func (lbc *mockLBController) Create(_ context.Context, _ core.OrganizationRef, args *core.LoadBalancerCreateArguments) (*core.LoadBalancer, *katapult.Response, error) {
@@ -454,6 +488,31 @@ func TestLoadBalancerManager_GetLoadBalancer(t *testing.T) {
 			}},
 			wantExists: true,
 		},
+		{
+			name: "exists with invalid annotations",
+			loadBalancers: []core.LoadBalancer{
+				{
+					Name:      "kce-test-test-service",
+					IPAddress: &core.IPAddress{Address: "10.0.0.1"},
+				},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-service",
+					Namespace: "default",
+					Annotations: map[string]string{
+						annotationLoadBalancerInternal: "yes",
+					},
+				},
+			},
+			wantStatus: &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+				{
+					IP: "10.0.0.1",
+				},
+			}},
+			wantExists: true,
+		},
 		{
 			name:        "nonexistent",
 			clusterName: "test",
@@ -482,6 +541,61 @@ func TestLoadBalancerManager_GetLoadBalancer(t *testing.T) {
 			wantExists: false,
 			wantErr:    "error from 0",
 		},
+		{
+			name: "adopted",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:        "lb_npORVDLVrf7MlghA",
+					Name:      "hand-built",
+					IPAddress: &core.IPAddress{Address: "10.0.0.2"},
+				},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-service",
+					Namespace: "default",
+					Annotations: map[string]string{
+						annotationLoadBalancerID: "lb_npORVDLVrf7MlghA",
+					},
+				},
+			},
+			wantStatus: &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+				{
+					IP: "10.0.0.2",
+				},
+			}},
+			wantExists: true,
+		},
+		{
+			name:        "adopted nonexistent",
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-service",
+					Namespace: "default",
+					Annotations: map[string]string{
+						annotationLoadBalancerID: "lb_npORVDLVrf7MlghA",
+					},
+				},
+			},
+			wantExists: false,
+		},
+		{
+			name:        "adopted error",
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-service",
+					Namespace: "default",
+					Annotations: map[string]string{
+						annotationLoadBalancerID: "error",
+					},
+				},
+			},
+			wantExists: false,
+			wantErr:    "error getting error",
+		},
 	}
 
 	for _, tt := range tests {
@@ -568,12 +682,17 @@ func TestLoadBalancerManager_EnsureLoadBalancerDeleted(t *testing.T) {
 	tests := []struct {
 		name string
 
-		loadBalancers []core.LoadBalancer
+		loadBalancers     []core.LoadBalancer
+		loadBalancerRules []core.LoadBalancerRule
+		// ignoreDelete simulates Katapult accepting a deletion but the load
+		// balancer continuing to exist.
+		ignoreDelete bool
 
 		clusterName string
 		service     *v1.Service
 
-		wantLoadBalancers []core.LoadBalancer
+		wantLoadBalancers     []core.LoadBalancer
+		wantLoadBalancerRules []core.LoadBalancerRule
 
 		wantErr string
 	}{
@@ -628,82 +747,218 @@ func TestLoadBalancerManager_EnsureLoadBalancerDeleted(t *testing.T) {
 			},
 			wantErr: "error from 0",
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			lbc := &mockLBController{items: tt.loadBalancers}
-			lbm := loadBalancerManager{
-				loadBalancerController: lbc,
-				log:                    logTest.TestLogger{T: t},
-			}
-
-			err := lbm.EnsureLoadBalancerDeleted(context.TODO(), tt.clusterName, tt.service)
-			assert.Equal(t, tt.wantLoadBalancers, lbc.items)
-			if tt.wantErr == "" {
-				assert.NoError(t, err)
-			} else {
-				assert.EqualError(t, err, tt.wantErr)
-			}
-		})
-	}
-}
-
-func TestLoadBalancerManager_tidyLoadBalancerRules(t *testing.T) {
-	// TODO: Cover error cases
-	tests := []struct {
-		name string
-
-		loadBalancerRules []core.LoadBalancerRule
-		loadBalancer      *core.LoadBalancer
-
-		service *v1.Service
-
-		wantLoadBalancerRules []core.LoadBalancerRule
-
-		wantErr string
-	}{
 		{
-			name: "correctly handles two rules",
-			loadBalancerRules: []core.LoadBalancerRule{
+			name: "retains adopted",
+			loadBalancers: []core.LoadBalancer{
 				{
-					ID:         "willbekept",
-					ListenPort: 133,
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						annotationLoadBalancerID: "lb_npORVDLVrf7MlghA",
+					},
 				},
+			},
+			wantLoadBalancers: []core.LoadBalancer{
 				{
-					ID:         "willbedeleted",
-					ListenPort: 1337,
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+		},
+		{
+			name: "deletes adopted with delete policy",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
 				},
 			},
+			clusterName: "test",
 			service: &v1.Service{
-				ObjectMeta: metav1.ObjectMeta{UID: "b5216b07-2cb4-4429-8294-23883301a01e"},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						annotationLoadBalancerID:             "lb_npORVDLVrf7MlghA",
+						annotationLoadBalancerDeletionPolicy: "delete",
+					},
+				},
+			},
+			wantLoadBalancers: []core.LoadBalancer{},
+		},
+		{
+			name: "retains with retain policy",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						annotationLoadBalancerDeletionPolicy: "retain",
+					},
+				},
+			},
+			wantLoadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "released-kce-test-bar-foo",
+				},
+			},
+		},
+		{
+			name: "ignores invalid annotations",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						annotationLoadBalancerInternal:     "yes",
+						annotationLoadBalancerPortRanges:   "true",
+						annotationLoadBalancerPortSettings: `{"http": {}}`,
+					},
+				},
 				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
-					{
-						Port: 133,
+					{Port: 10000, NodePort: 0},
+					{Port: 10001, NodePort: 0},
+				}},
+			},
+			wantLoadBalancers: []core.LoadBalancer{},
+		},
+		{
+			name: "ignores unknown port settings",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						annotationLoadBalancerPortSettings: `{"80": {"weight": 2}}`,
 					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+					{Port: 80, NodePort: 30080},
 				}},
 			},
-			loadBalancer: &core.LoadBalancer{},
-
-			wantLoadBalancerRules: []core.LoadBalancerRule{
+			wantLoadBalancers: []core.LoadBalancer{},
+		},
+		{
+			name: "retains with invalid deletion policy",
+			loadBalancers: []core.LoadBalancer{
 				{
-					ID:         "willbekept",
-					ListenPort: 133,
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						annotationLoadBalancerDeletionPolicy: "shred",
+					},
+				},
+			},
+			wantLoadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "released-kce-test-bar-foo",
+				},
+			},
+		},
+		{
+			name: "deletes rules",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+			loadBalancerRules: []core.LoadBalancerRule{
+				{ID: "lbrule_a", ListenPort: 80},
+				{ID: "lbrule_b", ListenPort: 443},
+				{ID: "lbrule_c", ListenPort: 8080},
+			},
+			clusterName: "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+				},
+			},
+			wantLoadBalancers:     []core.LoadBalancer{},
+			wantLoadBalancerRules: []core.LoadBalancerRule{},
+		},
+		{
+			name: "errors if lb still exists",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
+				},
+			},
+			ignoreDelete: true,
+			clusterName:  "test",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+				},
+			},
+			wantLoadBalancers: []core.LoadBalancer{
+				{
+					ID:   "lb_npORVDLVrf7MlghA",
+					Name: "kce-test-bar-foo",
 				},
 			},
+			wantErr: "lb lb_npORVDLVrf7MlghA still exists after deletion",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			lbc := &mockLBRController{items: tt.loadBalancerRules}
+			lbc := &mockLBController{
+				items:        tt.loadBalancers,
+				ignoreDelete: tt.ignoreDelete,
+			}
+			lbrc := &mockLBRController{items: tt.loadBalancerRules}
 			lbm := loadBalancerManager{
-				loadBalancerRuleController: lbc,
+				loadBalancerController:     lbc,
+				loadBalancerRuleController: lbrc,
+				deletePollInterval:         time.Millisecond,
+				deletePollTimeout:          10 * time.Millisecond,
 				log:                        logTest.TestLogger{T: t},
 			}
 
-			err := lbm.tidyLoadBalancerRules(context.TODO(), tt.service, tt.loadBalancer)
-			assert.Equal(t, tt.wantLoadBalancerRules, lbc.items)
+			err := lbm.EnsureLoadBalancerDeleted(context.TODO(), tt.clusterName, tt.service)
+			assert.Equal(t, tt.wantLoadBalancers, lbc.items)
+			assert.Equal(t, tt.wantLoadBalancerRules, lbrc.items)
 			if tt.wantErr == "" {
 				assert.NoError(t, err)
 			} else {
@@ -723,6 +978,8 @@ func TestLoadBalancerManager_ensureLoadBalancerRules(t *testing.T) {
 		service *v1.Service
 
 		wantLoadBalancerRules []core.LoadBalancerRule
+		wantManagedRules      string
+		wantEvents            []string
 
 		wantErr string
 	}{
@@ -780,19 +1037,342 @@ func TestLoadBalancerManager_ensureLoadBalancerRules(t *testing.T) {
 					CheckTimeout:    5,
 				},
 			},
+			wantManagedRules: `{"lb_npORVDLVrf7MlghA":[144,256]}`,
+			wantEvents:       []string{},
+		},
+		{
+			name: "leaves unmanaged rules",
+			loadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:              "lbrule_xICEvzBIgsjyHQQv",
+					ListenPort:      144,
+					DestinationPort: 132,
+				},
+			},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					UID: "b5216b07-2cb4-4429-8294-23883301a01e",
+					Annotations: map[string]string{
+						annotationLoadBalancerManagedRules: `{"lb_npORVDLVrf7MlghA":[]}`,
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+					{
+						Port:     144,
+						NodePort: 1337,
+					},
+				}},
+			},
+			loadBalancer: &core.LoadBalancer{
+				ID: "lb_npORVDLVrf7MlghA",
+			},
+
+			wantLoadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:              "lbrule_xICEvzBIgsjyHQQv",
+					ListenPort:      144,
+					DestinationPort: 132,
+				},
+			},
+			wantManagedRules: `{"lb_npORVDLVrf7MlghA":[]}`,
+			wantEvents: []string{
+				"Warning LoadBalancerRuleConflict Port 144 is not being served, load balancer lb_npORVDLVrf7MlghA already has a rule lbrule_xICEvzBIgsjyHQQv for it that was not created by kce-ccm",
+			},
+		},
+		{
+			name: "deletes unused rules",
+			loadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:         "willbekept",
+					ListenPort: 133,
+				},
+				{
+					ID:         "willbedeleted",
+					ListenPort: 1337,
+				},
+			},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					UID: "b5216b07-2cb4-4429-8294-23883301a01e",
+					Annotations: map[string]string{
+						annotationLoadBalancerManagedRules: `{"lb_npORVDLVrf7MlghA":[133,1337]}`,
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+					{
+						Port:     133,
+						NodePort: 30133,
+					},
+				}},
+			},
+			loadBalancer: &core.LoadBalancer{ID: "lb_npORVDLVrf7MlghA"},
+
+			wantLoadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:              "willbekept",
+					Algorithm:       core.RoundRobinRuleAlgorithm,
+					DestinationPort: 30133,
+					ListenPort:      133,
+					Protocol:        core.TCPProtocol,
+					CheckEnabled:    true,
+					CheckFall:       1,
+					CheckInterval:   10,
+					CheckProtocol:   core.TCPProtocol,
+					CheckRise:       1,
+					CheckTimeout:    5,
+				},
+			},
+			wantManagedRules: `{"lb_npORVDLVrf7MlghA":[133]}`,
+			wantEvents:       []string{},
+		},
+		{
+			name: "keeps unused unmanaged rules",
+			loadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:         "managed",
+					ListenPort: 133,
+				},
+				{
+					ID:         "unmanaged",
+					ListenPort: 1337,
+				},
+			},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					UID: "b5216b07-2cb4-4429-8294-23883301a01e",
+					Annotations: map[string]string{
+						annotationLoadBalancerManagedRules: `{"lb_npORVDLVrf7MlghA":[133]}`,
+					},
+				},
+			},
+			loadBalancer: &core.LoadBalancer{ID: "lb_npORVDLVrf7MlghA"},
+
+			wantLoadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:         "unmanaged",
+					ListenPort: 1337,
+				},
+			},
+			wantManagedRules: `{"lb_npORVDLVrf7MlghA":[]}`,
+			wantEvents:       []string{},
+		},
+		{
+			name: "keeps rules without a record",
+			loadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:         "unknown",
+					ListenPort: 1337,
+				},
+			},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{UID: "b5216b07-2cb4-4429-8294-23883301a01e"},
+			},
+			loadBalancer: &core.LoadBalancer{ID: "lb_npORVDLVrf7MlghA"},
+
+			wantLoadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:         "unknown",
+					ListenPort: 1337,
+				},
+			},
+			wantManagedRules: `{"lb_npORVDLVrf7MlghA":[]}`,
+			wantEvents:       []string{},
+		},
+		{
+			name: "leaves matching rules alone",
+			loadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:              "lbrule_xICEvzBIgsjyHQQv",
+					Algorithm:       core.RoundRobinRuleAlgorithm,
+					DestinationPort: 1337,
+					ListenPort:      144,
+					Protocol:        core.TCPProtocol,
+					CheckEnabled:    true,
+					CheckFall:       1,
+					CheckInterval:   10,
+					CheckProtocol:   core.TCPProtocol,
+					CheckRise:       1,
+					CheckTimeout:    5,
+					CheckPath:       "/set-by-hand",
+				},
+			},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{UID: "b5216b07-2cb4-4429-8294-23883301a01e"},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+					{
+						Port:     144,
+						NodePort: 1337,
+					},
+				}},
+			},
+			loadBalancer: &core.LoadBalancer{ID: "lb_npORVDLVrf7MlghA"},
+
+			wantLoadBalancerRules: []core.LoadBalancerRule{
+				{
+					ID:              "lbrule_xICEvzBIgsjyHQQv",
+					Algorithm:       core.RoundRobinRuleAlgorithm,
+					DestinationPort: 1337,
+					ListenPort:      144,
+					Protocol:        core.TCPProtocol,
+					CheckEnabled:    true,
+					CheckFall:       1,
+					CheckInterval:   10,
+					CheckProtocol:   core.TCPProtocol,
+					CheckRise:       1,
+					CheckTimeout:    5,
+					CheckPath:       "/set-by-hand",
+				},
+			},
+			wantManagedRules: `{"lb_npORVDLVrf7MlghA":[144]}`,
+			wantEvents:       []string{},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			lbc := &mockLBRController{items: tt.loadBalancerRules}
+			recorder := record.NewFakeRecorder(10)
 			lbm := loadBalancerManager{
 				loadBalancerRuleController: lbc,
 				log:                        logTest.TestLogger{T: t},
+				recorder:                   recorder,
 			}
 
-			err := lbm.ensureLoadBalancerRules(context.TODO(), tt.service, tt.loadBalancer)
+			rules := newRuleRecord(tt.service)
+			err := lbm.ensureLoadBalancerRules(context.TODO(), tt.service, tt.loadBalancer, &loadBalancerOptions{}, rules)
 			assert.Equal(t, tt.wantLoadBalancerRules, lbc.items)
+			assert.Equal(t, tt.wantManagedRules, rules.value())
+			assert.Equal(t, tt.wantEvents, drainEvents(recorder))
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerManager_reconcileLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name string
+
+		loadBalancer *core.LoadBalancer
+		target       loadBalancerTarget
+		// notInAPI simulates the load balancer being removed before the
+		// update is made.
+		notInAPI bool
+
+		want       *core.LoadBalancer
+		wantEvents []string
+		wantErr    string
+	}{
+		{
+			name: "no drift",
+			loadBalancer: &core.LoadBalancer{
+				ID:           "lb_npORVDLVrf7MlghA",
+				Name:         "kce-example-bar",
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"tag_a"},
+			},
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"tag_a"},
+			},
+			want: &core.LoadBalancer{
+				ID:           "lb_npORVDLVrf7MlghA",
+				Name:         "kce-example-bar",
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"tag_a"},
+			},
+			wantEvents: []string{},
+		},
+		{
+			name: "resource ids drifted",
+			loadBalancer: &core.LoadBalancer{
+				ID:           "lb_npORVDLVrf7MlghA",
+				Name:         "kce-example-bar",
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"tag_b"},
+			},
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"tag_a"},
+			},
+			want: &core.LoadBalancer{
+				ID:           "lb_npORVDLVrf7MlghA",
+				Name:         "kce-example-bar",
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"tag_a"},
+			},
+			wantEvents: []string{
+				"Normal LoadBalancerDriftCorrected Reverted changes to load balancer lb_npORVDLVrf7MlghA: resourceIds",
+			},
+		},
+		{
+			name: "everything drifted",
+			loadBalancer: &core.LoadBalancer{
+				ID:           "lb_npORVDLVrf7MlghA",
+				Name:         "renamed-in-ui",
+				ResourceType: core.VirtualMachinesResourceType,
+				ResourceIDs:  []string{"vm_a"},
+			},
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"tag_a"},
+			},
+			want: &core.LoadBalancer{
+				ID:           "lb_npORVDLVrf7MlghA",
+				Name:         "kce-example-bar",
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"tag_a"},
+			},
+			wantEvents: []string{
+				"Normal LoadBalancerDriftCorrected Reverted changes to load balancer lb_npORVDLVrf7MlghA: name, resourceType, resourceIds",
+			},
+		},
+		{
+			name: "update error",
+			loadBalancer: &core.LoadBalancer{
+				ID:   "lb_npORVDLVrf7MlghA",
+				Name: "kce-example-bar",
+			},
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"tag_a"},
+			},
+			notInAPI:   true,
+			wantEvents: []string{},
+			wantErr:    "tried to update non-existent element",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lbc := &mockLBController{}
+			if !tt.notInAPI {
+				lbc.items = []core.LoadBalancer{*tt.loadBalancer}
+			}
+			recorder := record.NewFakeRecorder(10)
+			lbm := loadBalancerManager{
+				loadBalancerController: lbc,
+				recorder:               recorder,
+				log:                    logTest.TestLogger{T: t},
+			}
+
+			got, err := lbm.reconcileLoadBalancer(
+				context.TODO(),
+				&v1.Service{},
+				tt.loadBalancer,
+				"kce-example-bar",
+				tt.target,
+			)
+			assert.Equal(t, tt.want, got)
+			close(recorder.Events)
+			gotEvents := []string{}
+			for event := range recorder.Events {
+				gotEvents = append(gotEvents, event)
+			}
+			assert.Equal(t, tt.wantEvents, gotEvents)
 			if tt.wantErr == "" {
 				assert.NoError(t, err)
 			} else {
@@ -819,9 +1399,11 @@ func TestLoadBalancerManager_EnsureLoadBalancer(t *testing.T) {
 			name: "uses existing LB",
 			loadBalancers: []core.LoadBalancer{
 				{
-					ID:        "lb_npORVDLVrf7MlghA",
-					Name:      "kce-example-foobar-bar",
-					IPAddress: &core.IPAddress{Address: "133.7.42.0"},
+					ID:           "lb_npORVDLVrf7MlghA",
+					Name:         "kce-example-foobar-bar",
+					IPAddress:    &core.IPAddress{Address: "133.7.42.0"},
+					ResourceType: core.VirtualMachineGroupsResourceType,
+					ResourceIDs:  []string{"node-tag-id"},
 				},
 			},
 			service: &v1.Service{
@@ -839,12 +1421,151 @@ func TestLoadBalancerManager_EnsureLoadBalancer(t *testing.T) {
 			}},
 			wantLoadBalancers: []core.LoadBalancer{
 				{
-					ID:        "lb_npORVDLVrf7MlghA",
-					Name:      "kce-example-foobar-bar",
-					IPAddress: &core.IPAddress{Address: "133.7.42.0"},
+					ID:           "lb_npORVDLVrf7MlghA",
+					Name:         "kce-example-foobar-bar",
+					IPAddress:    &core.IPAddress{Address: "133.7.42.0"},
+					ResourceType: core.VirtualMachineGroupsResourceType,
+					ResourceIDs:  []string{"node-tag-id"},
+				},
+			},
+		},
+		{
+			name: "updates existing LB target",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:           "lb_npORVDLVrf7MlghA",
+					Name:         "kce-example-foobar-bar",
+					IPAddress:    &core.IPAddress{Address: "133.7.42.0"},
+					ResourceType: core.VirtualMachineGroupsResourceType,
+					ResourceIDs:  []string{"node-tag-id"},
+				},
+			},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "bar",
+					Namespace: "foobar",
+					Annotations: map[string]string{
+						annotationLoadBalancerTagID: "tag_Y1VhjfZDaM4pM6GT",
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{}},
+			},
+
+			wantStatus: &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+				{
+					IP: "133.7.42.0",
+				},
+			}},
+			wantLoadBalancers: []core.LoadBalancer{
+				{
+					ID:           "lb_npORVDLVrf7MlghA",
+					Name:         "kce-example-foobar-bar",
+					IPAddress:    &core.IPAddress{Address: "133.7.42.0"},
+					ResourceType: core.TagsResourceType,
+					ResourceIDs:  []string{"tag_Y1VhjfZDaM4pM6GT"},
+				},
+			},
+		},
+		{
+			name:          "create lb targeting vm groups",
+			loadBalancers: []core.LoadBalancer{},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "bar",
+					Namespace: "foobar",
+					Annotations: map[string]string{
+						annotationLoadBalancerVMGroupIDs: "vmgrp_ingress",
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{}},
+			},
+
+			wantStatus: &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+				{
+					IP: "10.0.0.0",
+				},
+			}},
+			wantLoadBalancers: []core.LoadBalancer{
+				{
+					ID:           "created-0",
+					Name:         "kce-example-foobar-bar",
+					IPAddress:    &core.IPAddress{Address: "10.0.0.0"},
+					ResourceType: core.VirtualMachineGroupsResourceType,
+					ResourceIDs:  []string{"vmgrp_ingress"},
+				},
+			},
+		},
+		{
+			name:          "unknown vm group",
+			loadBalancers: []core.LoadBalancer{},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "bar",
+					Namespace: "foobar",
+					Annotations: map[string]string{
+						annotationLoadBalancerVMGroupIDs: "vmgrp_missing",
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{}},
+			},
+
+			wantLoadBalancers: []core.LoadBalancer{},
+			wantErr:           `virtual machine group "vmgrp_missing" does not exist`,
+		},
+		{
+			name: "adopts existing LB",
+			loadBalancers: []core.LoadBalancer{
+				{
+					ID:           "lb_npORVDLVrf7MlghA",
+					Name:         "hand-built",
+					IPAddress:    &core.IPAddress{Address: "133.7.42.0"},
+					ResourceType: core.VirtualMachineGroupsResourceType,
+					ResourceIDs:  []string{"node-tag-id"},
+				},
+			},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "bar",
+					Namespace: "foobar",
+					Annotations: map[string]string{
+						annotationLoadBalancerID: "lb_npORVDLVrf7MlghA",
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{}},
+			},
+
+			wantStatus: &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+				{
+					IP: "133.7.42.0",
+				},
+			}},
+			wantLoadBalancers: []core.LoadBalancer{
+				{
+					ID:           "lb_npORVDLVrf7MlghA",
+					Name:         "hand-built",
+					IPAddress:    &core.IPAddress{Address: "133.7.42.0"},
+					ResourceType: core.VirtualMachineGroupsResourceType,
+					ResourceIDs:  []string{"node-tag-id"},
 				},
 			},
 		},
+		{
+			name:          "adopted LB missing",
+			loadBalancers: []core.LoadBalancer{},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "bar",
+					Namespace: "foobar",
+					Annotations: map[string]string{
+						annotationLoadBalancerID: "lb_npORVDLVrf7MlghA",
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{}},
+			},
+
+			wantLoadBalancers: []core.LoadBalancer{},
+			wantErr:           "load balancer lb_npORVDLVrf7MlghA to adopt was not found",
+		},
 		{
 			name:          "create lb",
 			loadBalancers: []core.LoadBalancer{},
@@ -871,6 +1592,41 @@ func TestLoadBalancerManager_EnsureLoadBalancer(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:          "internal lb unsupported",
+			loadBalancers: []core.LoadBalancer{},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "bar",
+					Namespace: "foobar",
+					Annotations: map[string]string{
+						annotationLoadBalancerInternal:       "true",
+						annotationLoadBalancerVirtualNetwork: "vnet_rNVw1X7iu4ll3xXT",
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{}},
+			},
+
+			wantLoadBalancers: []core.LoadBalancer{},
+			wantErr:           "kce.krystal.uk/load-balancer-internal is unsupported: internal load balancers are not supported by the katapult api",
+		},
+		{
+			name:          "invalid annotations",
+			loadBalancers: []core.LoadBalancer{},
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "bar",
+					Namespace: "foobar",
+					Annotations: map[string]string{
+						annotationLoadBalancerInternal: "yes",
+					},
+				},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{}},
+			},
+
+			wantLoadBalancers: []core.LoadBalancer{},
+			wantErr:           `invalid value for kce.krystal.uk/load-balancer-internal: strconv.ParseBool: parsing "yes": invalid syntax`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -881,7 +1637,10 @@ func TestLoadBalancerManager_EnsureLoadBalancer(t *testing.T) {
 				config:                     Config{NodeTagID: "node-tag-id"},
 				loadBalancerController:     lbc,
 				loadBalancerRuleController: lbrc,
-				log:                        logTest.TestLogger{T: t},
+				virtualMachineGroupController: &mockVMGroupController{
+					items: []*core.VirtualMachineGroup{{ID: "vmgrp_ingress"}},
+				},
+				log: logTest.TestLogger{T: t},
 			}
 
 			status, err := lbm.EnsureLoadBalancer(context.TODO(), "example", tt.service, []*v1.Node{})
@@ -905,4 +1664,142 @@ func TestLoadBalancerManager_UpdateLoadBalancer(t *testing.T) {
 			[]*v1.Node{},
 		),
 	)
+
+	otherClass := "metallb"
+	assert.Equal(t,
+		cloudprovider.ImplementedElsewhere,
+		(&loadBalancerManager{}).UpdateLoadBalancer(
+			context.TODO(),
+			"",
+			&v1.Service{Spec: v1.ServiceSpec{LoadBalancerClass: &otherClass}},
+			[]*v1.Node{},
+		),
+	)
+}
+
+func TestLoadBalancerManager_UpdateLoadBalancerNodes(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	lbm.config.ExtraDataCenters = map[string]string{"dc_other": "tag_other"}
+	service := fakeKatapultService(80)
+	service.Annotations = map[string]string{
+		annotationLoadBalancerDataCenters: selectDataCentersFromNodes,
+	}
+	kube := withFakeCluster(lbm, service)
+	ctx := context.Background()
+
+	node := func(dc string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{v1.LabelTopologyRegion: dc},
+		}}
+	}
+	names := func() []string {
+		names := []string{}
+		for _, lb := range s.LoadBalancers() {
+			names = append(names, lb.Name)
+		}
+		return names
+	}
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", service, []*v1.Node{node("dc_fake")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"kce-kce-web"}, names())
+
+	// A node joining another data center adds a load balancer there.
+	service = recorded(t, kube, service)
+	err = lbm.UpdateLoadBalancer(ctx, "kce", service, []*v1.Node{node("dc_fake"), node("dc_other")})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"kce-kce-web", "kce-kce-web-dc_other"}, names())
+
+	// And the last node leaving a data center removes it again.
+	service = recorded(t, kube, service)
+	err = lbm.UpdateLoadBalancer(ctx, "kce", service, []*v1.Node{node("dc_other")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"kce-kce-web-dc_other"}, names())
+}
+
+func TestLoadBalancerManager_handlesService(t *testing.T) {
+	class := "metallb"
+	lbm := loadBalancerManager{}
+
+	assert.True(t, lbm.handlesService(&v1.Service{}))
+	assert.False(t, lbm.handlesService(&v1.Service{
+		Spec: v1.ServiceSpec{LoadBalancerClass: &class},
+	}))
+}
+
+func TestLoadBalancerManager_otherLoadBalancerClass(t *testing.T) {
+	otherClass := "metallb"
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bar",
+			Namespace: "foobar",
+		},
+		Spec: v1.ServiceSpec{LoadBalancerClass: &otherClass},
+	}
+	lbc := &mockLBController{items: []core.LoadBalancer{
+		{
+			ID:        "lb_npORVDLVrf7MlghA",
+			Name:      "kce-example-foobar-bar",
+			IPAddress: &core.IPAddress{Address: "133.7.42.0"},
+		},
+	}}
+	lbm := loadBalancerManager{
+		loadBalancerController: lbc,
+		log:                    logTest.TestLogger{T: t},
+	}
+
+	// A load balancer created before the service was given a class is still
+	// found, so that the service controller cleans it up.
+	status, exists, err := lbm.GetLoadBalancer(context.TODO(), "example", service)
+	assert.Equal(t, "133.7.42.0", status.Ingress[0].IP)
+	assert.True(t, exists)
+	assert.NoError(t, err)
+
+	status, err = lbm.EnsureLoadBalancer(context.TODO(), "example", service, []*v1.Node{})
+	assert.Nil(t, status)
+	assert.Equal(t, cloudprovider.ImplementedElsewhere, err)
+}
+
+func TestLoadBalancerManager_releaseAndReclaim(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	ctx := context.Background()
+
+	service := fakeKatapultService(80)
+	service.Annotations = map[string]string{
+		annotationLoadBalancerDeletionPolicy: "retain",
+	}
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	lb := lbs[0]
+
+	// Releasing the load balancer renames it, so that it is no longer owned
+	// by the cluster once its service has gone.
+	require.NoError(t, lbm.EnsureLoadBalancerDeleted(ctx, "kce", service))
+	lbs = s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	assert.Equal(t, "released-kce-kce-web", lbs[0].Name)
+	assert.Len(t, s.LoadBalancerRules(lb.ID), 1)
+
+	owned, err := lbm.ownedLoadBalancers(ctx, "kce", nil)
+	require.NoError(t, err)
+	assert.Empty(t, owned)
+
+	_, exists, err := lbm.GetLoadBalancer(ctx, "kce", service)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Releasing it again does nothing, as it is no longer found.
+	require.NoError(t, lbm.EnsureLoadBalancerDeleted(ctx, "kce", service))
+	assert.Equal(t, "released-kce-kce-web", s.LoadBalancers()[0].Name)
+
+	// A service with the same name reclaims it, keeping its address.
+	status, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80), nil)
+	require.NoError(t, err)
+	lbs = s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	assert.Equal(t, lb.ID, lbs[0].ID)
+	assert.Equal(t, "kce-kce-web", lbs[0].Name)
+	assert.Equal(t, lb.IPAddress.Address, status.Ingress[0].IP)
 }
@@ -0,0 +1,93 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/krystal/go-katapult"
+	v1 "k8s.io/api/core/v1"
+	logsjson "k8s.io/component-base/logs/json"
+	"k8s.io/klog/v2/klogr"
+)
+
+// Keys used in structured logs. Every call site should use these so that a
+// single reconcile can be traced end to end.
+const (
+	logKeyOperation        = "operation"
+	logKeyClusterName      = "clusterName"
+	logKeyServiceNamespace = "serviceNamespace"
+	logKeyServiceName      = "serviceName"
+	logKeyServiceUID       = "serviceUid"
+	logKeyLoadBalancerID   = "loadBalancerId"
+	logKeyRuleID           = "ruleId"
+	logKeyDataCenterID     = "dataCenterId"
+	logKeyNodeName         = "nodeName"
+	logKeyVirtualMachineID = "vmId"
+	logKeyRequestID        = "requestId"
+)
+
+// katapultRequestIDHeader is the response header holding the ID Katapult
+// assigned to a request.
+const katapultRequestIDHeader = "X-Request-ID"
+
+type logFormat string
+
+const (
+	logFormatText logFormat = "text"
+	logFormatJSON logFormat = "json"
+)
+
+func parseLogFormat(v string) (logFormat, error) {
+	switch logFormat(v) {
+	case logFormatText, logFormatJSON:
+		return logFormat(v), nil
+	}
+
+	return "", fmt.Errorf(`must be "text" or "json"`)
+}
+
+// newLogger creates the root logger for the provider in the given format.
+func newLogger(format logFormat) logr.Logger {
+	if format == logFormatJSON {
+		return logsjson.JSONLogger
+	}
+
+	return klogr.NewWithOptions(klogr.WithFormat(klogr.FormatKlog))
+}
+
+// withLogger returns a context carrying a logger for a single cloudprovider
+// call against a service.
+func withLogger(ctx context.Context, log logr.Logger, operation, clusterName string, service *v1.Service) (context.Context, logr.Logger) {
+	log = log.WithValues(
+		logKeyOperation, operation,
+		logKeyClusterName, clusterName,
+		logKeyServiceNamespace, service.Namespace,
+		logKeyServiceName, service.Name,
+		logKeyServiceUID, service.UID,
+	)
+
+	return logr.NewContext(ctx, log), log
+}
+
+// loggerFrom returns the logger carried by ctx, or fallback if there is none.
+func loggerFrom(ctx context.Context, fallback logr.Logger) logr.Logger {
+	if log := logr.FromContext(ctx); log != nil {
+		return log
+	}
+
+	return fallback
+}
+
+// withRequestID adds the Katapult request ID from a response to a logger.
+func withRequestID(log logr.Logger, resp *katapult.Response) logr.Logger {
+	if resp == nil || resp.Response == nil {
+		return log
+	}
+
+	id := resp.Header.Get(katapultRequestIDHeader)
+	if id == "" {
+		return log
+	}
+
+	return log.WithValues(logKeyRequestID, id)
+}
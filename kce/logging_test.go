@@ -0,0 +1,74 @@
+package kce
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/krystal/go-katapult"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"testing"
+)
+
+// recordingLogger captures the key/value pairs attached to it so tests can
+// check what context a log line would carry.
+type recordingLogger struct {
+	logr.Logger
+	values []interface{}
+}
+
+func (l *recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return &recordingLogger{
+		values: append(append([]interface{}{}, l.values...), keysAndValues...),
+	}
+}
+
+func Test_parseLogFormat(t *testing.T) {
+	got, err := parseLogFormat("json")
+	assert.NoError(t, err)
+	assert.Equal(t, logFormatJSON, got)
+
+	got, err = parseLogFormat("text")
+	assert.NoError(t, err)
+	assert.Equal(t, logFormatText, got)
+
+	_, err = parseLogFormat("xml")
+	assert.EqualError(t, err, `must be "text" or "json"`)
+}
+
+func Test_withLogger(t *testing.T) {
+	root := &recordingLogger{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bar",
+			Namespace: "foobar",
+			UID:       types.UID("a-uid"),
+		},
+	}
+
+	ctx, log := withLogger(context.TODO(), root, "EnsureLoadBalancer", "example", service)
+	assert.Equal(t, []interface{}{
+		"operation", "EnsureLoadBalancer",
+		"clusterName", "example",
+		"serviceNamespace", "foobar",
+		"serviceName", "bar",
+		"serviceUid", types.UID("a-uid"),
+	}, log.(*recordingLogger).values)
+	assert.Equal(t, log, loggerFrom(ctx, root))
+	assert.Equal(t, root, loggerFrom(context.TODO(), root))
+}
+
+func Test_withRequestID(t *testing.T) {
+	root := &recordingLogger{}
+
+	assert.Equal(t, root, withRequestID(root, nil))
+	assert.Equal(t, root, withRequestID(root, katapult.NewResponse(nil)))
+
+	resp := katapult.NewResponse(&http.Response{
+		Header: http.Header{"X-Request-Id": []string{"req-123"}},
+	})
+	log := withRequestID(root, resp)
+	assert.Equal(t, []interface{}{"requestId", "req-123"}, log.(*recordingLogger).values)
+}
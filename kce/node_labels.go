@@ -0,0 +1,134 @@
+package kce
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-logr/logr"
+	"github.com/krystal/go-katapult/core"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+const (
+	labelVirtualMachineID      = annotationPrefix + "vm-rid"
+	labelVirtualMachinePackage = annotationPrefix + "vm-package"
+
+	// labelTagPrefix is followed by the name of each Katapult tag on the
+	// node's VM. Label values cannot hold a list, so rather than a single
+	// kce.krystal.uk/tags label, each tag gets a label of its own.
+	labelTagPrefix = annotationPrefix + "tag-"
+)
+
+// nodeLabelController keeps labels describing each node's Katapult VM in
+// sync, so that workloads can be scheduled on a hardware class or tag.
+type nodeLabelController struct {
+	log       logr.Logger
+	client    kubernetes.Interface
+	instances *instancesManager
+	interval  time.Duration
+}
+
+// Run syncs node labels every interval until stop is closed.
+func (nlc *nodeLabelController) Run(stop <-chan struct{}) {
+	wait.Until(func() {
+		if err := nlc.sync(context.Background()); err != nil {
+			nlc.log.Error(err, "failed to sync node labels")
+		}
+	}, nlc.interval, stop)
+}
+
+// sync updates the labels of every node. A failure for one node does not stop
+// the others from being updated.
+func (nlc *nodeLabelController) sync(ctx context.Context) error {
+	nodes, err := nlc.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if err := nlc.syncNode(ctx, node); err != nil {
+			nlc.log.Error(err, "failed to sync node labels",
+				logKeyNodeName, node.Name,
+			)
+		}
+	}
+
+	return nil
+}
+
+func (nlc *nodeLabelController) syncNode(ctx context.Context, node *v1.Node) error {
+	vm, err := nlc.instances.getVirtualMachine(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	// Only the labels that have changed are patched, with removed labels set
+	// to null, so that labels set by anything else are never overwritten.
+	labels := map[string]interface{}{}
+	want := virtualMachineLabels(vm)
+	for k := range node.Labels {
+		if _, ok := want[k]; !ok && isVirtualMachineLabel(k) {
+			labels[k] = nil
+		}
+	}
+	for k, v := range want {
+		if current, ok := node.Labels[k]; !ok || current != v {
+			labels[k] = v
+		}
+	}
+
+	if len(labels) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	nlc.log.Info("updating node labels",
+		logKeyNodeName, node.Name,
+		logKeyVirtualMachineID, vm.ID,
+	)
+	_, err = nlc.client.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// isVirtualMachineLabel returns true for labels managed by the controller.
+func isVirtualMachineLabel(key string) bool {
+	return key == labelVirtualMachineID ||
+		key == labelVirtualMachinePackage ||
+		strings.HasPrefix(key, labelTagPrefix)
+}
+
+// virtualMachineLabels builds the labels for a VM. Tags whose names cannot be
+// used in a label key are skipped.
+func virtualMachineLabels(vm *core.VirtualMachine) map[string]string {
+	labels := map[string]string{
+		labelVirtualMachineID: vm.ID,
+	}
+	if vm.Package != nil && vm.Package.Permalink != "" {
+		labels[labelVirtualMachinePackage] = vm.Package.Permalink
+	}
+
+	for _, tag := range vm.Tags {
+		key := labelTagPrefix + tag.Name
+		if len(validation.IsQualifiedName(key)) > 0 {
+			continue
+		}
+		labels[key] = "true"
+	}
+
+	return labels
+}
@@ -0,0 +1,140 @@
+package kce
+
+import (
+	"context"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func Test_virtualMachineLabels(t *testing.T) {
+	got := virtualMachineLabels(&core.VirtualMachine{
+		ID:      "vm_worker",
+		Package: &core.VirtualMachinePackage{Permalink: "rock-3"},
+		Tags: []*core.Tag{
+			{Name: "gpu"},
+			{Name: "has spaces"},
+		},
+	})
+
+	assert.Equal(t, map[string]string{
+		"kce.krystal.uk/vm-rid":     "vm_worker",
+		"kce.krystal.uk/vm-package": "rock-3",
+		"kce.krystal.uk/tag-gpu":    "true",
+	}, got)
+}
+
+func TestNodeLabelController_sync(t *testing.T) {
+	tests := []struct {
+		name      string
+		node      *v1.Node
+		vm        core.VirtualMachine
+		want      map[string]string
+		wantPatch bool
+	}{
+		{
+			name: "adds labels",
+			node: &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "worker-1",
+					Labels: map[string]string{"app": "web"},
+				},
+				Spec: v1.NodeSpec{ProviderID: "kce://vm_worker"},
+			},
+			vm: core.VirtualMachine{
+				ID:      "vm_worker",
+				Package: &core.VirtualMachinePackage{Permalink: "rock-3"},
+				Tags:    []*core.Tag{{Name: "gpu"}},
+			},
+			want: map[string]string{
+				"app":                       "web",
+				"kce.krystal.uk/vm-rid":     "vm_worker",
+				"kce.krystal.uk/vm-package": "rock-3",
+				"kce.krystal.uk/tag-gpu":    "true",
+			},
+			wantPatch: true,
+		},
+		{
+			name: "updates resized and retagged vm",
+			node: &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "worker-1",
+					Labels: map[string]string{
+						"kce.krystal.uk/vm-rid":     "vm_worker",
+						"kce.krystal.uk/vm-package": "rock-3",
+						"kce.krystal.uk/tag-gpu":    "true",
+					},
+				},
+				Spec: v1.NodeSpec{ProviderID: "kce://vm_worker"},
+			},
+			vm: core.VirtualMachine{
+				ID:      "vm_worker",
+				Package: &core.VirtualMachinePackage{Permalink: "rock-6"},
+				Tags:    []*core.Tag{{Name: "ingress"}},
+			},
+			want: map[string]string{
+				"kce.krystal.uk/vm-rid":      "vm_worker",
+				"kce.krystal.uk/vm-package":  "rock-6",
+				"kce.krystal.uk/tag-ingress": "true",
+			},
+			wantPatch: true,
+		},
+		{
+			name: "leaves unchanged node alone",
+			node: &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "worker-1",
+					Labels: map[string]string{
+						"kce.krystal.uk/vm-rid": "vm_worker",
+					},
+				},
+				Spec: v1.NodeSpec{ProviderID: "kce://vm_worker"},
+			},
+			vm: core.VirtualMachine{ID: "vm_worker"},
+			want: map[string]string{
+				"kce.krystal.uk/vm-rid": "vm_worker",
+			},
+		},
+		{
+			name: "skips node without vm",
+			node: &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+				Spec:       v1.NodeSpec{ProviderID: "kce://vm_missing"},
+			},
+			vm: core.VirtualMachine{ID: "vm_worker"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.node)
+			nlc := nodeLabelController{
+				log:    logTest.TestLogger{T: t},
+				client: client,
+				instances: &instancesManager{
+					virtualMachineController: &mockVMController{items: []core.VirtualMachine{tt.vm}},
+				},
+			}
+
+			err := nlc.sync(context.TODO())
+			assert.NoError(t, err)
+
+			node, err := client.CoreV1().Nodes().Get(context.TODO(), tt.node.Name, metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, node.Labels)
+
+			patched := false
+			for _, action := range client.Actions() {
+				assert.NotEqual(t, "update", action.GetVerb())
+				if action.GetVerb() == "patch" {
+					patched = true
+				}
+			}
+			assert.Equal(t, tt.wantPatch, patched)
+		})
+	}
+}
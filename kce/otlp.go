@@ -0,0 +1,214 @@
+package kce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// otlpExporter sends spans to a collector using OTLP/HTTP with JSON encoding.
+// The upstream OTLP exporters depend on a newer grpc than the version the
+// cloud-provider libraries are pinned to, so we encode the requests ourselves.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: http.DefaultClient,
+	}
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// OTLP status codes differ from the otel API's codes.
+var otlpStatusCodes = map[codes.Code]int{
+	codes.Unset: 0,
+	codes.Ok:    1,
+	codes.Error: 2,
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		v := otlpValue{}
+		switch attr.Value.Type() {
+		case attribute.BOOL:
+			b := attr.Value.AsBool()
+			v.BoolValue = &b
+		case attribute.INT64:
+			i := strconv.FormatInt(attr.Value.AsInt64(), 10)
+			v.IntValue = &i
+		case attribute.FLOAT64:
+			f := attr.Value.AsFloat64()
+			v.DoubleValue = &f
+		default:
+			s := attr.Value.Emit()
+			v.StringValue = &s
+		}
+		out = append(out, otlpKeyValue{Key: string(attr.Key), Value: v})
+	}
+
+	return out
+}
+
+func otlpSpanFrom(span sdktrace.ReadOnlySpan) otlpSpan {
+	out := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime().UnixNano(), 10),
+		Attributes:        otlpAttributes(span.Attributes()),
+		Status: otlpStatus{
+			Code:    otlpStatusCodes[span.Status().Code],
+			Message: span.Status().Description,
+		},
+	}
+	if span.Parent().HasSpanID() {
+		out.ParentSpanID = span.Parent().SpanID().String()
+	}
+
+	return out
+}
+
+// tracesRequest groups spans by resource and instrumentation library.
+func tracesRequest(spans []sdktrace.ReadOnlySpan) otlpTracesRequest {
+	req := otlpTracesRequest{ResourceSpans: []otlpResourceSpans{}}
+
+	for _, span := range spans {
+		var attrs []otlpKeyValue
+		if span.Resource() != nil {
+			attrs = otlpAttributes(span.Resource().Attributes())
+		}
+		scope := otlpScope{
+			Name:    span.InstrumentationLibrary().Name,
+			Version: span.InstrumentationLibrary().Version,
+		}
+
+		var rs *otlpResourceSpans
+		for i := range req.ResourceSpans {
+			if fmt.Sprint(req.ResourceSpans[i].Resource.Attributes) == fmt.Sprint(attrs) {
+				rs = &req.ResourceSpans[i]
+				break
+			}
+		}
+		if rs == nil {
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: attrs},
+			})
+			rs = &req.ResourceSpans[len(req.ResourceSpans)-1]
+		}
+
+		var ss *otlpScopeSpans
+		for i := range rs.ScopeSpans {
+			if rs.ScopeSpans[i].Scope == scope {
+				ss = &rs.ScopeSpans[i]
+				break
+			}
+		}
+		if ss == nil {
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{Scope: scope})
+			ss = &rs.ScopeSpans[len(rs.ScopeSpans)-1]
+		}
+
+		ss.Spans = append(ss.Spans, otlpSpanFrom(span))
+	}
+
+	return req
+}
+
+// ExportSpans sends a batch of spans to the collector.
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(tracesRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Shutdown has nothing to release, as requests are not kept open.
+func (e *otlpExporter) Shutdown(_ context.Context) error {
+	return nil
+}
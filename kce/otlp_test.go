@@ -0,0 +1,67 @@
+package kce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOTLPExporter_ExportSpans(t *testing.T) {
+	var got otlpTracesRequest
+	var gotPath, gotContentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotContentType = r.Header.Get("Content-Type")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer srv.Close()
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(newOTLPExporter(srv.URL + "/")))
+	tracer := tp.Tracer(tracerName)
+	ctx, parent := tracer.Start(context.Background(), "LoadBalancer.EnsureLoadBalancer")
+	_, child := tracer.Start(ctx, "katapult.LoadBalancers.Create", trace.WithSpanKind(trace.SpanKindClient))
+	child.SetAttributes(attributeHTTPStatusCode.Int(422))
+	endSpan(child, fmt.Errorf("validation_error"))
+
+	assert.Equal(t, "/v1/traces", gotPath)
+	assert.Equal(t, "application/json", gotContentType)
+	require.Len(t, got.ResourceSpans, 1)
+	require.Len(t, got.ResourceSpans[0].ScopeSpans, 1)
+	assert.Equal(t, tracerName, got.ResourceSpans[0].ScopeSpans[0].Scope.Name)
+	require.Len(t, got.ResourceSpans[0].ScopeSpans[0].Spans, 1)
+
+	span := got.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "katapult.LoadBalancers.Create", span.Name)
+	assert.Equal(t, parent.SpanContext().TraceID().String(), span.TraceID)
+	assert.Equal(t, parent.SpanContext().SpanID().String(), span.ParentSpanID)
+	assert.Equal(t, int(trace.SpanKindClient), span.Kind)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "validation_error"}, span.Status)
+	status := "422"
+	assert.Contains(t, span.Attributes, otlpKeyValue{
+		Key:   "http.status_code",
+		Value: otlpValue{IntValue: &status},
+	})
+}
+
+func TestOTLPExporter_ExportSpans_collectorError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	tp := sdktrace.NewTracerProvider()
+	_, span := tp.Tracer(tracerName).Start(context.Background(), "Clusters.ListClusters")
+	span.End()
+
+	err := newOTLPExporter(srv.URL).ExportSpans(context.Background(),
+		[]sdktrace.ReadOnlySpan{span.(sdktrace.ReadOnlySpan)},
+	)
+	assert.EqualError(t, err, "collector returned status 503")
+}
@@ -0,0 +1,121 @@
+package kce
+
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"sort"
+	"strings"
+)
+
+// portRange is a run of consecutive service ports whose node ports are also
+// consecutive, such as the passive ports of an FTP server. Katapult has no
+// rules that cover a range of ports, so each port still has its own rule made
+// with its own API request. A range only groups how the changes to its rules
+// are reported.
+type portRange struct {
+	first, last   int
+	firstNodePort int
+}
+
+func (r portRange) contains(port int) bool {
+	return port >= r.first && port <= r.last
+}
+
+func (r portRange) String() string {
+	if r.first == r.last {
+		return fmt.Sprint(r.first)
+	}
+
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+// servicePortRanges collapses a service's ports into ranges of consecutive
+// ports. Every port in a range must have a node port offset from the range's
+// first node port by the same amount as the port is from the first port, so
+// that a range on the load balancer maps onto a range of node ports. Rules are
+// always TCP, so ports using any other protocol are rejected rather than
+// forwarded as TCP.
+func servicePortRanges(servicePorts []v1.ServicePort) ([]portRange, error) {
+	for _, servicePort := range servicePorts {
+		if servicePort.Protocol != "" && servicePort.Protocol != v1.ProtocolTCP {
+			return nil, fmt.Errorf("port %d uses %s, but port ranges only support TCP",
+				servicePort.Port, servicePort.Protocol,
+			)
+		}
+	}
+
+	sorted := make([]v1.ServicePort, len(servicePorts))
+	copy(sorted, servicePorts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Port < sorted[j].Port
+	})
+
+	ranges := []portRange{}
+	for _, servicePort := range sorted {
+		port := int(servicePort.Port)
+		nodePort := int(servicePort.NodePort)
+
+		if len(ranges) == 0 || port != ranges[len(ranges)-1].last+1 {
+			ranges = append(ranges, portRange{first: port, last: port, firstNodePort: nodePort})
+			continue
+		}
+
+		r := &ranges[len(ranges)-1]
+		if want := r.firstNodePort + port - r.first; nodePort != want {
+			return nil, fmt.Errorf("port %d has node port %d, but must have node port %d to follow on from port %d",
+				port, nodePort, want, r.last,
+			)
+		}
+		r.last = port
+	}
+
+	return ranges, nil
+}
+
+// formatPorts describes a set of ports, collapsing consecutive ports into
+// ranges, for example "80, 443, 10000-10099".
+func formatPorts(ports []int) string {
+	sorted := make([]int, len(ports))
+	copy(sorted, ports)
+	sort.Ints(sorted)
+
+	parts := []string{}
+	for i := 0; i < len(sorted); {
+		r := portRange{first: sorted[i], last: sorted[i]}
+		for i++; i < len(sorted) && sorted[i] == r.last+1; i++ {
+			r.last = sorted[i]
+		}
+		parts = append(parts, r.String())
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// batchRuleChanges groups the changes in a plan so that those with the same
+// action on ports in the same range are together. Changes outside of any
+// range are left in batches of their own. The order of the plan is kept.
+func batchRuleChanges(changes []ruleChange, ranges []portRange) [][]ruleChange {
+	batches := [][]ruleChange{}
+	index := map[string]int{}
+
+	for _, c := range changes {
+		key := ""
+		for _, r := range ranges {
+			if r.first != r.last && r.contains(c.port) {
+				key = c.action + " " + r.String()
+				break
+			}
+		}
+
+		if i, ok := index[key]; ok && key != "" {
+			batches[i] = append(batches[i], c)
+			continue
+		}
+		if key != "" {
+			index[key] = len(batches)
+		}
+		batches = append(batches, []ruleChange{c})
+	}
+
+	return batches
+}
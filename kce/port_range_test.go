@@ -0,0 +1,104 @@
+package kce
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func Test_servicePortRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   []v1.ServicePort
+		want    []portRange
+		wantErr string
+	}{
+		{
+			name: "no ports",
+			want: []portRange{},
+		},
+		{
+			name: "separate ports",
+			ports: []v1.ServicePort{
+				{Port: 443, NodePort: 30443},
+				{Port: 80, NodePort: 30080},
+			},
+			want: []portRange{
+				{first: 80, last: 80, firstNodePort: 30080},
+				{first: 443, last: 443, firstNodePort: 30443},
+			},
+		},
+		{
+			name: "node ports not consecutive",
+			ports: []v1.ServicePort{
+				{Port: 10001, NodePort: 31001},
+				{Port: 21, NodePort: 30021},
+				{Port: 10000, NodePort: 31000},
+				{Port: 20, NodePort: 32000},
+			},
+			wantErr: "port 21 has node port 30021, but must have node port 32001 to follow on from port 20",
+		},
+		{
+			name: "udp port",
+			ports: []v1.ServicePort{
+				{Port: 10000, NodePort: 31000, Protocol: v1.ProtocolTCP},
+				{Port: 10001, NodePort: 31001, Protocol: v1.ProtocolUDP},
+			},
+			wantErr: "port 10001 uses UDP, but port ranges only support TCP",
+		},
+		{
+			name: "ranges",
+			ports: []v1.ServicePort{
+				{Port: 10001, NodePort: 31001},
+				{Port: 10000, NodePort: 31000},
+				{Port: 10002, NodePort: 31002},
+			},
+			want: []portRange{
+				{first: 10000, last: 10002, firstNodePort: 31000},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := servicePortRanges(tt.ports)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_formatPorts(t *testing.T) {
+	assert.Equal(t, "", formatPorts(nil))
+	assert.Equal(t, "80", formatPorts([]int{80}))
+	assert.Equal(t, "80, 443, 10000-10002", formatPorts([]int{10002, 443, 10000, 80, 10001}))
+}
+
+func Test_batchRuleChanges(t *testing.T) {
+	ranges := []portRange{
+		{first: 80, last: 80},
+		{first: 10000, last: 10002},
+	}
+	changes := []ruleChange{
+		{action: dryRunCreate, port: 10000},
+		{action: dryRunCreate, port: 80},
+		{action: dryRunCreate, port: 10001},
+		{action: dryRunUpdate, port: 10002},
+		{action: dryRunDelete, port: 9000},
+		{action: dryRunDelete, port: 9001},
+	}
+
+	batches := [][]int{}
+	for _, batch := range batchRuleChanges(changes, ranges) {
+		ports := []int{}
+		for _, c := range batch {
+			ports = append(ports, c.port)
+		}
+		batches = append(batches, ports)
+	}
+	assert.Equal(t, [][]int{{10000, 10001}, {80}, {10002}, {9000}, {9001}}, batches)
+}
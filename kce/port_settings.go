@@ -0,0 +1,231 @@
+package kce
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/krystal/go-katapult/core"
+	v1 "k8s.io/api/core/v1"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// portSettings override the default settings of the rule for a single
+// service port. They are read from the annotationLoadBalancerPortSettings
+// annotation, which holds a JSON object keyed by port name or number.
+type portSettings struct {
+	Algorithm     core.LoadBalancerRuleAlgorithm `json:"algorithm"`
+	Protocol      core.Protocol                  `json:"protocol"`
+	ProxyProtocol *bool                          `json:"proxyProtocol"`
+	HealthCheck   *healthCheckSettings           `json:"healthCheck"`
+}
+
+// healthCheckSettings override the health check of a rule. The interval and
+// timeout are in seconds, and rise and fall are the number of checks that
+// must pass or fail before a node is considered up or down.
+type healthCheckSettings struct {
+	Enabled  *bool         `json:"enabled"`
+	Protocol core.Protocol `json:"protocol"`
+	Path     string        `json:"path"`
+	Interval *int          `json:"interval"`
+	Timeout  *int          `json:"timeout"`
+	Rise     *int          `json:"rise"`
+	Fall     *int          `json:"fall"`
+}
+
+// defaultHealthCheckPath is the path requested by HTTP health checks that do
+// not set one. It is always sent, so that a path set before is replaced.
+const defaultHealthCheckPath = "/"
+
+// apply overrides the arguments of a rule with any settings that are set.
+func (s portSettings) apply(args *core.LoadBalancerRuleArguments) {
+	if s.Algorithm != "" {
+		args.Algorithm = s.Algorithm
+	}
+	if s.Protocol != "" {
+		args.Protocol = s.Protocol
+	}
+	if s.ProxyProtocol != nil {
+		args.ProxyProtocol = s.ProxyProtocol
+	}
+
+	check := s.HealthCheck
+	if check == nil {
+		return
+	}
+	if check.Enabled != nil {
+		args.CheckEnabled = check.Enabled
+	}
+	if check.Protocol != "" {
+		args.CheckProtocol = check.Protocol
+	}
+	if check.Path != "" {
+		args.CheckPath = check.Path
+	}
+	if args.CheckProtocol == core.HTTPProtocol && args.CheckPath == "" {
+		args.CheckPath = defaultHealthCheckPath
+	}
+	if check.Interval != nil {
+		args.CheckInterval = *check.Interval
+	}
+	if check.Timeout != nil {
+		args.CheckTimeout = *check.Timeout
+	}
+	if check.Rise != nil {
+		args.CheckRise = *check.Rise
+	}
+	if check.Fall != nil {
+		args.CheckFall = *check.Fall
+	}
+}
+
+func (s portSettings) validate() error {
+	switch s.Algorithm {
+	case "", core.RoundRobinRuleAlgorithm, core.LeastConnectionsRuleAlgorithm, core.StickyRuleAlgorithm:
+	default:
+		return fmt.Errorf("algorithm must be %q, %q or %q, not %q",
+			core.RoundRobinRuleAlgorithm, core.LeastConnectionsRuleAlgorithm, core.StickyRuleAlgorithm, s.Algorithm,
+		)
+	}
+
+	if err := validateProtocol(s.Protocol); err != nil {
+		return fmt.Errorf("protocol %w", err)
+	}
+
+	check := s.HealthCheck
+	if check == nil {
+		return nil
+	}
+	if err := validateProtocol(check.Protocol); err != nil {
+		return fmt.Errorf("healthCheck.protocol %w", err)
+	}
+	if check.Path != "" {
+		if check.Protocol != core.HTTPProtocol {
+			return fmt.Errorf("healthCheck.path can only be set when healthCheck.protocol is %q", core.HTTPProtocol)
+		}
+		if !strings.HasPrefix(check.Path, "/") {
+			return fmt.Errorf("healthCheck.path must start with /")
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"interval", check.Interval},
+		{"timeout", check.Timeout},
+		{"rise", check.Rise},
+		{"fall", check.Fall},
+	} {
+		if field.value != nil && *field.value < 1 {
+			return fmt.Errorf("healthCheck.%s must be at least 1", field.name)
+		}
+	}
+
+	return nil
+}
+
+// validateProtocol checks a rule or health check protocol. HTTPS rules need
+// certificates, which cannot be set up from a service.
+func validateProtocol(protocol core.Protocol) error {
+	switch protocol {
+	case "", core.TCPProtocol, core.HTTPProtocol:
+		return nil
+	}
+
+	return fmt.Errorf("must be %q or %q, not %q", core.TCPProtocol, core.HTTPProtocol, protocol)
+}
+
+// parsePortSettings reads the per port rule settings from the value of the
+// annotationLoadBalancerPortSettings annotation, keyed by port number.
+func parsePortSettings(v string, servicePorts []v1.ServicePort) (map[int]portSettings, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, describeJSONError(err)
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	settings := map[int]portSettings{}
+	setBy := map[int]string{}
+	for _, key := range keys {
+		port, ok := findServicePort(servicePorts, key)
+		if !ok {
+			return nil, fmt.Errorf("port %q is not one of the service's ports", key)
+		}
+		if other, ok := setBy[port]; ok {
+			return nil, fmt.Errorf("port %q is the same port as %q", key, other)
+		}
+
+		s := portSettings{}
+		d := json.NewDecoder(bytes.NewReader(raw[key]))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&s); err != nil {
+			return nil, fmt.Errorf("port %q: %w", key, describeJSONError(err))
+		}
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("port %q: %w", key, err)
+		}
+
+		settings[port] = s
+		setBy[port] = key
+	}
+
+	return settings, nil
+}
+
+// findServicePort returns the port number of the service port with the given
+// name or number.
+func findServicePort(servicePorts []v1.ServicePort, key string) (int, bool) {
+	number, err := strconv.Atoi(key)
+	for _, servicePort := range servicePorts {
+		if (err == nil && int(servicePort.Port) == number) || (servicePort.Name != "" && servicePort.Name == key) {
+			return int(servicePort.Port), true
+		}
+	}
+
+	return 0, false
+}
+
+// describeJSONError rewrites errors from encoding/json so that they refer to
+// the fields of the annotation rather than Go types.
+func describeJSONError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("invalid JSON at offset %d: %s", syntaxErr.Offset, syntaxErr)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("must be %s, not %s", describeJSONType(typeErr.Type), typeErr.Value)
+		}
+		return fmt.Errorf("%s must be %s, not %s", typeErr.Field, describeJSONType(typeErr.Type), typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown setting %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+
+	return err
+}
+
+func describeJSONType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	}
+
+	return "an object"
+}
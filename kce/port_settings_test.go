@@ -0,0 +1,210 @@
+package kce
+
+import (
+	"context"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func Test_parsePortSettings(t *testing.T) {
+	ports := []v1.ServicePort{
+		{Name: "http", Port: 80, NodePort: 30080},
+		{Name: "proxy", Port: 8443, NodePort: 38443},
+		{Port: 9000, NodePort: 39000},
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    map[int]portSettings
+		wantErr string
+	}{
+		{
+			name:  "empty",
+			value: `{}`,
+			want:  map[int]portSettings{},
+		},
+		{
+			name: "by name and number",
+			value: `{
+				"http": {
+					"algorithm": "least_connections",
+					"protocol": "HTTP",
+					"healthCheck": {"protocol": "HTTP", "path": "/healthz", "interval": 20, "timeout": 2, "rise": 2, "fall": 3}
+				},
+				"9000": {"proxyProtocol": true, "healthCheck": {"enabled": false}}
+			}`,
+			want: map[int]portSettings{
+				80: {
+					Algorithm: core.LeastConnectionsRuleAlgorithm,
+					Protocol:  core.HTTPProtocol,
+					HealthCheck: &healthCheckSettings{
+						Protocol: core.HTTPProtocol,
+						Path:     "/healthz",
+						Interval: intPtr(20),
+						Timeout:  intPtr(2),
+						Rise:     intPtr(2),
+						Fall:     intPtr(3),
+					},
+				},
+				9000: {
+					ProxyProtocol: boolPtr(true),
+					HealthCheck:   &healthCheckSettings{Enabled: boolPtr(false)},
+				},
+			},
+		},
+		{
+			name:    "invalid JSON",
+			value:   `{"http": {"algorithm": "sticky",}}`,
+			wantErr: "invalid JSON at offset 33: invalid character '}' looking for beginning of object key string",
+		},
+		{
+			name:    "not an object",
+			value:   `["http"]`,
+			wantErr: "must be an object, not array",
+		},
+		{
+			name:    "settings not an object",
+			value:   `{"http": "sticky"}`,
+			wantErr: `port "http": must be an object, not string`,
+		},
+		{
+			name:    "unknown port",
+			value:   `{"https": {}}`,
+			wantErr: `port "https" is not one of the service's ports`,
+		},
+		{
+			name:    "unknown port number",
+			value:   `{"443": {}}`,
+			wantErr: `port "443" is not one of the service's ports`,
+		},
+		{
+			name:    "same port twice",
+			value:   `{"http": {}, "80": {}}`,
+			wantErr: `port "http" is the same port as "80"`,
+		},
+		{
+			name:    "unknown setting",
+			value:   `{"http": {"algo": "sticky"}}`,
+			wantErr: `port "http": unknown setting "algo"`,
+		},
+		{
+			name:    "unknown health check setting",
+			value:   `{"http": {"healthCheck": {"url": "/"}}}`,
+			wantErr: `port "http": unknown setting "url"`,
+		},
+		{
+			name:    "wrong type",
+			value:   `{"http": {"healthCheck": {"interval": "10s"}}}`,
+			wantErr: `port "http": healthCheck.interval must be a number, not string`,
+		},
+		{
+			name:    "wrong type for flag",
+			value:   `{"proxy": {"proxyProtocol": "yes"}}`,
+			wantErr: `port "proxy": proxyProtocol must be true or false, not string`,
+		},
+		{
+			name:    "invalid algorithm",
+			value:   `{"http": {"algorithm": "random"}}`,
+			wantErr: `port "http": algorithm must be "round_robin", "least_connections" or "sticky", not "random"`,
+		},
+		{
+			name:    "HTTPS",
+			value:   `{"http": {"protocol": "HTTPS"}}`,
+			wantErr: `port "http": protocol must be "TCP" or "HTTP", not "HTTPS"`,
+		},
+		{
+			name:    "invalid health check protocol",
+			value:   `{"http": {"healthCheck": {"protocol": "UDP"}}}`,
+			wantErr: `port "http": healthCheck.protocol must be "TCP" or "HTTP", not "UDP"`,
+		},
+		{
+			name:    "path without HTTP health check",
+			value:   `{"http": {"healthCheck": {"path": "/healthz"}}}`,
+			wantErr: `port "http": healthCheck.path can only be set when healthCheck.protocol is "HTTP"`,
+		},
+		{
+			name:    "relative path",
+			value:   `{"http": {"healthCheck": {"protocol": "HTTP", "path": "healthz"}}}`,
+			wantErr: `port "http": healthCheck.path must start with /`,
+		},
+		{
+			name:    "zero timeout",
+			value:   `{"http": {"healthCheck": {"timeout": 0}}}`,
+			wantErr: `port "http": healthCheck.timeout must be at least 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePortSettings(tt.value, ports)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestLoadBalancerManager_portSettings(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	ctx := context.Background()
+
+	service := fakeKatapultService(80, 443)
+	service.Spec.Ports[0].Name = "http"
+	service.Annotations = map[string]string{
+		annotationLoadBalancerPortSettings: `{"http": {"protocol": "HTTP", "healthCheck": {"protocol": "HTTP", "path": "/healthz"}}}`,
+	}
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	rules := s.LoadBalancerRules(lbs[0].ID)
+	require.Len(t, rules, 2)
+	assert.Equal(t, core.HTTPProtocol, rules[0].Protocol)
+	assert.Equal(t, core.HTTPProtocol, rules[0].CheckProtocol)
+	assert.Equal(t, "/healthz", rules[0].CheckPath)
+	assert.Equal(t, core.TCPProtocol, rules[1].Protocol)
+	assert.Equal(t, core.TCPProtocol, rules[1].CheckProtocol)
+
+	// Changing the settings updates the rule.
+	s.ResetRequests()
+	service.Annotations[annotationLoadBalancerPortSettings] = `{"http": {"algorithm": "sticky", "protocol": "HTTP", "healthCheck": {"protocol": "HTTP", "path": "/healthz"}}}`
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PATCH /core/v1/load_balancers/rules/_"}, mutatingRequests(s))
+	assert.Equal(t, core.StickyRuleAlgorithm, s.LoadBalancerRules(lbs[0].ID)[0].Algorithm)
+
+	// Leaving out the path of an HTTP check resets it to the default, rather
+	// than keeping the path set before.
+	s.ResetRequests()
+	service.Annotations[annotationLoadBalancerPortSettings] = `{"http": {"algorithm": "sticky", "protocol": "HTTP", "healthCheck": {"protocol": "HTTP"}}}`
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PATCH /core/v1/load_balancers/rules/_"}, mutatingRequests(s))
+	assert.Equal(t, "/", s.LoadBalancerRules(lbs[0].ID)[0].CheckPath)
+
+	s.ResetRequests()
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	assert.Empty(t, mutatingRequests(s))
+
+	service.Annotations[annotationLoadBalancerPortSettings] = `{"http": {"algorithm": "fastest"}}`
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	assert.EqualError(t, err, `invalid value for kce.krystal.uk/load-balancer-port-settings: port "http": `+
+		`algorithm must be "round_robin", "least_connections" or "sticky", not "fastest"`)
+}
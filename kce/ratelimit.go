@@ -0,0 +1,117 @@
+package kce
+
+import (
+	"context"
+	"github.com/krystal/go-katapult"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRateLimitWait is how long to back off for when Katapult does
+	// not say how long to wait.
+	defaultRateLimitWait = time.Second
+	// defaultRateLimitMaxWait caps how long to back off for at once.
+	defaultRateLimitMaxWait = 30 * time.Second
+	// rateLimitRetries is how many times a rate limited request is retried.
+	rateLimitRetries = 5
+)
+
+// rateLimiter backs off every request made through it once Katapult has
+// reported that the rate limit has been exceeded, so that concurrent workers
+// pause together rather than each using up their retries. The zero value is
+// ready to use.
+type rateLimiter struct {
+	mu    sync.Mutex
+	until time.Time
+
+	// maxWait caps how long to back off for at once, defaulting to
+	// defaultRateLimitMaxWait.
+	maxWait time.Duration
+}
+
+// do calls fn, retrying it if Katapult responds that the rate limit has been
+// exceeded. fn is called with the context of a span named name, so that each
+// attempt is a child of it, and the number of retries and the time spent
+// backing off are recorded on the span.
+func (r *rateLimiter) do(ctx context.Context, name string, fn func(ctx context.Context) (*katapult.Response, error)) (err error) {
+	ctx, span := startSpan(ctx, name, trace.SpanKindInternal)
+	retries := 0
+	var waited time.Duration
+	defer func() {
+		span.SetAttributes(
+			attributeRetries.Int(retries),
+			attributeRetryWait.Int64(waited.Milliseconds()),
+		)
+		endSpan(span, err)
+	}()
+
+	for attempt := 0; ; attempt++ {
+		d, err := r.wait(ctx)
+		waited += d
+		if err != nil {
+			return err
+		}
+
+		resp, err := fn(ctx)
+		if err == nil || !isRateLimited(resp) || attempt == rateLimitRetries {
+			return err
+		}
+		retries++
+		r.backOff(retryAfter(resp))
+	}
+}
+
+// wait blocks until any back off has passed, returning how long it waited.
+func (r *rateLimiter) wait(ctx context.Context) (time.Duration, error) {
+	r.mu.Lock()
+	d := time.Until(r.until)
+	r.mu.Unlock()
+	if d <= 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	case <-t.C:
+		return time.Since(start), nil
+	}
+}
+
+func (r *rateLimiter) backOff(d time.Duration) {
+	maxWait := r.maxWait
+	if maxWait == 0 {
+		maxWait = defaultRateLimitMaxWait
+	}
+	if d > maxWait {
+		d = maxWait
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if until := time.Now().Add(d); until.After(r.until) {
+		r.until = until
+	}
+}
+
+func isRateLimited(resp *katapult.Response) bool {
+	return resp != nil && resp.Response != nil && resp.StatusCode == http.StatusTooManyRequests
+}
+
+// retryAfter reads how long Katapult has asked us to wait from the
+// Retry-After header of a rate limited response.
+func retryAfter(resp *katapult.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return defaultRateLimitWait
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,391 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// ruleChange is a single change to a load balancer's rules. The action is one
+// of dryRunCreate, dryRunUpdate or dryRunDelete.
+type ruleChange struct {
+	action string
+	port   int
+	// from is the port an update moves a rule from, when a service port's
+	// number has changed. It is zero when the rule keeps its port.
+	from int
+
+	// rule is the existing rule being updated or deleted, and is nil for
+	// creates.
+	rule *core.LoadBalancerRule
+	// args are the arguments a rule is created or updated with.
+	args core.LoadBalancerRuleArguments
+}
+
+// ruleConflict is a service port that cannot be served because a rule that
+// kce-ccm does not manage already listens on it.
+type ruleConflict struct {
+	servicePort v1.ServicePort
+	rule        core.LoadBalancerRule
+}
+
+// rulePlan is every change needed to bring a load balancer's rules in line
+// with its service. Changes are ordered so that rules for new ports are
+// created before old ones are deleted, keeping as many ports served as
+// possible while the plan is part way through.
+type rulePlan struct {
+	changes   []ruleChange
+	conflicts []ruleConflict
+}
+
+func (p rulePlan) count(action string) int {
+	n := 0
+	for _, c := range p.changes {
+		if c.action == action {
+			n++
+		}
+	}
+
+	return n
+}
+
+// serviceRuleArguments returns the arguments of the rule serving a service
+// port.
+func serviceRuleArguments(servicePort v1.ServicePort) core.LoadBalancerRuleArguments {
+	proxyProtocol := false
+	checkEnabled := true
+
+	return core.LoadBalancerRuleArguments{
+		Algorithm:       core.RoundRobinRuleAlgorithm,
+		DestinationPort: int(servicePort.NodePort),
+		ListenPort:      int(servicePort.Port),
+		Protocol:        core.TCPProtocol,
+		ProxyProtocol:   &proxyProtocol,
+		CheckEnabled:    &checkEnabled,
+		CheckProtocol:   core.TCPProtocol,
+		CheckTimeout:    5,
+		CheckInterval:   10,
+		CheckRise:       1,
+		CheckFall:       1,
+	}
+}
+
+// ruleArguments returns the arguments that would recreate a rule as it is,
+// which are used to restore a rule during a rollback.
+func ruleArguments(rule core.LoadBalancerRule) core.LoadBalancerRuleArguments {
+	proxyProtocol := rule.ProxyProtocol
+	checkEnabled := rule.CheckEnabled
+
+	return core.LoadBalancerRuleArguments{
+		Algorithm:       rule.Algorithm,
+		DestinationPort: rule.DestinationPort,
+		ListenPort:      rule.ListenPort,
+		Protocol:        rule.Protocol,
+		ProxyProtocol:   &proxyProtocol,
+		Certificates:    rule.Certificates,
+		CheckEnabled:    &checkEnabled,
+		CheckFall:       rule.CheckFall,
+		CheckInterval:   rule.CheckInterval,
+		CheckPath:       rule.CheckPath,
+		CheckProtocol:   rule.CheckProtocol,
+		CheckRise:       rule.CheckRise,
+		CheckTimeout:    rule.CheckTimeout,
+	}
+}
+
+// ruleMatches returns true if updating a rule with args would not change it,
+// so that rules that are already correct are not updated. The check path is
+// only compared for HTTP health checks, as TCP checks do not use it and the
+// API cannot clear it.
+func ruleMatches(rule core.LoadBalancerRule, args core.LoadBalancerRuleArguments) bool {
+	return rule.Algorithm == args.Algorithm &&
+		rule.DestinationPort == args.DestinationPort &&
+		rule.ListenPort == args.ListenPort &&
+		rule.Protocol == args.Protocol &&
+		(args.ProxyProtocol == nil || rule.ProxyProtocol == *args.ProxyProtocol) &&
+		(args.CheckEnabled == nil || rule.CheckEnabled == *args.CheckEnabled) &&
+		rule.CheckProtocol == args.CheckProtocol &&
+		(args.CheckProtocol != core.HTTPProtocol || rule.CheckPath == args.CheckPath) &&
+		rule.CheckTimeout == args.CheckTimeout &&
+		rule.CheckInterval == args.CheckInterval &&
+		rule.CheckRise == args.CheckRise &&
+		rule.CheckFall == args.CheckFall
+}
+
+// planLoadBalancerRules works out the changes needed to make a load
+// balancer's rules serve the ports exposed by a service. Only the rules in
+// owned are ever changed or deleted, rules added by hand are left in place.
+// When a named port's number has changed since the ports in names were
+// recorded, its rule is moved to the new port rather than replaced, so that
+// it keeps serving traffic throughout. Rules use the default settings, with
+// any overrides for their port from settings.
+func planLoadBalancerRules(log logr.Logger, service *v1.Service, rules []core.LoadBalancerRule, owned map[int]bool, names map[string]int, settings map[int]portSettings) rulePlan {
+	plan := rulePlan{}
+	updates := []ruleChange{}
+	deletes := []ruleChange{}
+
+	inUse := map[int]bool{}
+	for _, servicePort := range service.Spec.Ports {
+		inUse[int(servicePort.Port)] = true
+	}
+
+	moved := map[int]bool{}
+	for _, servicePort := range service.Spec.Ports {
+		port := int(servicePort.Port)
+
+		args := serviceRuleArguments(servicePort)
+		settings[port].apply(&args)
+		rule := findRule(rules, port)
+		switch {
+		case rule == nil:
+			if from := movableRule(rules, owned, names, inUse, moved, servicePort); from != nil {
+				moved[from.ListenPort] = true
+				updates = append(updates, ruleChange{action: dryRunUpdate, port: port, from: from.ListenPort, rule: from, args: args})
+				continue
+			}
+			plan.changes = append(plan.changes, ruleChange{action: dryRunCreate, port: port, args: args})
+		case !owned[port]:
+			plan.conflicts = append(plan.conflicts, ruleConflict{servicePort: servicePort, rule: *rule})
+		case !ruleMatches(*rule, args):
+			updates = append(updates, ruleChange{action: dryRunUpdate, port: port, rule: rule, args: args})
+		}
+	}
+
+	for i, rule := range rules {
+		if inUse[rule.ListenPort] || moved[rule.ListenPort] {
+			continue
+		}
+		if !owned[rule.ListenPort] {
+			log.V(4).Info("leaving unmanaged lb rule",
+				logKeyRuleID, rule.ID,
+				"rulePort", rule.ListenPort,
+			)
+			continue
+		}
+
+		deletes = append(deletes, ruleChange{action: dryRunDelete, port: rule.ListenPort, rule: &rules[i]})
+	}
+
+	plan.changes = append(plan.changes, updates...)
+	plan.changes = append(plan.changes, deletes...)
+
+	return plan
+}
+
+// movableRule returns the rule that served a named service port before its
+// number changed, if that rule is managed by kce-ccm and is no longer needed
+// for the port it listens on.
+func movableRule(rules []core.LoadBalancerRule, owned map[int]bool, names map[string]int, inUse, moved map[int]bool, servicePort v1.ServicePort) *core.LoadBalancerRule {
+	if servicePort.Name == "" {
+		return nil
+	}
+
+	from, ok := names[servicePort.Name]
+	if !ok || from == int(servicePort.Port) || inUse[from] || moved[from] || !owned[from] {
+		return nil
+	}
+
+	return findRule(rules, from)
+}
+
+// phases splits the changes in a plan into runs of the same action, which are
+// made one after another. The changes within a phase can be made in any
+// order.
+func (p rulePlan) phases() [][]ruleChange {
+	phases := [][]ruleChange{}
+	for i, c := range p.changes {
+		if i == 0 || c.action != p.changes[i-1].action {
+			phases = append(phases, []ruleChange{})
+		}
+		phases[len(phases)-1] = append(phases[len(phases)-1], c)
+	}
+
+	return phases
+}
+
+// applyRuleChange makes a single change to a load balancer's rules, and
+// returns the change that would undo it.
+func (lbm *loadBalancerManager) applyRuleChange(ctx context.Context, lb *core.LoadBalancer, c ruleChange) (ruleChange, error) {
+	log := loggerFrom(ctx, lbm.log).WithValues(logKeyLoadBalancerID, lb.ID)
+
+	switch c.action {
+	case dryRunCreate:
+		var created *core.LoadBalancerRule
+		var resp *katapult.Response
+		err := lbm.rateLimiter.do(ctx, "LoadBalancer.createRule", func(ctx context.Context) (*katapult.Response, error) {
+			var err error
+			created, resp, err = lbm.loadBalancerRuleController.Create(ctx, lb.Ref(), c.args)
+			return resp, err
+		})
+		if err != nil {
+			return ruleChange{}, err
+		}
+		withRequestID(log, resp).Info("created lb rule",
+			logKeyRuleID, created.ID,
+			"rulePort", c.port,
+		)
+
+		return ruleChange{action: dryRunDelete, port: c.port, rule: created}, nil
+	case dryRunUpdate:
+		log.V(4).Info("updating lb rule",
+			logKeyRuleID, c.rule.ID,
+			"args", c.args,
+		)
+		var resp *katapult.Response
+		err := lbm.rateLimiter.do(ctx, "LoadBalancer.updateRule", func(ctx context.Context) (*katapult.Response, error) {
+			var err error
+			_, resp, err = lbm.loadBalancerRuleController.Update(ctx, c.rule.Ref(), c.args)
+			return resp, err
+		})
+		if err != nil {
+			return ruleChange{}, err
+		}
+
+		undo := ruleChange{action: dryRunUpdate, port: c.rule.ListenPort, rule: c.rule, args: ruleArguments(*c.rule)}
+		if c.from != 0 {
+			withRequestID(log, resp).Info("moved lb rule",
+				logKeyRuleID, c.rule.ID,
+				"rulePort", c.port,
+				"previousRulePort", c.from,
+			)
+			undo.from = c.port
+
+			return undo, nil
+		}
+		withRequestID(log, resp).Info("updated lb rule",
+			logKeyRuleID, c.rule.ID,
+			"rulePort", c.port,
+		)
+
+		return undo, nil
+	default:
+		var resp *katapult.Response
+		err := lbm.rateLimiter.do(ctx, "LoadBalancer.deleteRule", func(ctx context.Context) (*katapult.Response, error) {
+			var err error
+			_, resp, err = lbm.loadBalancerRuleController.Delete(ctx, c.rule.Ref())
+			return resp, err
+		})
+		if err != nil {
+			return ruleChange{}, err
+		}
+		withRequestID(log, resp).Info("deleted lb rule",
+			logKeyRuleID, c.rule.ID,
+			"rulePort", c.port,
+		)
+
+		return ruleChange{action: dryRunCreate, port: c.port, args: ruleArguments(*c.rule)}, nil
+	}
+}
+
+// applyRuleChanges makes changes to a load balancer's rules concurrently,
+// with at most RuleConcurrency in flight at once. The changes for each port
+// range are queued one after another, each with its own request, and if any
+// of them fails a single error is returned for the range.
+// It returns the changes that were made, the changes that would undo them,
+// and an error for each port or range that could not be changed.
+func (lbm *loadBalancerManager) applyRuleChanges(ctx context.Context, lb *core.LoadBalancer, changes []ruleChange, ranges []portRange) (made, undo []ruleChange, failed []error) {
+	workers := lbm.config.RuleConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	batches := batchRuleChanges(changes, ranges)
+	queue := make([]ruleChange, 0, len(changes))
+	for _, batch := range batches {
+		queue = append(queue, batch...)
+	}
+
+	inverses := make([]ruleChange, len(queue))
+	errs := make([]error, len(queue))
+	ran := make([]bool, len(queue))
+	workqueue.ParallelizeUntil(ctx, workers, len(queue), func(i int) {
+		ran[i] = true
+		inverses[i], errs[i] = lbm.applyRuleChange(ctx, lb, queue[i])
+	})
+
+	i := 0
+	for _, batch := range batches {
+		batchErrs := []error{}
+		for _, c := range batch {
+			err := errs[i]
+			if !ran[i] {
+				err = ctx.Err()
+			}
+			if err != nil {
+				batchErrs = append(batchErrs, fmt.Errorf("failed to %s lb rule for port %d: %w", c.action, c.port, err))
+			} else {
+				made = append(made, c)
+				undo = append(undo, inverses[i])
+			}
+			i++
+		}
+
+		switch {
+		case len(batchErrs) == 0:
+		case len(batch) == 1:
+			failed = append(failed, batchErrs...)
+		default:
+			ports := make([]int, 0, len(batch))
+			for _, c := range batch {
+				ports = append(ports, c.port)
+			}
+			failed = append(failed, fmt.Errorf("failed to %s lb rules for ports %s: %w",
+				batch[0].action, formatPorts(ports), utilerrors.NewAggregate(batchErrs),
+			))
+		}
+	}
+
+	return made, undo, failed
+}
+
+// applyRulePlan makes every change in a plan, a phase at a time. If any
+// change fails, those already made are undone so that the load balancer is
+// left with the rules it had before, rather than half way between the two.
+// The undo changes that were made are returned so the caller can tell which
+// rules were restored.
+func (lbm *loadBalancerManager) applyRulePlan(ctx context.Context, lb *core.LoadBalancer, plan rulePlan, ranges []portRange) ([]ruleChange, error) {
+	log := loggerFrom(ctx, lbm.log).WithValues(logKeyLoadBalancerID, lb.ID)
+
+	undo := [][]ruleChange{}
+	made := 0
+	for _, phase := range plan.phases() {
+		_, inverses, failed := lbm.applyRuleChanges(ctx, lb, phase, ranges)
+		undo = append(undo, inverses)
+		made += len(inverses)
+		if len(failed) == 0 {
+			continue
+		}
+
+		err := fmt.Errorf("%d of %d lb rule changes failed after %d were made: %w",
+			len(phase)-len(inverses), len(plan.changes), made, utilerrors.NewAggregate(failed),
+		)
+		log.Error(err, "rolling back lb rule changes",
+			"changes", made,
+		)
+
+		// Undo the phases in reverse, so that deleted rules are restored
+		// before the rules created in their place are removed.
+		undone := []ruleChange{}
+		rollbackErrs := []error{}
+		for i := len(undo) - 1; i >= 0; i-- {
+			restored, _, failed := lbm.applyRuleChanges(ctx, lb, undo[i], ranges)
+			undone = append(undone, restored...)
+			rollbackErrs = append(rollbackErrs, failed...)
+		}
+
+		if len(rollbackErrs) > 0 {
+			return undone, fmt.Errorf("%w, and %d of them could not be rolled back: %v",
+				err, len(rollbackErrs), utilerrors.NewAggregate(rollbackErrs),
+			)
+		}
+
+		return undone, fmt.Errorf("%w, rolled back", err)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,324 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	"github.com/krystal/kce-ccm/internal/fakekatapult"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlanLoadBalancerRules(t *testing.T) {
+	rules := []core.LoadBalancerRule{
+		{ID: "lbrule_old", ListenPort: 443},
+		{ID: "lbrule_web", ListenPort: 80},
+		{ID: "lbrule_manual", ListenPort: 22},
+	}
+	service := fakeKatapultService(80, 8080)
+	owned := map[int]bool{80: true, 443: true}
+
+	plan := planLoadBalancerRules(logTest.TestLogger{T: t}, service, rules, owned, nil, nil)
+
+	changes := []string{}
+	for _, c := range plan.changes {
+		id := ""
+		if c.rule != nil {
+			id = c.rule.ID
+		}
+		changes = append(changes, c.action+" "+id)
+	}
+	assert.Equal(t, []string{
+		"create ",
+		"update lbrule_web",
+		"delete lbrule_old",
+	}, changes)
+	assert.Equal(t, 8080, plan.changes[0].port)
+	assert.Empty(t, plan.conflicts)
+	assert.Equal(t, 1, plan.count(dryRunDelete))
+}
+
+func TestLoadBalancerManager_ruleRollback(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	kube := withFakeCluster(lbm, fakeKatapultService())
+	ctx := context.Background()
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443), nil)
+	require.NoError(t, err)
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	lb := lbs[0]
+	before := s.LoadBalancerRules(lb.ID)
+
+	// Port 80 moves to a new node port, 8080 is added and 443 is removed.
+	changed := func() *v1.Service {
+		service := recorded(t, kube, fakeKatapultService(80, 8080))
+		service.Spec.Ports[0].NodePort = 31000
+		return service
+	}
+
+	t.Run("rolled back", func(t *testing.T) {
+		s.AddFault(fakekatapult.Fault{
+			Method:     http.MethodDelete,
+			Path:       "/core/v1/load_balancers/rules/_",
+			StatusCode: http.StatusInternalServerError,
+			Count:      1,
+		})
+
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", changed(), nil)
+		assert.EqualError(t, err, "1 of 3 lb rule changes failed after 2 were made: "+
+			"failed to delete lb rule for port 443: internal_server_error: An internal server error occurred, rolled back")
+		assert.Equal(t, before, s.LoadBalancerRules(lb.ID))
+		assert.Equal(t, `{"`+lb.ID+`":[80,443]}`, recorded(t, kube, fakeKatapultService()).Annotations[annotationLoadBalancerManagedRules])
+	})
+
+	t.Run("rollback fails", func(t *testing.T) {
+		s.AddFault(fakekatapult.Fault{
+			Method:     http.MethodDelete,
+			Path:       "/core/v1/load_balancers/rules/_",
+			StatusCode: http.StatusInternalServerError,
+		})
+		defer s.ClearFaults()
+
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", changed(), nil)
+		assert.EqualError(t, err, "1 of 3 lb rule changes failed after 2 were made: "+
+			"failed to delete lb rule for port 443: internal_server_error: An internal server error occurred, and 1 of them could not be rolled back: "+
+			"failed to delete lb rule for port 8080: internal_server_error: An internal server error occurred")
+
+		rules := s.LoadBalancerRules(lb.ID)
+		assert.Equal(t, []int{80, 443, 8080}, fakeListenPorts(rules))
+		assert.Equal(t, before[0], rules[0])
+		// The rule left behind is still recorded so a later attempt can tidy
+		// it up.
+		assert.Equal(t, `{"`+lb.ID+`":[80,443,8080]}`, recorded(t, kube, fakeKatapultService()).Annotations[annotationLoadBalancerManagedRules])
+	})
+
+	t.Run("recovers", func(t *testing.T) {
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", changed(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, []int{80, 8080}, fakeListenPorts(s.LoadBalancerRules(lb.ID)))
+		assert.Equal(t, 31000, s.LoadBalancerRules(lb.ID)[0].DestinationPort)
+		assert.Equal(t, `{"`+lb.ID+`":[80,8080]}`, recorded(t, kube, fakeKatapultService()).Annotations[annotationLoadBalancerManagedRules])
+	})
+}
+
+// concurrentRuleController tracks how many rule changes are in flight at once.
+type concurrentRuleController struct {
+	loadBalancerRuleController
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *concurrentRuleController) Create(ctx context.Context, lb core.LoadBalancerRef, args core.LoadBalancerRuleArguments) (*core.LoadBalancerRule, *katapult.Response, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	return c.loadBalancerRuleController.Create(ctx, lb, args)
+}
+
+func TestLoadBalancerManager_ruleConcurrency(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	lbm.config.RuleConcurrency = 4
+	rules := &concurrentRuleController{loadBalancerRuleController: lbm.loadBalancerRuleController}
+	lbm.loadBalancerRuleController = rules
+	ctx := context.Background()
+
+	ports := []int32{}
+	for port := int32(1000); port < 1020; port++ {
+		ports = append(ports, port)
+	}
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(ports...), nil)
+	require.NoError(t, err)
+
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	assert.Len(t, s.LoadBalancerRules(lbs[0].ID), 20)
+	assert.Equal(t, 4, rules.max)
+}
+
+func TestLoadBalancerManager_ruleRateLimit(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	lbm.config.RuleConcurrency = 4
+	lbm.rateLimiter.maxWait = time.Millisecond
+	ctx := context.Background()
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(), nil)
+	require.NoError(t, err)
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+
+	s.AddFault(fakekatapult.Fault{
+		Method:     http.MethodPost,
+		Path:       "/core/v1/load_balancers/" + lbs[0].ID + "/rules",
+		StatusCode: http.StatusTooManyRequests,
+		Count:      3,
+	})
+	exporter := recordSpans(t)
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443, 8080), nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{80, 443, 8080}, fakeListenPorts(s.LoadBalancerRules(lbs[0].ID)))
+
+	// Every retry is recorded on the span of the rule change it was for.
+	retries := int64(0)
+	for _, span := range exporter.GetSpans() {
+		if span.Name != "LoadBalancer.createRule" {
+			continue
+		}
+		for _, attr := range span.Attributes {
+			if attr.Key == attributeRetries {
+				retries += attr.Value.AsInt64()
+			}
+		}
+	}
+	assert.Equal(t, int64(3), retries)
+
+	// Errors other than the rate limit are not retried, and are reported for
+	// each port.
+	s.AddFault(fakekatapult.Fault{
+		Method:     http.MethodPost,
+		Path:       "/core/v1/load_balancers/" + lbs[0].ID + "/rules",
+		StatusCode: http.StatusInternalServerError,
+	})
+	defer s.ClearFaults()
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80, 443, 8080, 9000, 9001), nil)
+	assert.EqualError(t, err, "2 of 2 lb rule changes failed after 0 were made: ["+
+		"failed to create lb rule for port 9000: internal_server_error: An internal server error occurred, "+
+		"failed to create lb rule for port 9001: internal_server_error: An internal server error occurred"+
+		"], rolled back")
+}
+
+func TestLoadBalancerManager_rulePortRanges(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	lbm.config.RuleConcurrency = 1
+	ctx := context.Background()
+	service := fakeKatapultService(10000, 10001, 10002, 80)
+	service.Annotations = map[string]string{annotationLoadBalancerPortRanges: "true"}
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(), nil)
+	require.NoError(t, err)
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+
+	// A failure for one port of a range fails the range as a whole, and
+	// every change is rolled back.
+	s.AddFault(fakekatapult.Fault{
+		Method:     http.MethodPost,
+		Path:       "/core/v1/load_balancers/" + lbs[0].ID + "/rules",
+		StatusCode: http.StatusInternalServerError,
+		Count:      1,
+	})
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	assert.EqualError(t, err, "1 of 4 lb rule changes failed after 3 were made: "+
+		"failed to create lb rules for ports 10000-10002: "+
+		"failed to create lb rule for port 10000: internal_server_error: An internal server error occurred, rolled back")
+	assert.Empty(t, s.LoadBalancerRules(lbs[0].ID))
+
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{80, 10000, 10001, 10002}, fakeListenPorts(s.LoadBalancerRules(lbs[0].ID)))
+}
+
+func TestPlanLoadBalancerRules_movedPorts(t *testing.T) {
+	rules := []core.LoadBalancerRule{
+		{ID: "lbrule_http", ListenPort: 80},
+		{ID: "lbrule_https", ListenPort: 443},
+		{ID: "lbrule_manual", ListenPort: 22},
+	}
+	service := fakeKatapultService(8080, 443, 2222, 9000)
+	service.Spec.Ports[0].Name = "http"
+	service.Spec.Ports[1].Name = "https"
+	service.Spec.Ports[2].Name = "ssh"
+	service.Spec.Ports[3].Name = "metrics"
+	owned := map[int]bool{80: true, 443: true}
+	names := map[string]int{"http": 80, "https": 443, "ssh": 22, "metrics": 443}
+
+	plan := planLoadBalancerRules(logTest.TestLogger{T: t}, service, rules, owned, names, nil)
+
+	changes := []string{}
+	for _, c := range plan.changes {
+		id := ""
+		if c.rule != nil {
+			id = c.rule.ID
+		}
+		changes = append(changes, fmt.Sprintf("%s %s %d->%d", c.action, id, c.from, c.port))
+	}
+	// Rules added by hand and rules still in use are never moved.
+	assert.Equal(t, []string{
+		"create  0->2222",
+		"create  0->9000",
+		"update lbrule_http 80->8080",
+		"update lbrule_https 0->443",
+	}, changes)
+}
+
+func TestLoadBalancerManager_movedPorts(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	kube := withFakeCluster(lbm, fakeKatapultService())
+	ctx := context.Background()
+
+	named := func(ports ...int32) *v1.Service {
+		service := recorded(t, kube, fakeKatapultService(ports...))
+		service.Spec.Ports[0].Name = "http"
+		return service
+	}
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", named(80, 443), nil)
+	require.NoError(t, err)
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	lb := lbs[0]
+	before := s.LoadBalancerRules(lb.ID)
+	assert.Equal(t, `{"http":80}`, recorded(t, kube, fakeKatapultService()).Annotations[annotationLoadBalancerPortNames])
+
+	t.Run("rolled back", func(t *testing.T) {
+		s.AddFault(fakekatapult.Fault{
+			Method:     http.MethodDelete,
+			Path:       "/core/v1/load_balancers/rules/_",
+			StatusCode: http.StatusInternalServerError,
+			Count:      1,
+		})
+
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", named(8080), nil)
+		assert.Error(t, err)
+		assert.Equal(t, before, s.LoadBalancerRules(lb.ID))
+		service := recorded(t, kube, fakeKatapultService())
+		assert.Equal(t, `{"`+lb.ID+`":[80,443]}`, service.Annotations[annotationLoadBalancerManagedRules])
+		assert.Equal(t, `{"http":80}`, service.Annotations[annotationLoadBalancerPortNames])
+	})
+
+	t.Run("moved", func(t *testing.T) {
+		s.ResetRequests()
+
+		_, err := lbm.EnsureLoadBalancer(ctx, "kce", named(8080, 443), nil)
+		require.NoError(t, err)
+
+		rules := s.LoadBalancerRules(lb.ID)
+		require.Len(t, rules, 2)
+		assert.Equal(t, before[0].ID, rules[0].ID)
+		assert.Equal(t, 8080, rules[0].ListenPort)
+		assert.Equal(t, 38080, rules[0].DestinationPort)
+		assert.Equal(t, []string{"PATCH /core/v1/load_balancers/rules/_"}, mutatingRequests(s))
+
+		service := recorded(t, kube, fakeKatapultService())
+		assert.Equal(t, `{"`+lb.ID+`":[443,8080]}`, service.Annotations[annotationLoadBalancerManagedRules])
+		assert.Equal(t, `{"http":8080}`, service.Annotations[annotationLoadBalancerPortNames])
+	})
+}
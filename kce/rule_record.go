@@ -0,0 +1,166 @@
+package kce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+)
+
+const eventReasonRuleConflict = "LoadBalancerRuleConflict"
+
+// ruleRecord tracks which rules kce-ccm manages on each of a service's load
+// balancers, so that rules added to them by hand are left alone. Katapult
+// rules have no name or description to mark them with, so the listen ports of
+// the managed rules are recorded in an annotation on the service, keyed by
+// load balancer ID. The port each named service port last had is recorded
+// too, so that a port whose number changes can have its rule moved.
+type ruleRecord struct {
+	service *v1.Service
+	ports   map[string][]int
+	names   map[string]int
+
+	// saved and savedNames are the annotation values last written to the
+	// service.
+	saved      string
+	savedNames string
+}
+
+// newRuleRecord loads the rule record from a service. A record that cannot
+// be parsed is treated as missing.
+func newRuleRecord(service *v1.Service) *ruleRecord {
+	r := &ruleRecord{
+		service: service,
+		ports:   map[string][]int{},
+		names:   map[string]int{},
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerManagedRules]; ok {
+		r.saved = v
+		if err := json.Unmarshal([]byte(v), &r.ports); err != nil {
+			r.ports = map[string][]int{}
+		}
+	}
+
+	if v, ok := service.Annotations[annotationLoadBalancerPortNames]; ok {
+		r.savedNames = v
+		if err := json.Unmarshal([]byte(v), &r.names); err != nil {
+			r.names = map[string]int{}
+		}
+	}
+
+	return r
+}
+
+// owned returns the listen ports of the rules managed on a load balancer.
+// Load balancers with no record, such as those managed by earlier versions
+// or just adopted, are assumed to have their service's ports managed, and
+// nothing else.
+func (r *ruleRecord) owned(lbID string) map[int]bool {
+	owned := map[int]bool{}
+
+	ports, ok := r.ports[lbID]
+	if !ok {
+		for _, port := range r.service.Spec.Ports {
+			owned[int(port.Port)] = true
+		}
+		return owned
+	}
+
+	for _, port := range ports {
+		owned[port] = true
+	}
+
+	return owned
+}
+
+// set records the listen ports of the rules managed on a load balancer.
+func (r *ruleRecord) set(lbID string, owned map[int]bool) {
+	ports := []int{}
+	for port := range owned {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	r.ports[lbID] = ports
+}
+
+// retain forgets every load balancer other than those given, such as those
+// that have been deleted.
+func (r *ruleRecord) retain(lbIDs map[string]bool) {
+	for id := range r.ports {
+		if !lbIDs[id] {
+			delete(r.ports, id)
+		}
+	}
+}
+
+// setNames records the port of each of the service's named ports.
+func (r *ruleRecord) setNames(servicePorts []v1.ServicePort) {
+	r.names = map[string]int{}
+	for _, servicePort := range servicePorts {
+		if servicePort.Name != "" {
+			r.names[servicePort.Name] = int(servicePort.Port)
+		}
+	}
+}
+
+func (r *ruleRecord) value() string {
+	// Marshalling a map of int slices cannot fail.
+	b, _ := json.Marshal(r.ports)
+
+	return string(b)
+}
+
+func (r *ruleRecord) namesValue() string {
+	b, _ := json.Marshal(r.names)
+
+	return string(b)
+}
+
+// saveRuleRecord writes the rule record to its service if it has changed.
+// The record is only kept in memory when there is no client, or during a dry
+// run when no rules are changed.
+func (lbm *loadBalancerManager) saveRuleRecord(ctx context.Context, r *ruleRecord) error {
+	if lbm.config.DryRun {
+		return nil
+	}
+
+	annotations := map[string]string{}
+	v := r.value()
+	if _, ok := r.service.Annotations[annotationLoadBalancerManagedRules]; v != r.saved && (ok || len(r.ports) > 0) {
+		annotations[annotationLoadBalancerManagedRules] = v
+	}
+	names := r.namesValue()
+	if _, ok := r.service.Annotations[annotationLoadBalancerPortNames]; names != r.savedNames && (ok || len(r.names) > 0) {
+		annotations[annotationLoadBalancerPortNames] = names
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	if lbm.kube != nil {
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": annotations,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = lbm.kube.CoreV1().Services(r.service.Namespace).Patch(
+			ctx, r.service.Name, types.MergePatchType, patch, metav1.PatchOptions{},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record managed rules: %w", err)
+		}
+	}
+	r.saved = v
+	r.savedNames = names
+
+	return nil
+}
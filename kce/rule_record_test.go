@@ -0,0 +1,126 @@
+package kce
+
+import (
+	"context"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"testing"
+)
+
+func TestRuleRecord_owned(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation *string
+		want       map[int]bool
+	}{
+		{
+			name: "no record",
+			want: map[int]bool{80: true, 443: true},
+		},
+		{
+			name:       "recorded",
+			annotation: stringPtr(`{"lb_1":[80,8080],"lb_2":[443]}`),
+			want:       map[int]bool{80: true, 8080: true},
+		},
+		{
+			name:       "load balancer not recorded",
+			annotation: stringPtr(`{"lb_2":[443]}`),
+			want:       map[int]bool{80: true, 443: true},
+		},
+		{
+			name:       "invalid record",
+			annotation: stringPtr(`80,443`),
+			want:       map[int]bool{80: true, 443: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := fakeKatapultService(80, 443)
+			if tt.annotation != nil {
+				service.Annotations = map[string]string{
+					annotationLoadBalancerManagedRules: *tt.annotation,
+				}
+			}
+
+			assert.Equal(t, tt.want, newRuleRecord(service).owned("lb_1"))
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestLoadBalancerManager_unmanagedRules(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	kube := withFakeCluster(lbm, fakeKatapultService())
+	recorder := record.NewFakeRecorder(10)
+	lbm.recorder = recorder
+	ctx := context.Background()
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", fakeKatapultService(80), nil)
+	require.NoError(t, err)
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	lb := lbs[0]
+
+	stored, err := kube.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, `{"`+lb.ID+`":[80]}`, stored.Annotations[annotationLoadBalancerManagedRules])
+
+	// An operator adds rules by hand, one of which the service later wants.
+	for _, port := range []int{8443, 9000} {
+		_, _, err = lbm.loadBalancerRuleController.Create(ctx, lb.Ref(), core.LoadBalancerRuleArguments{
+			ListenPort:      port,
+			DestinationPort: 31443,
+			Protocol:        core.HTTPProtocol,
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", recorded(t, kube, fakeKatapultService(443, 8443)), nil)
+	require.NoError(t, err)
+
+	rules := s.LoadBalancerRules(lb.ID)
+	assert.Equal(t, []int{8443, 9000, 443}, fakeListenPorts(rules))
+	for _, rule := range rules {
+		if rule.ListenPort != 443 {
+			assert.Equal(t, core.HTTPProtocol, rule.Protocol, "rule for port %d was changed", rule.ListenPort)
+		}
+	}
+	assert.Equal(t, []string{
+		"Warning LoadBalancerRuleConflict Port 8443 is not being served, load balancer " + lb.ID +
+			" already has a rule " + rules[0].ID + " for it that was not created by kce-ccm",
+	}, drainEvents(recorder))
+
+	stored, err = kube.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, `{"`+lb.ID+`":[443]}`, stored.Annotations[annotationLoadBalancerManagedRules])
+}
+
+func TestLoadBalancerManager_ruleRecordPruned(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	lbm.config.ExtraDataCenters = map[string]string{"dc_other": "tag_other"}
+	service := fakeKatapultService(80)
+	service.Annotations = map[string]string{
+		annotationLoadBalancerDataCenters: "dc_fake,dc_other",
+	}
+	kube := withFakeCluster(lbm, service)
+	ctx := context.Background()
+
+	_, err := lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+	require.Len(t, s.LoadBalancers(), 2)
+
+	service = recorded(t, kube, service)
+	service.Annotations[annotationLoadBalancerDataCenters] = "dc_fake"
+	_, err = lbm.EnsureLoadBalancer(ctx, "kce", service, nil)
+	require.NoError(t, err)
+
+	lbs := s.LoadBalancers()
+	require.Len(t, lbs, 1)
+	assert.Equal(t, `{"`+lbs[0].ID+`":[80]}`, recorded(t, kube, service).Annotations[annotationLoadBalancerManagedRules])
+}
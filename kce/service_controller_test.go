@@ -0,0 +1,92 @@
+package kce
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/cloud-provider/controllers/service"
+	"k8s.io/component-base/featuregate"
+	"testing"
+	"time"
+)
+
+// TestServiceController runs the service controller from k8s.io/cloud-provider
+// against the provider, to check how it treats services with a load balancer
+// class. The unit tests call the provider directly, so would not notice the
+// controller skipping a service.
+func TestServiceController(t *testing.T) {
+	s, lbm := newFakeKatapult(t)
+	ctx := context.Background()
+
+	class := "metallb"
+	plain := fakeKatapultService(80)
+	plain.Name = "plain"
+	plain.Spec.Type = v1.ServiceTypeLoadBalancer
+	classy := fakeKatapultService(80)
+	classy.Name = "classy"
+	classy.Spec.Type = v1.ServiceTypeLoadBalancer
+	classy.Spec.LoadBalancerClass = &class
+
+	// A service that is given a class once it has a load balancer, whose load
+	// balancer must then be cleaned up.
+	previous := fakeKatapultService(80)
+	previous.Name = "previous"
+	previous.Spec.Type = v1.ServiceTypeLoadBalancer
+
+	kube := fake.NewSimpleClientset(plain, classy, previous, readyNode("node-1"))
+	lbm.kube = kube
+
+	factory := informers.NewSharedInformerFactory(kube, 0)
+	controller, err := service.New(
+		&provider{loadBalancer: lbm},
+		kube,
+		factory.Core().V1().Services(),
+		factory.Core().V1().Nodes(),
+		"kce",
+		featuregate.NewFeatureGate(),
+	)
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	go controller.Run(stop, 1)
+
+	hasIngress := func(name string) bool {
+		got, err := kube.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+		return err == nil && len(got.Status.LoadBalancer.Ingress) == 1
+	}
+	names := func() []string {
+		names := []string{}
+		for _, lb := range s.LoadBalancers() {
+			names = append(names, lb.Name)
+		}
+		return names
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return hasIngress("plain") && hasIngress("previous"), nil
+	})
+	require.NoError(t, err, "load balancers: %v", names())
+	assert.ElementsMatch(t, []string{"kce-kce-plain", "kce-kce-previous"}, names())
+
+	got, err := kube.CoreV1().Services("default").Get(ctx, "previous", metav1.GetOptions{})
+	require.NoError(t, err)
+	got.Spec.LoadBalancerClass = &class
+	_, err = kube.CoreV1().Services("default").Update(ctx, got, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	err = wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return !hasIngress("previous") && len(names()) == 1, nil
+	})
+	require.NoError(t, err, "load balancers: %v", names())
+
+	// Only the service without a class is given a load balancer, and the
+	// load balancer of the service that now has a class is deleted.
+	assert.Equal(t, []string{"kce-kce-plain"}, names())
+	assert.Len(t, s.LoadBalancerRules(s.LoadBalancers()[0].ID), 1)
+}
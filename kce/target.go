@@ -0,0 +1,150 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	"sort"
+)
+
+type virtualMachineController interface {
+	Get(ctx context.Context, ref core.VirtualMachineRef) (*core.VirtualMachine, *katapult.Response, error)
+	List(ctx context.Context, org core.OrganizationRef, opts *core.ListOptions) ([]*core.VirtualMachine, *katapult.Response, error)
+}
+
+type virtualMachineGroupController interface {
+	List(ctx context.Context, org core.OrganizationRef) ([]*core.VirtualMachineGroup, *katapult.Response, error)
+}
+
+// loadBalancerTarget describes the set of VMs that a load balancer directs
+// traffic to.
+type loadBalancerTarget struct {
+	resourceType core.ResourceType
+	resourceIDs  []string
+}
+
+// matches returns true if the load balancer already directs traffic to the
+// target. The order of resource IDs is not significant.
+func (t loadBalancerTarget) matches(lb *core.LoadBalancer) bool {
+	return lb.ResourceType == t.resourceType && sameIDs(lb.ResourceIDs, t.resourceIDs)
+}
+
+// sameIDs returns true if both slices hold the same IDs in any order.
+func sameIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// listVirtualMachines fetches all VMs for an org, paging where necessary
+func listVirtualMachines(ctx context.Context, vmc virtualMachineController, org core.OrganizationRef) ([]*core.VirtualMachine, error) {
+	list, resp, err := vmc.List(ctx, org, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for page := 2; page <= resp.Pagination.TotalPages; page++ {
+		more, _, err := vmc.List(ctx, org, &core.ListOptions{Page: page})
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, more...)
+	}
+
+	return list, err
+}
+
+// findTagID resolves a tag name to its RID. There is no API for listing tags
+// so we find a VM in the organization that carries the tag.
+func (lbm *loadBalancerManager) findTagID(ctx context.Context, name string) (string, error) {
+	vms, err := listVirtualMachines(ctx, lbm.virtualMachineController, lbm.config.orgRef())
+	if err != nil {
+		return "", err
+	}
+
+	for _, vm := range vms {
+		for _, tag := range vm.Tags {
+			if tag.Name == name {
+				return tag.ID, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no virtual machines found with tag %q", name)
+}
+
+// checkVirtualMachineGroups ensures that every group ID exists in the
+// associated org.
+func (lbm *loadBalancerManager) checkVirtualMachineGroups(ctx context.Context, ids []string) error {
+	groups, _, err := lbm.virtualMachineGroupController.List(ctx, lbm.config.orgRef())
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		found := false
+		for _, group := range groups {
+			if group.ID == id {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("virtual machine group %q does not exist", id)
+		}
+	}
+
+	return nil
+}
+
+// loadBalancerTarget determines which VMs a service's load balancer should
+// direct traffic to. Unless overridden by annotations, this is the node tag
+// for the data center the load balancer is in.
+func (lbm *loadBalancerManager) loadBalancerTarget(ctx context.Context, opts *loadBalancerOptions, dc dataCenter) (loadBalancerTarget, error) {
+	switch {
+	case opts.tagID != "":
+		return loadBalancerTarget{
+			resourceType: core.TagsResourceType,
+			resourceIDs:  []string{opts.tagID},
+		}, nil
+	case opts.tagName != "":
+		id, err := lbm.findTagID(ctx, opts.tagName)
+		if err != nil {
+			return loadBalancerTarget{}, err
+		}
+
+		return loadBalancerTarget{
+			resourceType: core.TagsResourceType,
+			resourceIDs:  []string{id},
+		}, nil
+	case len(opts.vmGroupIDs) > 0:
+		err := lbm.checkVirtualMachineGroups(ctx, opts.vmGroupIDs)
+		if err != nil {
+			return loadBalancerTarget{}, err
+		}
+
+		return loadBalancerTarget{
+			resourceType: core.VirtualMachineGroupsResourceType,
+			resourceIDs:  opts.vmGroupIDs,
+		}, nil
+	}
+
+	return loadBalancerTarget{
+		resourceType: core.VirtualMachineGroupsResourceType,
+		resourceIDs:  []string{dc.nodeTagID},
+	}, nil
+}
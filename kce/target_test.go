@@ -0,0 +1,253 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult"
+	"github.com/krystal/go-katapult/core"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http"
+	"testing"
+)
+
+type mockVMController struct {
+	items []core.VirtualMachine
+}
+
+func (vmc *mockVMController) List(_ context.Context, _ core.OrganizationRef, opts *core.ListOptions) ([]*core.VirtualMachine, *katapult.Response, error) {
+	perPage := 2
+	page := 1
+	if opts != nil {
+		if opts.PerPage != 0 {
+			perPage = opts.PerPage
+		}
+		if opts.Page != 0 {
+			page = opts.Page
+		}
+	}
+
+	pagedOut := make([]*core.VirtualMachine, 0)
+	start := (page - 1) * perPage
+	end := page * perPage
+	if end > len(vmc.items) {
+		end = len(vmc.items)
+	}
+	for i := start; i < end; i++ {
+		copyOfItem := vmc.items[i]
+		if copyOfItem.ID == "error" {
+			return nil, nil, fmt.Errorf("error from %d", i)
+		}
+		pagedOut = append(pagedOut, &copyOfItem)
+	}
+
+	return pagedOut, &katapult.Response{
+		Pagination: &katapult.Pagination{
+			CurrentPage: page,
+			PerPage:     perPage,
+			TotalPages:  int(math.Ceil(float64(len(vmc.items)) / float64(perPage))),
+			Total:       len(vmc.items),
+		},
+	}, nil
+}
+
+func (vmc *mockVMController) Get(_ context.Context, ref core.VirtualMachineRef) (*core.VirtualMachine, *katapult.Response, error) {
+	if ref.ID == "error" || ref.FQDN == "error" {
+		return nil, nil, fmt.Errorf("error from get")
+	}
+
+	for _, vm := range vmc.items {
+		if (ref.ID != "" && vm.ID == ref.ID) || (ref.FQDN != "" && vm.FQDN == ref.FQDN) {
+			copyOfItem := vm
+			return &copyOfItem, &katapult.Response{}, nil
+		}
+	}
+
+	return nil, katapult.NewResponse(&http.Response{StatusCode: 404}), fmt.Errorf("not found")
+}
+
+type mockVMGroupController struct {
+	items []*core.VirtualMachineGroup
+	err   error
+}
+
+func (vmgc *mockVMGroupController) List(_ context.Context, _ core.OrganizationRef) ([]*core.VirtualMachineGroup, *katapult.Response, error) {
+	if vmgc.err != nil {
+		return nil, nil, vmgc.err
+	}
+
+	return vmgc.items, &katapult.Response{}, nil
+}
+
+func TestLoadBalancerTarget_matches(t *testing.T) {
+	tests := []struct {
+		name   string
+		target loadBalancerTarget
+		lb     *core.LoadBalancer
+		want   bool
+	}{
+		{
+			name: "matches",
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"a", "b"},
+			},
+			lb: &core.LoadBalancer{
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"b", "a"},
+			},
+			want: true,
+		},
+		{
+			name: "different type",
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"a"},
+			},
+			lb: &core.LoadBalancer{
+				ResourceType: core.VirtualMachineGroupsResourceType,
+				ResourceIDs:  []string{"a"},
+			},
+			want: false,
+		},
+		{
+			name: "different ids",
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"a", "b"},
+			},
+			lb: &core.LoadBalancer{
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"a", "c"},
+			},
+			want: false,
+		},
+		{
+			name: "different number of ids",
+			target: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"a"},
+			},
+			lb: &core.LoadBalancer{
+				ResourceType: core.TagsResourceType,
+				ResourceIDs:  []string{"a", "b"},
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.target.matches(tt.lb))
+		})
+	}
+}
+
+func TestLoadBalancerManager_loadBalancerTarget(t *testing.T) {
+	tests := []struct {
+		name string
+
+		virtualMachines      []core.VirtualMachine
+		virtualMachineGroups []*core.VirtualMachineGroup
+		opts                 *loadBalancerOptions
+
+		want    loadBalancerTarget
+		wantErr string
+	}{
+		{
+			name: "defaults to node tag",
+			opts: &loadBalancerOptions{},
+			want: loadBalancerTarget{
+				resourceType: core.VirtualMachineGroupsResourceType,
+				resourceIDs:  []string{"node-tag-id"},
+			},
+		},
+		{
+			name: "tag id",
+			opts: &loadBalancerOptions{tagID: "tag_Y1VhjfZDaM4pM6GT"},
+			want: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"tag_Y1VhjfZDaM4pM6GT"},
+			},
+		},
+		{
+			name: "tag name",
+			virtualMachines: []core.VirtualMachine{
+				{ID: "vm_1", Tags: []*core.Tag{{ID: "tag_workers", Name: "workers"}}},
+				{ID: "vm_2"},
+				{ID: "vm_3", Tags: []*core.Tag{{ID: "tag_ingress", Name: "ingress"}}},
+			},
+			opts: &loadBalancerOptions{tagName: "ingress"},
+			want: loadBalancerTarget{
+				resourceType: core.TagsResourceType,
+				resourceIDs:  []string{"tag_ingress"},
+			},
+		},
+		{
+			name: "tag name not found",
+			virtualMachines: []core.VirtualMachine{
+				{ID: "vm_1", Tags: []*core.Tag{{ID: "tag_workers", Name: "workers"}}},
+			},
+			opts:    &loadBalancerOptions{tagName: "ingress"},
+			wantErr: `no virtual machines found with tag "ingress"`,
+		},
+		{
+			name: "tag name lookup error",
+			virtualMachines: []core.VirtualMachine{
+				{ID: "vm_1"},
+				{ID: "vm_2"},
+				{ID: "error"},
+			},
+			opts:    &loadBalancerOptions{tagName: "ingress"},
+			wantErr: "error from 2",
+		},
+		{
+			name: "vm groups",
+			virtualMachineGroups: []*core.VirtualMachineGroup{
+				{ID: "vmgrp_a"},
+				{ID: "vmgrp_b"},
+			},
+			opts: &loadBalancerOptions{vmGroupIDs: []string{"vmgrp_b", "vmgrp_a"}},
+			want: loadBalancerTarget{
+				resourceType: core.VirtualMachineGroupsResourceType,
+				resourceIDs:  []string{"vmgrp_b", "vmgrp_a"},
+			},
+		},
+		{
+			name: "vm group missing",
+			virtualMachineGroups: []*core.VirtualMachineGroup{
+				{ID: "vmgrp_a"},
+			},
+			opts:    &loadBalancerOptions{vmGroupIDs: []string{"vmgrp_a", "vmgrp_b"}},
+			wantErr: `virtual machine group "vmgrp_b" does not exist`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lbm := loadBalancerManager{
+				virtualMachineController:      &mockVMController{items: tt.virtualMachines},
+				virtualMachineGroupController: &mockVMGroupController{items: tt.virtualMachineGroups},
+				log:                           logTest.TestLogger{T: t},
+			}
+
+			got, err := lbm.loadBalancerTarget(context.TODO(), tt.opts, dataCenter{nodeTagID: "node-tag-id"})
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerManager_checkVirtualMachineGroups_error(t *testing.T) {
+	lbm := loadBalancerManager{
+		virtualMachineGroupController: &mockVMGroupController{err: fmt.Errorf("boom")},
+	}
+
+	err := lbm.checkVirtualMachineGroups(context.TODO(), []string{"vmgrp_a"})
+	assert.EqualError(t, err, "boom")
+}
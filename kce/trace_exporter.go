@@ -0,0 +1,40 @@
+package kce
+
+import (
+	"context"
+	"encoding/json"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"sync"
+)
+
+// spanWriter exports spans as JSON, one object per line, in the same format
+// as the upstream stdouttrace exporter. It is used to debug tracing without a
+// collector.
+type spanWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newSpanWriter(w io.Writer) *spanWriter {
+	return &spanWriter{enc: json.NewEncoder(w)}
+}
+
+// ExportSpans writes each span on its own line.
+func (e *spanWriter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, stub := range tracetest.SpanStubsFromReadOnlySpans(spans) {
+		if err := e.enc.Encode(stub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown is a no-op, as nothing is buffered.
+func (e *spanWriter) Shutdown(_ context.Context) error {
+	return nil
+}
@@ -0,0 +1,45 @@
+package kce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestSpanWriter_ExportSpans(t *testing.T) {
+	var buf bytes.Buffer
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(newSpanWriter(&buf)))
+	tracer := tp.Tracer(tracerName)
+	ctx, parent := tracer.Start(context.Background(), "LoadBalancer.EnsureLoadBalancer")
+	_, child := tracer.Start(ctx, "katapult.LoadBalancers.Create", trace.WithSpanKind(trace.SpanKindClient))
+	child.SetAttributes(attributeHTTPStatusCode.Int(422))
+	endSpan(child, fmt.Errorf("validation_error"))
+	parent.End()
+
+	var got []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var span map[string]interface{}
+		require.NoError(t, dec.Decode(&span))
+		got = append(got, span)
+	}
+	require.Len(t, got, 2)
+
+	span := got[0]
+	assert.Equal(t, "katapult.LoadBalancers.Create", span["Name"])
+	assert.Equal(t, parent.SpanContext().TraceID().String(), span["SpanContext"].(map[string]interface{})["TraceID"])
+	assert.Equal(t, parent.SpanContext().SpanID().String(), span["Parent"].(map[string]interface{})["SpanID"])
+	assert.Equal(t, map[string]interface{}{"Code": float64(codes.Error), "Description": "validation_error"}, span["Status"])
+	assert.Contains(t, span["Attributes"], map[string]interface{}{
+		"Key":   "http.status_code",
+		"Value": map[string]interface{}{"Type": "INT64", "Value": float64(422)},
+	})
+	assert.Equal(t, "LoadBalancer.EnsureLoadBalancer", got[1]["Name"])
+}
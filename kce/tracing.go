@@ -0,0 +1,89 @@
+package kce
+
+import (
+	"context"
+	"github.com/krystal/go-katapult"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+// tracerName identifies spans created by the provider.
+const tracerName = "github.com/krystal/kce-ccm/kce"
+
+// Attributes recorded on spans, alongside the log keys where they overlap.
+const (
+	attributeHTTPStatusCode     = attribute.Key("http.status_code")
+	attributeKatapultPage       = attribute.Key("katapult.page")
+	attributeDeletePollAttempts = attribute.Key("kce.delete_poll_attempts")
+	attributeRetries            = attribute.Key("kce.retries")
+	attributeRetryWait          = attribute.Key("kce.retry_wait_ms")
+)
+
+// newTracerProvider creates a tracer provider that batches spans and sends
+// them to each of the exporters.
+func newTracerProvider(exporters ...sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(sdkresource.NewSchemaless(
+			attribute.String("service.name", eventComponent),
+		)),
+	}
+	for _, exporter := range exporters {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// startSpan starts a span using the global tracer provider. Unless tracing
+// is configured this is a no-op.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endSpan records the outcome of an operation and ends its span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// serviceAttributes describes the service a cloudprovider method was called
+// for.
+func serviceAttributes(clusterName string, service *v1.Service) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(logKeyClusterName, clusterName),
+		attribute.String(logKeyServiceNamespace, service.Namespace),
+		attribute.String(logKeyServiceName, service.Name),
+		attribute.String(logKeyServiceUID, string(service.UID)),
+	}
+}
+
+// nodeAttributes describes the node a cloudprovider method was called for.
+func nodeAttributes(node *v1.Node) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(logKeyNodeName, node.Name),
+	}
+}
+
+// endKatapultSpan records the response to a Katapult API request and ends its
+// span.
+func endKatapultSpan(span trace.Span, resp *katapult.Response, err error) {
+	if resp != nil && resp.Response != nil {
+		span.SetAttributes(attributeHTTPStatusCode.Int(resp.StatusCode))
+		if id := resp.Header.Get(katapultRequestIDHeader); id != "" {
+			span.SetAttributes(attribute.String(logKeyRequestID, id))
+		}
+	}
+
+	endSpan(span, err)
+}
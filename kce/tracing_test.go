@@ -0,0 +1,112 @@
+package kce
+
+import (
+	"context"
+	"fmt"
+	logTest "github.com/go-logr/logr/testing"
+	"github.com/krystal/go-katapult"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"testing"
+)
+
+// recordSpans installs a global tracer provider that records spans in memory
+// for the duration of a test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	return exporter
+}
+
+func TestLoadBalancerManager_EnsureLoadBalancer_tracing(t *testing.T) {
+	exporter := recordSpans(t)
+	lbm := loadBalancerManager{
+		config:                     Config{NodeTagID: "node-tag-id"},
+		loadBalancerController:     tracedLoadBalancerController{next: &mockLBController{}},
+		loadBalancerRuleController: tracedLoadBalancerRuleController{next: &mockLBRController{}},
+		log:                        logTest.TestLogger{T: t},
+	}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bar",
+			Namespace: "foobar",
+		},
+	}
+
+	_, err := lbm.EnsureLoadBalancer(context.TODO(), "example", service, []*v1.Node{})
+	assert.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	names := []string{}
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{
+		"katapult.LoadBalancers.List",
+		"katapult.LoadBalancers.Create",
+		"katapult.LoadBalancerRules.List",
+		"LoadBalancer.EnsureLoadBalancer",
+	}, names)
+
+	root := spans[len(spans)-1]
+	assert.False(t, root.Parent.IsValid())
+	assert.Contains(t, root.Attributes, attribute.String("serviceName", "bar"))
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID(), span.Name)
+		assert.Equal(t, trace.SpanKindClient, span.SpanKind, span.Name)
+	}
+}
+
+func TestLoadBalancerManager_EnsureLoadBalancer_tracingError(t *testing.T) {
+	exporter := recordSpans(t)
+	lbm := loadBalancerManager{
+		log: logTest.TestLogger{T: t},
+	}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationLoadBalancerTagID: "",
+			},
+		},
+	}
+
+	_, err := lbm.EnsureLoadBalancer(context.TODO(), "example", service, []*v1.Node{})
+	assert.Error(t, err)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Equal(t, err.Error(), spans[0].Status.Description)
+}
+
+func Test_endKatapultSpan(t *testing.T) {
+	exporter := recordSpans(t)
+
+	_, span := startKatapultSpan(context.TODO(), "LoadBalancers.Get", nil)
+	endKatapultSpan(span, katapult.NewResponse(&http.Response{
+		StatusCode: http.StatusNotFound,
+		Header:     http.Header{"X-Request-Id": []string{"req-123"}},
+	}), fmt.Errorf("load_balancer_not_found"))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "katapult.LoadBalancers.Get", spans[0].Name)
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.Int("http.status_code", 404),
+		attribute.String("requestId", "req-123"),
+	}, spans[0].Attributes)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+}